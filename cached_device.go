@@ -0,0 +1,364 @@
+package fs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// CacheMode selects when the writes to a CachedDevice reach the device
+// underneath it.
+type CacheMode int
+
+const (
+	// WriteThrough writes to the device right away and keeps the cache
+	// up to date with what was written.
+	WriteThrough CacheMode = iota
+
+	// WriteBack only writes to the cache. The changed blocks are written
+	// to the device when they are evicted, or by Flush and Close.
+	WriteBack
+)
+
+// The default memory bound of a CachedDevice.
+const DefaultCacheMemory = 4 * 1024 * 1024
+
+// CachedDeviceOptions are the options for NewCachedDevice.
+type CachedDeviceOptions struct {
+	// BlockSize is the size of the blocks that are cached, which must be
+	// a multiple of the sector size of the device. Using the cluster size
+	// of the filesystem on the device caches whole clusters. If it is
+	// zero, the sector size is used.
+	BlockSize int
+
+	// MaxMemory is the most bytes of data that are cached. The least
+	// recently used blocks are evicted to stay within it. If it is zero,
+	// DefaultCacheMemory is used. At least one block is always cached.
+	MaxMemory int64
+
+	// ReadAhead is the number of blocks that are read along with a
+	// block that is missing from the cache, when the reads are
+	// sequential. If it is zero, there is no read-ahead.
+	ReadAhead int
+
+	// Mode is when writes reach the device.
+	Mode CacheMode
+}
+
+// A CachedDevice is a BlockDevice that keeps the most recently used
+// blocks of another BlockDevice in memory. It is safe for concurrent use.
+type CachedDevice struct {
+	device    BlockDevice
+	options   CachedDeviceOptions
+	maxBlocks int
+
+	lock sync.Mutex
+
+	// blocks maps the index of every cached block to its element in
+	// lru, which holds the most recently used block at the front.
+	blocks map[int64]*list.Element
+	lru    *list.List
+
+	// next is the block after the last one that was read, used to
+	// detect sequential reads.
+	next int64
+}
+
+// cacheBlock is a single cached block of a CachedDevice.
+type cacheBlock struct {
+	index int64
+	data  []byte
+	dirty bool
+}
+
+// NewCachedDevice returns a CachedDevice that caches the given device.
+// If options is nil, the defaults are used.
+func NewCachedDevice(device BlockDevice, options *CachedDeviceOptions) (*CachedDevice, error) {
+	var opts CachedDeviceOptions
+	if options != nil {
+		opts = *options
+	}
+
+	if opts.BlockSize == 0 {
+		opts.BlockSize = device.SectorSize()
+	}
+
+	if opts.BlockSize < 0 || opts.BlockSize%device.SectorSize() != 0 {
+		return nil, fmt.Errorf("block size %d is not a multiple of the sector size %d",
+			opts.BlockSize, device.SectorSize())
+	}
+
+	if opts.MaxMemory == 0 {
+		opts.MaxMemory = DefaultCacheMemory
+	}
+
+	if opts.MaxMemory < 0 || opts.ReadAhead < 0 {
+		return nil, errors.New("invalid cache options")
+	}
+
+	if opts.Mode != WriteThrough && opts.Mode != WriteBack {
+		return nil, fmt.Errorf("unknown cache mode: %d", opts.Mode)
+	}
+
+	maxBlocks := int(opts.MaxMemory / int64(opts.BlockSize))
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+
+	result := &CachedDevice{
+		device:    device,
+		options:   opts,
+		maxBlocks: maxBlocks,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+		next:      -1,
+	}
+
+	return result, nil
+}
+
+// Close flushes the cache and closes the device underneath it.
+func (c *CachedDevice) Close() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	return c.device.Close()
+}
+
+func (c *CachedDevice) Len() int64 {
+	return c.device.Len()
+}
+
+func (c *CachedDevice) SectorSize() int {
+	return c.device.SectorSize()
+}
+
+func (c *CachedDevice) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if off+int64(len(p)) > c.device.Len() {
+		if off >= c.device.Len() {
+			return 0, io.EOF
+		}
+
+		p = p[:c.device.Len()-off]
+		err = io.EOF
+	}
+
+	bs := int64(c.options.BlockSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / bs
+		block, berr := c.block(index, true)
+		if berr != nil {
+			return n, berr
+		}
+
+		n += copy(p[n:], block.data[pos-index*bs:])
+		c.next = index + 1
+	}
+
+	return n, err
+}
+
+func (c *CachedDevice) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if off+int64(len(p)) > c.device.Len() {
+		return 0, errors.New("write past the end of the device")
+	}
+
+	if c.options.Mode == WriteThrough {
+		if n, err := c.device.WriteAt(p, off); err != nil {
+			return n, err
+		}
+	}
+
+	bs := int64(c.options.BlockSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / bs
+		start := pos - index*bs
+		whole := start == 0 && int64(len(p)-n) >= c.blockLen(index)
+
+		var block *cacheBlock
+		if element, ok := c.blocks[index]; ok {
+			block = element.Value.(*cacheBlock)
+			c.lru.MoveToFront(element)
+		} else if whole {
+			// The block is overwritten completely, so there is no need
+			// to read it first.
+			block, err = c.insert(index, make([]byte, c.blockLen(index)))
+			if err != nil {
+				return n, err
+			}
+		} else if c.options.Mode == WriteBack {
+			if block, err = c.block(index, false); err != nil {
+				return n, err
+			}
+		} else {
+			// Write-through doesn't need the block cached at all
+			n += int(c.blockLen(index) - start)
+			continue
+		}
+
+		n += copy(block.data[start:], p[n:])
+		if c.options.Mode == WriteBack {
+			block.dirty = true
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes every block that was changed to the device. Blocks that
+// are next to each other are written together.
+func (c *CachedDevice) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var dirty []*cacheBlock
+	for _, element := range c.blocks {
+		if block := element.Value.(*cacheBlock); block.dirty {
+			dirty = append(dirty, block)
+		}
+	}
+
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].index < dirty[j].index
+	})
+
+	bs := int64(c.options.BlockSize)
+	for start := 0; start < len(dirty); {
+		end := start + 1
+		for end < len(dirty) && dirty[end].index == dirty[end-1].index+1 {
+			end++
+		}
+
+		data := make([]byte, 0, int64(end-start)*bs)
+		for _, block := range dirty[start:end] {
+			data = append(data, block.data...)
+		}
+
+		if _, err := c.device.WriteAt(data, dirty[start].index*bs); err != nil {
+			return err
+		}
+
+		for _, block := range dirty[start:end] {
+			block.dirty = false
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// block returns the block with the given index, reading it from the
+// device if it isn't cached. If readAhead is true and the reads are
+// sequential, the blocks after it are read along with it.
+func (c *CachedDevice) block(index int64, readAhead bool) (*cacheBlock, error) {
+	if element, ok := c.blocks[index]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cacheBlock), nil
+	}
+
+	bs := int64(c.options.BlockSize)
+	count := int64(1)
+	if readAhead && index == c.next {
+		last := (c.device.Len() - 1) / bs
+		for count <= int64(c.options.ReadAhead) && index+count <= last {
+			if _, ok := c.blocks[index+count]; ok {
+				break
+			}
+
+			count++
+		}
+
+		// Never read ahead more than fits in the cache
+		if count > int64(c.maxBlocks) {
+			count = int64(c.maxBlocks)
+		}
+	}
+
+	size := int64(0)
+	for i := index; i < index+count; i++ {
+		size += c.blockLen(i)
+	}
+
+	data := make([]byte, size)
+	if _, err := c.device.ReadAt(data, index*bs); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Insert the blocks read ahead first, so that the block that was
+	// asked for is the most recently used one.
+	var result *cacheBlock
+	for i := index + count - 1; i >= index; i-- {
+		start := (i - index) * bs
+		block, err := c.insert(i, data[start:start+c.blockLen(i)])
+		if err != nil {
+			return nil, err
+		}
+
+		result = block
+	}
+
+	return result, nil
+}
+
+// insert adds a block to the cache as the most recently used one,
+// evicting the least recently used blocks to make room for it.
+func (c *CachedDevice) insert(index int64, data []byte) (*cacheBlock, error) {
+	for c.lru.Len() >= c.maxBlocks {
+		if err := c.evict(); err != nil {
+			return nil, err
+		}
+	}
+
+	block := &cacheBlock{index: index, data: data}
+	c.blocks[index] = c.lru.PushFront(block)
+	return block, nil
+}
+
+// evict drops the least recently used block, writing it to the device
+// first if it was changed.
+func (c *CachedDevice) evict() error {
+	element := c.lru.Back()
+	block := element.Value.(*cacheBlock)
+	if block.dirty {
+		offset := block.index * int64(c.options.BlockSize)
+		if _, err := c.device.WriteAt(block.data, offset); err != nil {
+			return err
+		}
+	}
+
+	c.lru.Remove(element)
+	delete(c.blocks, block.index)
+	return nil
+}
+
+// blockLen returns the length of the block with the given index, which
+// is only less than the block size for the last block of the device.
+func (c *CachedDevice) blockLen(index int64) int64 {
+	bs := int64(c.options.BlockSize)
+	if remaining := c.device.Len() - index*bs; remaining < bs {
+		return remaining
+	}
+
+	return bs
+}
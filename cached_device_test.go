@@ -0,0 +1,262 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCachedDeviceImplementsBlockDevice(t *testing.T) {
+	var raw interface{}
+	raw = new(CachedDevice)
+	if _, ok := raw.(BlockDevice); !ok {
+		t.Fatal("CachedDevice should be a BlockDevice")
+	}
+}
+
+func TestNewCachedDevice_badBlockSize(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	_, err := NewCachedDevice(device, &CachedDeviceOptions{BlockSize: 1000})
+	if err == nil {
+		t.Fatal("should error if the block size isn't a multiple of the sector size")
+	}
+}
+
+func TestCachedDevice_ReadAt(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	cache, err := NewCachedDevice(device, &CachedDeviceOptions{BlockSize: 1024})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A read that isn't aligned to the blocks
+	data := make([]byte, 1500)
+	if _, err := cache.ReadAt(data, 700); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(data, device.data[700:2200]) {
+		t.Fatal("bad data")
+	}
+
+	if device.reads != 3 {
+		t.Fatalf("bad reads: %d", device.reads)
+	}
+
+	// Everything is cached now
+	if _, err := cache.ReadAt(data[:100], 1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if device.reads != 3 {
+		t.Fatalf("bad reads: %d", device.reads)
+	}
+
+	// Reading past the end is cut short
+	n, err := cache.ReadAt(data, int64(len(device.data))-10)
+	if n != 10 || err == nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestCachedDevice_readAhead(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	cache, err := NewCachedDevice(device, &CachedDeviceOptions{ReadAhead: 4})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Read every sector in order
+	data := make([]byte, 512)
+	for off := int64(0); off < int64(len(device.data)); off += 512 {
+		if _, err := cache.ReadAt(data, off); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !bytes.Equal(data, device.data[off:off+512]) {
+			t.Fatalf("bad data at %d", off)
+		}
+	}
+
+	// The first read isn't sequential, then every miss reads 5 sectors
+	if device.reads != 1+(64-1+4)/5 {
+		t.Fatalf("bad reads: %d", device.reads)
+	}
+}
+
+func TestCachedDevice_MaxMemory(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	cache, err := NewCachedDevice(device, &CachedDeviceOptions{MaxMemory: 4 * 512})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := make([]byte, 512)
+	for _, sector := range []int64{0, 1, 2, 3, 4, 0} {
+		if _, err := cache.ReadAt(data, sector*512); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Sector 0 was evicted to make room for sector 4
+	if device.reads != 6 || len(cache.blocks) != 4 {
+		t.Fatalf("bad: %d %d", device.reads, len(cache.blocks))
+	}
+}
+
+func TestCachedDevice_WriteAt_writeThrough(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	cache, err := NewCachedDevice(device, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := make([]byte, 512)
+	if _, err := cache.ReadAt(data, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := cache.WriteAt([]byte("hello"), 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(device.data[10:15]) != "hello" {
+		t.Fatal("should be written to the device")
+	}
+
+	if _, err := cache.ReadAt(data, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data[10:15]) != "hello" || device.reads != 1 {
+		t.Fatalf("cache should be updated: %d", device.reads)
+	}
+}
+
+func TestCachedDevice_WriteAt_writeBack(t *testing.T) {
+	device := cachedTestDevice(t, 64*512)
+	cache, err := NewCachedDevice(device, &CachedDeviceOptions{
+		MaxMemory: 4 * 512,
+		Mode:      WriteBack,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A partial write and a write of two whole sectors
+	if _, err := cache.WriteAt([]byte("hello"), 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := cache.WriteAt(bytes.Repeat([]byte("x"), 1024), 1024); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if device.writes != 0 || device.reads != 1 {
+		t.Fatalf("bad: %d %d", device.writes, device.reads)
+	}
+
+	data := make([]byte, 5)
+	if _, err := cache.ReadAt(data, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data) != "hello" {
+		t.Fatalf("bad data: %q", data)
+	}
+
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Sector 0 and sectors 2 and 3 are written
+	if device.writes != 2 || string(device.data[10:15]) != "hello" || device.data[2047] != 'x' {
+		t.Fatalf("bad writes: %d", device.writes)
+	}
+
+	// A dirty block that is evicted is written out
+	if _, err := cache.WriteAt([]byte("bye"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for sector := int64(10); sector < 14; sector++ {
+		if _, err := cache.ReadAt(data, sector*512); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if device.writes != 3 || string(device.data[:3]) != "bye" {
+		t.Fatalf("bad writes: %d", device.writes)
+	}
+}
+
+// cachedTestBackingDevice is an in-memory BlockDevice that counts the
+// calls made to it.
+type cachedTestBackingDevice struct {
+	data   []byte
+	reads  int
+	writes int
+}
+
+func cachedTestDevice(t *testing.T, size int) *cachedTestBackingDevice {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	return &cachedTestBackingDevice{data: data}
+}
+
+func (d *cachedTestBackingDevice) Close() error    { return nil }
+func (d *cachedTestBackingDevice) Len() int64      { return int64(len(d.data)) }
+func (d *cachedTestBackingDevice) SectorSize() int { return 512 }
+
+func (d *cachedTestBackingDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.reads++
+	return copy(p, d.data[off:]), nil
+}
+
+func (d *cachedTestBackingDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.writes++
+	return copy(d.data[off:], p), nil
+}
+
+func TestCachedDevice_fileDisk(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-fs")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Truncate(64 * 512); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	disk, err := NewFileDisk(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cache, err := NewCachedDevice(disk, &CachedDeviceOptions{Mode: WriteBack})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := cache.WriteAt([]byte("hello"), 64*512-5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data[len(data)-5:]) != "hello" {
+		t.Fatal("should be flushed on close")
+	}
+}
@@ -1,11 +1,19 @@
 package fs
 
+import (
+	"os"
+	"time"
+)
+
 // Directory is an entry in a filesystem that stores files.
 type Directory interface {
 	Entry(name string) DirectoryEntry
 	Entries() []DirectoryEntry
 	AddDirectory(name string) (DirectoryEntry, error)
 	AddFile(name string) (DirectoryEntry, error)
+
+	// Remove removes the file or empty directory with the given name.
+	Remove(name string) error
 }
 
 // DirectoryEntry represents a single entry within a directory,
@@ -16,3 +24,15 @@ type DirectoryEntry interface {
 	Dir() (Directory, error)
 	File() (File, error)
 }
+
+// DirectoryEntryInfo is an optional interface implemented by directory
+// entries that can report the metadata stored alongside them. The
+// methods have the same meaning as those of os.FileInfo.
+type DirectoryEntryInfo interface {
+	DirectoryEntry
+
+	Size() int64
+	Mode() os.FileMode
+	ModTime() time.Time
+	Sys() interface{}
+}
@@ -0,0 +1,127 @@
+package exfat
+
+import (
+	"errors"
+)
+
+// The size of the pieces of the bitmap that are tracked as changed, and
+// written out as a whole, if the sector size isn't known.
+const defaultBitmapSectorSize = 512
+
+// Bitmap is the allocation bitmap of an exFAT filesystem. Each bit
+// records whether a cluster in the cluster heap is in use.
+type Bitmap struct {
+	data         []byte
+	clusterCount uint32
+
+	// dirty marks the sectors of the bitmap that changed since it was
+	// last written out.
+	sectorSize int
+	dirty      []bool
+}
+
+// NewBitmap creates a new, completely free, allocation bitmap.
+func NewBitmap(clusterCount uint32) *Bitmap {
+	result := decodeBitmap(make([]byte, (clusterCount+7)/8), clusterCount, defaultBitmapSectorSize)
+	for i := range result.dirty {
+		result.dirty[i] = true
+	}
+
+	return result
+}
+
+// decodeBitmap returns the bitmap with the given raw data, which was
+// read from a device with the given sector size.
+func decodeBitmap(data []byte, clusterCount uint32, sectorSize int) *Bitmap {
+	return &Bitmap{
+		data:         data,
+		clusterCount: clusterCount,
+		sectorSize:   sectorSize,
+		dirty:        make([]bool, (len(data)+sectorSize-1)/sectorSize),
+	}
+}
+
+// Bytes returns the raw bytes of the bitmap.
+func (b *Bitmap) Bytes() []byte {
+	return b.data
+}
+
+// InUse returns true if the given cluster is allocated.
+func (b *Bitmap) InUse(cluster uint32) bool {
+	idx := cluster - FirstCluster
+	return b.data[idx/8]&(1<<(idx%8)) != 0
+}
+
+// Set marks the given cluster as allocated or free.
+func (b *Bitmap) Set(cluster uint32, used bool) {
+	idx := cluster - FirstCluster
+	if used {
+		b.data[idx/8] |= 1 << (idx % 8)
+	} else {
+		b.data[idx/8] &^= 1 << (idx % 8)
+	}
+
+	b.dirty[int(idx/8)/b.sectorSize] = true
+}
+
+// flush calls write with every run of sectors of the bitmap that changed
+// since the last flush, along with the offset of the run in the bitmap.
+func (b *Bitmap) flush(write func(off int64, data []byte) error) error {
+	for start := 0; start < len(b.dirty); start++ {
+		if !b.dirty[start] {
+			continue
+		}
+
+		end := start + 1
+		for end < len(b.dirty) && b.dirty[end] {
+			end++
+		}
+
+		last := end * b.sectorSize
+		if last > len(b.data) {
+			last = len(b.data)
+		}
+
+		if err := write(int64(start*b.sectorSize), b.data[start*b.sectorSize:last]); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	for i := range b.dirty {
+		b.dirty[i] = false
+	}
+
+	return nil
+}
+
+// Alloc finds a free cluster, marks it as allocated and returns it.
+func (b *Bitmap) Alloc() (uint32, error) {
+	for i := uint32(0); i < b.clusterCount; i++ {
+		if b.data[i/8] == 0xFF {
+			i += 7
+			continue
+		}
+
+		cluster := i + FirstCluster
+		if !b.InUse(cluster) {
+			b.Set(cluster, true)
+			return cluster, nil
+		}
+	}
+
+	return 0, errors.New("volume is full")
+}
+
+// FreeCount returns the number of free clusters.
+func (b *Bitmap) FreeCount() uint32 {
+	var free uint32
+	for i := uint32(0); i < b.clusterCount; i++ {
+		if !b.InUse(i + FirstCluster) {
+			free++
+		}
+	}
+
+	return free
+}
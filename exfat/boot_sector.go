@@ -0,0 +1,205 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// The first cluster that can really hold user data is always 2
+const FirstCluster = 2
+
+// The number of sectors in a boot region: the boot sector, 8 extended
+// boot sectors, the OEM parameters, a reserved sector and the checksum.
+const BootRegionSectors = 12
+
+// The sector that the backup boot region starts at.
+const BackupBootRegionSector = BootRegionSectors
+
+// BootSector is the exFAT boot sector, which describes the layout of
+// the volume.
+type BootSector struct {
+	PartitionOffset             uint64
+	VolumeLength                uint64
+	FATOffset                   uint32
+	FATLength                   uint32
+	ClusterHeapOffset           uint32
+	ClusterCount                uint32
+	FirstClusterOfRootDirectory uint32
+	VolumeSerialNumber          uint32
+	FileSystemRevision          uint16
+	VolumeFlags                 uint16
+	BytesPerSectorShift         uint8
+	SectorsPerClusterShift      uint8
+	NumberOfFATs                uint8
+	DriveSelect                 uint8
+	PercentInUse                uint8
+}
+
+// DecodeBootSector takes a BlockDevice and decodes the exFAT boot sector
+// from it. The checksum of the main boot region is verified.
+func DecodeBootSector(device fs.BlockDevice) (*BootSector, error) {
+	var sector [512]byte
+	if _, err := device.ReadAt(sector[:], 0); err != nil {
+		return nil, err
+	}
+
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return nil, errors.New("corrupt boot sector signature")
+	}
+
+	if string(sector[3:11]) != "EXFAT   " {
+		return nil, errors.New("not an exFAT filesystem")
+	}
+
+	result := new(BootSector)
+	result.PartitionOffset = binary.LittleEndian.Uint64(sector[64:72])
+	result.VolumeLength = binary.LittleEndian.Uint64(sector[72:80])
+	result.FATOffset = binary.LittleEndian.Uint32(sector[80:84])
+	result.FATLength = binary.LittleEndian.Uint32(sector[84:88])
+	result.ClusterHeapOffset = binary.LittleEndian.Uint32(sector[88:92])
+	result.ClusterCount = binary.LittleEndian.Uint32(sector[92:96])
+	result.FirstClusterOfRootDirectory = binary.LittleEndian.Uint32(sector[96:100])
+	result.VolumeSerialNumber = binary.LittleEndian.Uint32(sector[100:104])
+	result.FileSystemRevision = binary.LittleEndian.Uint16(sector[104:106])
+	result.VolumeFlags = binary.LittleEndian.Uint16(sector[106:108])
+	result.BytesPerSectorShift = sector[108]
+	result.SectorsPerClusterShift = sector[109]
+	result.NumberOfFATs = sector[110]
+	result.DriveSelect = sector[111]
+	result.PercentInUse = sector[112]
+
+	if result.BytesPerSectorShift < 9 || result.BytesPerSectorShift > 12 {
+		return nil, fmt.Errorf("invalid bytes per sector shift: %d", result.BytesPerSectorShift)
+	}
+
+	if result.BytesPerSectorShift+result.SectorsPerClusterShift > 25 {
+		return nil, fmt.Errorf("invalid sectors per cluster shift: %d", result.SectorsPerClusterShift)
+	}
+
+	if result.NumberOfFATs != 1 && result.NumberOfFATs != 2 {
+		return nil, fmt.Errorf("invalid number of FATs: %d", result.NumberOfFATs)
+	}
+
+	if result.FirstClusterOfRootDirectory < FirstCluster ||
+		result.FirstClusterOfRootDirectory >= result.ClusterCount+FirstCluster {
+		return nil, fmt.Errorf("invalid root directory cluster: %d", result.FirstClusterOfRootDirectory)
+	}
+
+	// Verify the checksum of the whole boot region
+	bytesPerSector := int(result.BytesPerSector())
+	region := make([]byte, BootRegionSectors*bytesPerSector)
+	if _, err := device.ReadAt(region, 0); err != nil {
+		return nil, err
+	}
+
+	checksum := bootChecksum(region[:(BootRegionSectors-1)*bytesPerSector])
+	checksumSector := region[(BootRegionSectors-1)*bytesPerSector:]
+	if binary.LittleEndian.Uint32(checksumSector[0:4]) != checksum {
+		return nil, errors.New("boot region checksum mismatch")
+	}
+
+	return result, nil
+}
+
+// Bytes returns the raw bytes of the boot sector, which is a single
+// sector in length.
+func (b *BootSector) Bytes() []byte {
+	sector := make([]byte, b.BytesPerSector())
+
+	// JumpBoot
+	sector[0] = 0xEB
+	sector[1] = 0x76
+	sector[2] = 0x90
+
+	// FileSystemName
+	copy(sector[3:11], "EXFAT   ")
+
+	// MustBeZero is sector[11:64]
+
+	binary.LittleEndian.PutUint64(sector[64:72], b.PartitionOffset)
+	binary.LittleEndian.PutUint64(sector[72:80], b.VolumeLength)
+	binary.LittleEndian.PutUint32(sector[80:84], b.FATOffset)
+	binary.LittleEndian.PutUint32(sector[84:88], b.FATLength)
+	binary.LittleEndian.PutUint32(sector[88:92], b.ClusterHeapOffset)
+	binary.LittleEndian.PutUint32(sector[92:96], b.ClusterCount)
+	binary.LittleEndian.PutUint32(sector[96:100], b.FirstClusterOfRootDirectory)
+	binary.LittleEndian.PutUint32(sector[100:104], b.VolumeSerialNumber)
+	binary.LittleEndian.PutUint16(sector[104:106], b.FileSystemRevision)
+	binary.LittleEndian.PutUint16(sector[106:108], b.VolumeFlags)
+	sector[108] = b.BytesPerSectorShift
+	sector[109] = b.SectorsPerClusterShift
+	sector[110] = b.NumberOfFATs
+	sector[111] = b.DriveSelect
+	sector[112] = b.PercentInUse
+
+	// BootSignature
+	sector[510] = 0x55
+	sector[511] = 0xAA
+
+	return sector
+}
+
+// RegionBytes returns the raw bytes of an entire boot region: the boot
+// sector, the extended boot sectors, the OEM parameters, the reserved
+// sector and the boot checksum sector.
+func (b *BootSector) RegionBytes() []byte {
+	bytesPerSector := int(b.BytesPerSector())
+	region := make([]byte, BootRegionSectors*bytesPerSector)
+	copy(region, b.Bytes())
+
+	// Extended boot sectors only have a signature
+	for i := 1; i <= 8; i++ {
+		end := (i + 1) * bytesPerSector
+		binary.LittleEndian.PutUint32(region[end-4:end], 0xAA550000)
+	}
+
+	checksum := bootChecksum(region[:(BootRegionSectors-1)*bytesPerSector])
+	checksumSector := region[(BootRegionSectors-1)*bytesPerSector:]
+	for i := 0; i < len(checksumSector); i += 4 {
+		binary.LittleEndian.PutUint32(checksumSector[i:i+4], checksum)
+	}
+
+	return region
+}
+
+// BytesPerSector returns the number of bytes per sector.
+func (b *BootSector) BytesPerSector() uint32 {
+	return 1 << b.BytesPerSectorShift
+}
+
+// BytesPerCluster returns the number of bytes per cluster.
+func (b *BootSector) BytesPerCluster() uint32 {
+	return 1 << (b.BytesPerSectorShift + b.SectorsPerClusterShift)
+}
+
+// ClusterOffset returns the offset of the data section of a particular
+// cluster.
+func (b *BootSector) ClusterOffset(n uint32) int64 {
+	offset := int64(b.ClusterHeapOffset) << b.BytesPerSectorShift
+	offset += int64(n-FirstCluster) * int64(b.BytesPerCluster())
+	return offset
+}
+
+// FATOffsetBytes returns the offset in bytes of the given FAT.
+func (b *BootSector) FATOffsetBytes(n int) int64 {
+	offset := int64(b.FATOffset) + int64(n)*int64(b.FATLength)
+	return offset << b.BytesPerSectorShift
+}
+
+// bootChecksum computes the checksum of the boot region, which skips
+// the VolumeFlags and PercentInUse fields since those change at runtime.
+func bootChecksum(data []byte) uint32 {
+	var checksum uint32
+	for i, b := range data {
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+
+		checksum = ((checksum & 1) << 31) + (checksum >> 1) + uint32(b)
+	}
+
+	return checksum
+}
@@ -0,0 +1,448 @@
+package exfat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// Directory implements fs.Directory and is used to interface with
+// a directory on an exFAT filesystem. There is only one Directory for
+// every directory of a FileSystem, which every handle shares.
+type Directory struct {
+	fs       *FileSystem
+	clusters []uint32
+	data     []byte
+
+	// list holds the entries in use, in the order of their slots. They
+	// are decoded once and then kept up to date by every change, so that
+	// every handle of an entry shares the same entry set.
+	list []*DirectoryEntry
+
+	// entry is the entry of this directory in its parent, or nil if this
+	// is the root directory.
+	entry *DirectoryEntry
+}
+
+// DirectoryEntry implements fs.DirectoryEntry and represents a single
+// file/folder within a directory in an exFAT filesystem.
+type DirectoryEntry struct {
+	dir    *Directory
+	offset int
+	count  int
+	set    *EntrySet
+}
+
+func (d *DirectoryEntry) Dir() (fs.Directory, error) {
+	if !d.IsDir() {
+		panic("not a directory")
+	}
+
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	return d.dir.fs.directory(d)
+}
+
+func (d *DirectoryEntry) File() (fs.File, error) {
+	if d.IsDir() {
+		panic("not a file")
+	}
+
+	return &File{entry: d}, nil
+}
+
+func (d *DirectoryEntry) IsDir() bool {
+	return d.set.IsDir()
+}
+
+func (d *DirectoryEntry) Name() string {
+	return d.set.Name
+}
+
+// Size returns the size of the file in bytes. Directories report a size
+// of zero.
+func (d *DirectoryEntry) Size() int64 {
+	if d.IsDir() {
+		return 0
+	}
+
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	return int64(d.set.DataLength)
+}
+
+// Mode maps the attributes of the entry to a file mode. Directories are
+// ModeDir with 0777 permissions and files have 0666 permissions, without
+// the write permissions if the read-only attribute is set. The hidden,
+// system and archive attributes have no file mode equivalent, they are
+// only returned by Sys.
+func (d *DirectoryEntry) Mode() os.FileMode {
+	mode := os.FileMode(0666)
+	if d.IsDir() {
+		mode = os.ModeDir | 0777
+	}
+
+	if d.set.Attr&AttrReadOnly == AttrReadOnly {
+		mode &^= 0222
+	}
+
+	return mode
+}
+
+// ModTime returns the time the entry was last modified.
+func (d *DirectoryEntry) ModTime() time.Time {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	return d.set.ModifyTime
+}
+
+// Sys returns the attributes of the entry as a FileAttr.
+func (d *DirectoryEntry) Sys() interface{} {
+	return d.set.Attr
+}
+
+// EntrySet returns a copy of the raw entry set of this entry.
+func (d *DirectoryEntry) EntrySet() EntrySet {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	return *d.set
+}
+
+// write writes the entry set back to its slots in the directory.
+func (d *DirectoryEntry) write() error {
+	data, err := d.set.Bytes(d.dir.fs.upcase)
+	if err != nil {
+		return err
+	}
+
+	if len(data) != d.count*DirectoryEntrySize {
+		return errors.New("entry set changed size")
+	}
+
+	return d.dir.writeSlots(d.offset, data)
+}
+
+func (d *Directory) AddDirectory(name string) (fs.DirectoryEntry, error) {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	return d.addEntry(name, AttrDirectory)
+}
+
+func (d *Directory) AddFile(name string) (fs.DirectoryEntry, error) {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	return d.addEntry(name, AttrArchive)
+}
+
+func (d *Directory) Entries() []fs.DirectoryEntry {
+	d.fs.lock.RLock()
+	defer d.fs.lock.RUnlock()
+
+	entries := d.entries()
+	result := make([]fs.DirectoryEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = entry
+	}
+
+	return result
+}
+
+func (d *Directory) Entry(name string) fs.DirectoryEntry {
+	d.fs.lock.RLock()
+	defer d.fs.lock.RUnlock()
+
+	// Return a nil interface rather than a nil *DirectoryEntry
+	if entry := d.lookup(name); entry != nil {
+		return entry
+	}
+
+	return nil
+}
+
+// Remove removes the file or empty directory with the given name. The
+// clusters it used are freed.
+func (d *Directory) Remove(name string) error {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	return d.remove(name, false)
+}
+
+// RemoveAll removes the file or directory with the given name, along
+// with everything the directory contains.
+func (d *Directory) RemoveAll(name string) error {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	return d.remove(name, true)
+}
+
+// remove removes the entry with the given name. The caller must hold
+// lock for writing.
+func (d *Directory) remove(name string, recursive bool) error {
+	entry := d.lookup(name)
+	if entry == nil {
+		return fmt.Errorf("file not found: %s", name)
+	}
+
+	if entry.IsDir() {
+		dir, err := d.fs.directory(entry)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range dir.entries() {
+			if !recursive {
+				return fmt.Errorf("directory not empty: %s", name)
+			}
+
+			if err := dir.remove(child.Name(), true); err != nil {
+				return err
+			}
+		}
+
+		d.fs.forgetDirectory(entry.set.FirstCluster)
+	}
+
+	// Clear the InUse bit of every entry in the set before the clusters
+	// are freed, so that no entry ever points at free clusters.
+	offset := entry.offset
+	data := make([]byte, entry.count*DirectoryEntrySize)
+	copy(data, d.data[offset:offset+len(data)])
+	for i := 0; i < len(data); i += DirectoryEntrySize {
+		data[i] &^= entryTypeInUse
+	}
+
+	if err := d.writeSlots(offset, data); err != nil {
+		return err
+	}
+
+	for i, other := range d.list {
+		if other == entry {
+			d.list = append(d.list[:i], d.list[i+1:]...)
+			break
+		}
+	}
+
+	// Free the clusters and write the FAT and bitmap out
+	if _, err := d.fs.resize(entry.set, 0); err != nil {
+		return err
+	}
+
+	return d.fs.flush()
+}
+
+// entries returns the entries in use. The caller must hold lock.
+func (d *Directory) entries() []*DirectoryEntry {
+	result := make([]*DirectoryEntry, len(d.list))
+	copy(result, d.list)
+	return result
+}
+
+// lookup returns the entry with the given name, or nil. The caller must
+// hold lock.
+func (d *Directory) lookup(name string) *DirectoryEntry {
+	for _, entry := range d.list {
+		if d.fs.upcase.Equal(entry.Name(), name) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// decodeEntries decodes the entries in use from the data of the
+// directory.
+func (d *Directory) decodeEntries() {
+	d.list = make([]*DirectoryEntry, 0, len(d.data)/DirectoryEntrySize/3)
+	for i := 0; i+DirectoryEntrySize <= len(d.data); i += DirectoryEntrySize {
+		entryType := d.data[i]
+		if entryType == entryTypeEndOfDirectory {
+			break
+		}
+
+		if entryType != entryTypeFile {
+			continue
+		}
+
+		// Corrupt entry sets are skipped, just like deleted ones
+		set, count, err := DecodeEntrySet(d.data[i:])
+		if err != nil {
+			continue
+		}
+
+		d.list = append(d.list, &DirectoryEntry{
+			dir:    d,
+			offset: i,
+			count:  count,
+			set:    set,
+		})
+
+		i += (count - 1) * DirectoryEntrySize
+	}
+}
+
+func (d *Directory) addEntry(name string, attr FileAttr) (*DirectoryEntry, error) {
+	name = strings.TrimSpace(name)
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	if d.lookup(name) != nil {
+		return nil, fmt.Errorf("name already exists: %s", name)
+	}
+
+	now := time.Now()
+	set := &EntrySet{
+		Attr:       attr,
+		AccessTime: now,
+		CreateTime: now,
+		ModifyTime: now,
+		Name:       name,
+		Flags:      FlagAllocationPossible,
+	}
+
+	// Directories always have at least one cluster and their data
+	// length is always a multiple of the cluster size.
+	if attr&AttrDirectory == AttrDirectory {
+		clusters, err := d.fs.resize(set, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := d.fs.flush(); err != nil {
+			return nil, err
+		}
+
+		bpc := d.fs.bs.BytesPerCluster()
+		if err := d.fs.writeClusters(clusters, 0, make([]byte, bpc)); err != nil {
+			return nil, err
+		}
+
+		set.DataLength = uint64(bpc)
+		set.ValidDataLength = uint64(bpc)
+	}
+
+	data, err := set.Bytes(d.fs.upcase)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := d.findSlots(len(data) / DirectoryEntrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.writeSlots(offset, data); err != nil {
+		return nil, err
+	}
+
+	result := &DirectoryEntry{
+		dir:    d,
+		offset: offset,
+		count:  len(data) / DirectoryEntrySize,
+		set:    set,
+	}
+
+	// Keep the entries in the order of their slots
+	i := sort.Search(len(d.list), func(i int) bool {
+		return d.list[i].offset > offset
+	})
+	d.list = append(d.list, nil)
+	copy(d.list[i+1:], d.list[i:])
+	d.list[i] = result
+
+	return result, nil
+}
+
+// findSlots finds a run of unused directory entries that can hold count
+// entries, growing the directory if there is none, and returns the byte
+// offset of the run.
+func (d *Directory) findSlots(count int) (int, error) {
+	run := 0
+	for i := 0; i+DirectoryEntrySize <= len(d.data); i += DirectoryEntrySize {
+		if d.data[i]&entryTypeInUse != 0 {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == count {
+			return i - (count-1)*DirectoryEntrySize, nil
+		}
+	}
+
+	// Grow the directory by enough clusters to hold the entries
+	bpc := int(d.fs.bs.BytesPerCluster())
+	needed := (count - run) * DirectoryEntrySize
+	newClusters := (needed + bpc - 1) / bpc
+	offset := len(d.data) - run*DirectoryEntrySize
+
+	// The root directory has no entry set, so its chain is grown
+	// directly in the FAT.
+	set := &EntrySet{
+		FirstCluster: d.clusters[0],
+		DataLength:   uint64(len(d.data)),
+	}
+	if d.entry != nil {
+		set = d.entry.set
+	}
+
+	clusters, err := d.fs.resize(set, len(d.clusters)+newClusters)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.fs.flush(); err != nil {
+		return 0, err
+	}
+
+	d.clusters = clusters
+	if d.entry != nil {
+		set.DataLength = uint64(len(clusters) * bpc)
+		set.ValidDataLength = set.DataLength
+		if err := d.entry.write(); err != nil {
+			return 0, err
+		}
+	}
+
+	d.data = append(d.data, make([]byte, newClusters*bpc)...)
+	if err := d.writeSlots(len(d.data)-newClusters*bpc, d.data[len(d.data)-newClusters*bpc:]); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// writeSlots copies the data into the directory at the given offset and
+// writes it to the device.
+func (d *Directory) writeSlots(offset int, data []byte) error {
+	copy(d.data[offset:], data)
+	return d.fs.writeClusters(d.clusters, int64(offset), d.data[offset:offset+len(data)])
+}
+
+// validateName verifies that the name is a valid exFAT file name.
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid file name: %q", name)
+	}
+
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune("\"*/:<>?\\|", r) {
+			return fmt.Errorf("%#U not a valid character in a file name", r)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// The size in bytes of a single directory entry.
+const DirectoryEntrySize = 32
+
+// The maximum length of a file name in UTF-16 code units.
+const MaxNameLength = 255
+
+// The number of UTF-16 code units that fit in a single file name entry.
+const nameEntryLength = 15
+
+// Directory entry types. The high bit of each type is the InUse bit,
+// which is cleared when an entry is deleted.
+const (
+	entryTypeEndOfDirectory  = 0x00
+	entryTypeAllocBitmap     = 0x81
+	entryTypeUpcaseTable     = 0x82
+	entryTypeVolumeLabel     = 0x83
+	entryTypeFile            = 0x85
+	entryTypeStreamExtension = 0xC0
+	entryTypeFileName        = 0xC1
+	entryTypeInUse           = 0x80
+)
+
+type FileAttr uint16
+
+const (
+	AttrReadOnly  FileAttr = 0x01
+	AttrHidden             = 0x02
+	AttrSystem             = 0x04
+	AttrDirectory          = 0x10
+	AttrArchive            = 0x20
+)
+
+// Flags of the stream extension entry.
+const (
+	FlagAllocationPossible uint8 = 0x01
+	FlagNoFatChain               = 0x02
+)
+
+// EntrySet is the group of directory entries that describes a single
+// file or directory: a file entry, a stream extension entry and one or
+// more file name entries.
+type EntrySet struct {
+	Attr       FileAttr
+	CreateTime time.Time
+	ModifyTime time.Time
+	AccessTime time.Time
+	Name       string
+
+	Flags           uint8
+	FirstCluster    uint32
+	ValidDataLength uint64
+	DataLength      uint64
+}
+
+// DecodeEntrySet decodes the entry set that starts at the beginning of
+// data. It returns the entry set and the number of directory entries
+// that it occupies.
+func DecodeEntrySet(data []byte) (*EntrySet, int, error) {
+	if len(data) < 3*DirectoryEntrySize || data[0] != entryTypeFile {
+		return nil, 0, errors.New("not a file directory entry")
+	}
+
+	count := 1 + int(data[1])
+	if count < 3 || count*DirectoryEntrySize > len(data) {
+		return nil, 0, fmt.Errorf("invalid secondary count: %d", data[1])
+	}
+
+	data = data[:count*DirectoryEntrySize]
+	if binary.LittleEndian.Uint16(data[2:4]) != entrySetChecksum(data) {
+		return nil, 0, errors.New("entry set checksum mismatch")
+	}
+
+	result := new(EntrySet)
+	result.Attr = FileAttr(binary.LittleEndian.Uint16(data[4:6]))
+	result.CreateTime = decodeTimestamp(
+		binary.LittleEndian.Uint32(data[8:12]), data[20], data[22])
+	result.ModifyTime = decodeTimestamp(
+		binary.LittleEndian.Uint32(data[12:16]), data[21], data[23])
+	result.AccessTime = decodeTimestamp(
+		binary.LittleEndian.Uint32(data[16:20]), 0, data[24])
+
+	stream := data[DirectoryEntrySize : 2*DirectoryEntrySize]
+	if stream[0] != entryTypeStreamExtension {
+		return nil, 0, errors.New("missing stream extension entry")
+	}
+
+	result.Flags = stream[1]
+	nameLength := int(stream[3])
+	result.ValidDataLength = binary.LittleEndian.Uint64(stream[8:16])
+	result.FirstCluster = binary.LittleEndian.Uint32(stream[20:24])
+	result.DataLength = binary.LittleEndian.Uint64(stream[24:32])
+
+	name := make([]uint16, 0, nameLength)
+	for i := 2; i < count && len(name) < nameLength; i++ {
+		entry := data[i*DirectoryEntrySize : (i+1)*DirectoryEntrySize]
+		if entry[0] != entryTypeFileName {
+			return nil, 0, errors.New("missing file name entry")
+		}
+
+		for j := 0; j < nameEntryLength && len(name) < nameLength; j++ {
+			name = append(name, binary.LittleEndian.Uint16(entry[2+j*2:4+j*2]))
+		}
+	}
+
+	if len(name) != nameLength {
+		return nil, 0, errors.New("file name is shorter than its name length")
+	}
+
+	result.Name = string(utf16.Decode(name))
+	return result, count, nil
+}
+
+// Bytes returns the on-disk byte data for the entry set. The up-case
+// table is needed to compute the name hash.
+func (e *EntrySet) Bytes(upcase *UpcaseTable) ([]byte, error) {
+	name := utf16.Encode([]rune(e.Name))
+	if len(name) == 0 || len(name) > MaxNameLength {
+		return nil, fmt.Errorf("invalid file name length: %d", len(name))
+	}
+
+	nameEntries := (len(name) + nameEntryLength - 1) / nameEntryLength
+	count := 2 + nameEntries
+	result := make([]byte, count*DirectoryEntrySize)
+
+	// File directory entry
+	result[0] = entryTypeFile
+	result[1] = uint8(count - 1)
+	binary.LittleEndian.PutUint16(result[4:6], uint16(e.Attr))
+
+	var tenMs uint8
+	var timestamp uint32
+	timestamp, tenMs = encodeTimestamp(e.CreateTime)
+	binary.LittleEndian.PutUint32(result[8:12], timestamp)
+	result[20] = tenMs
+	result[22] = utcOffset
+
+	timestamp, tenMs = encodeTimestamp(e.ModifyTime)
+	binary.LittleEndian.PutUint32(result[12:16], timestamp)
+	result[21] = tenMs
+	result[23] = utcOffset
+
+	timestamp, _ = encodeTimestamp(e.AccessTime)
+	binary.LittleEndian.PutUint32(result[16:20], timestamp)
+	result[24] = utcOffset
+
+	// Stream extension directory entry
+	stream := result[DirectoryEntrySize : 2*DirectoryEntrySize]
+	stream[0] = entryTypeStreamExtension
+	stream[1] = e.Flags
+	stream[3] = uint8(len(name))
+	binary.LittleEndian.PutUint16(stream[4:6], nameHash(upcase.Upcase(name)))
+	binary.LittleEndian.PutUint64(stream[8:16], e.ValidDataLength)
+	binary.LittleEndian.PutUint32(stream[20:24], e.FirstCluster)
+	binary.LittleEndian.PutUint64(stream[24:32], e.DataLength)
+
+	// File name directory entries
+	for i := 0; i < nameEntries; i++ {
+		entry := result[(2+i)*DirectoryEntrySize : (3+i)*DirectoryEntrySize]
+		entry[0] = entryTypeFileName
+
+		for j := 0; j < nameEntryLength; j++ {
+			idx := i*nameEntryLength + j
+			if idx >= len(name) {
+				break
+			}
+
+			binary.LittleEndian.PutUint16(entry[2+j*2:4+j*2], name[idx])
+		}
+	}
+
+	binary.LittleEndian.PutUint16(result[2:4], entrySetChecksum(result))
+	return result, nil
+}
+
+// IsDir returns true if the entry set describes a directory.
+func (e *EntrySet) IsDir() bool {
+	return e.Attr&AttrDirectory == AttrDirectory
+}
+
+// entrySetChecksum computes the checksum of an entry set, which skips
+// the checksum field itself.
+func entrySetChecksum(data []byte) uint16 {
+	var checksum uint16
+	for i, b := range data {
+		if i == 2 || i == 3 {
+			continue
+		}
+
+		checksum = ((checksum & 1) << 15) + (checksum >> 1) + uint16(b)
+	}
+
+	return checksum
+}
+
+// nameHash computes the hash of an up-cased file name.
+func nameHash(name []uint16) uint16 {
+	var hash uint16
+	for _, c := range name {
+		hash = ((hash & 1) << 15) + (hash >> 1) + (c & 0xFF)
+		hash = ((hash & 1) << 15) + (hash >> 1) + (c >> 8)
+	}
+
+	return hash
+}
+
+// Timestamps are always written in UTC, which is recorded by setting
+// the valid bit in the UTC offset field with an offset of zero.
+const utcOffset = 0x80
+
+func decodeTimestamp(timestamp uint32, tenMs uint8, offset uint8) time.Time {
+	loc := time.Local
+	if offset&0x80 != 0 {
+		// The offset is a signed 7-bit count of 15 minute intervals
+		minutes := int(int8(offset<<1)>>1) * 15
+		loc = time.FixedZone("", minutes*60)
+	}
+
+	return time.Date(
+		1980+int(timestamp>>25),
+		time.Month((timestamp>>21)&0x0F),
+		int((timestamp>>16)&0x1F),
+		int((timestamp>>11)&0x1F),
+		int((timestamp>>5)&0x3F),
+		int(timestamp&0x1F)*2+int(tenMs)/100,
+		(int(tenMs)%100)*10*int(time.Millisecond),
+		loc)
+}
+
+func encodeTimestamp(t time.Time) (uint32, uint8) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	timestamp := uint32(t.Year()-1980) << 25
+	timestamp |= uint32(t.Month()) << 21
+	timestamp |= uint32(t.Day()) << 16
+	timestamp |= uint32(t.Hour()) << 11
+	timestamp |= uint32(t.Minute()) << 5
+	timestamp |= uint32(t.Second() / 2)
+
+	tenMs := uint8((t.Second()%2)*100 + t.Nanosecond()/int(10*time.Millisecond))
+	return timestamp, tenMs
+}
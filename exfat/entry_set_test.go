@@ -0,0 +1,63 @@
+package exfat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEntrySet_roundTrip(t *testing.T) {
+	upcase := NewUpcaseTable()
+	now := time.Date(2020, 5, 17, 13, 45, 31, 0, time.UTC)
+	set := &EntrySet{
+		Attr:            AttrArchive,
+		AccessTime:      now,
+		CreateTime:      now,
+		ModifyTime:      now,
+		Name:            "a rather long name with 🎉 in it.txt",
+		Flags:           FlagAllocationPossible,
+		FirstCluster:    42,
+		ValidDataLength: 1234,
+		DataLength:      1234,
+	}
+
+	data, err := set.Bytes(upcase)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	result, count, err := DecodeEntrySet(data)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if count != len(data)/DirectoryEntrySize {
+		t.Fatalf("bad count: %d", count)
+	}
+
+	if result.Name != set.Name {
+		t.Fatalf("bad name: %s", result.Name)
+	}
+
+	if !result.ModifyTime.Equal(now) {
+		t.Fatalf("bad time: %s", result.ModifyTime)
+	}
+
+	if result.FirstCluster != 42 || result.DataLength != 1234 {
+		t.Fatalf("bad stream: %#v", result)
+	}
+
+	// Any corruption must be caught by the checksum
+	data[40] ^= 0xFF
+	if _, _, err := DecodeEntrySet(data); err == nil {
+		t.Fatal("should detect checksum mismatch")
+	}
+}
+
+func TestNameHash(t *testing.T) {
+	upcase := NewUpcaseTable()
+	a := nameHash(upcase.Upcase([]uint16{'f', 'o', 'o'}))
+	b := nameHash(upcase.Upcase([]uint16{'F', 'O', 'O'}))
+	if a != b {
+		t.Fatalf("hashes should be case insensitive: %x != %x", a, b)
+	}
+}
@@ -0,0 +1,155 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// The FAT entry value that marks the end of a cluster chain.
+const EndOfChain = 0xFFFFFFFF
+
+// The FAT entry value that marks a bad cluster.
+const BadCluster = 0xFFFFFFF7
+
+// FAT is the file allocation table of an exFAT filesystem. Unlike FAT12,
+// FAT16 and FAT32, the FAT does not record which clusters are free; the
+// allocation bitmap does. The FAT only links the clusters of fragmented
+// chains.
+type FAT struct {
+	bs      *BootSector
+	entries []uint32
+
+	// dirty marks the sectors of the FAT that changed since it was last
+	// written to the device.
+	dirty []bool
+}
+
+// DecodeFAT decodes the FAT from the device.
+func DecodeFAT(device fs.BlockDevice, bs *BootSector) (*FAT, error) {
+	count := int(bs.ClusterCount) + FirstCluster
+	if uint64(count)*4 > uint64(bs.FATLength)*uint64(bs.BytesPerSector()) {
+		return nil, fmt.Errorf("FAT too small for %d clusters", bs.ClusterCount)
+	}
+
+	data := make([]byte, count*4)
+	if _, err := device.ReadAt(data, bs.FATOffsetBytes(0)); err != nil {
+		return nil, err
+	}
+
+	result := &FAT{
+		bs:      bs,
+		entries: make([]uint32, count),
+		dirty:   make([]bool, bs.FATLength),
+	}
+
+	for i := range result.entries {
+		result.entries[i] = binary.LittleEndian.Uint32(data[i*4 : i*4+4])
+	}
+
+	return result, nil
+}
+
+// NewFAT creates a new FAT data structure, properly initialized.
+func NewFAT(bs *BootSector) *FAT {
+	result := &FAT{
+		bs:      bs,
+		entries: make([]uint32, int(bs.ClusterCount)+FirstCluster),
+		dirty:   make([]bool, bs.FATLength),
+	}
+
+	// Media type and the reserved second entry, according to spec
+	result.entries[0] = 0xFFFFFFF8
+	result.entries[1] = 0xFFFFFFFF
+
+	// Nothing of a new FAT is on the device yet
+	for i := range result.dirty {
+		result.dirty[i] = true
+	}
+
+	return result
+}
+
+// Bytes returns the raw bytes for the FAT that should be written to
+// the block device.
+func (f *FAT) Bytes() []byte {
+	return f.sectorBytes(0, int(f.bs.FATLength))
+}
+
+// sectorBytes returns the raw bytes of the sectors of the FAT from start
+// up to end.
+func (f *FAT) sectorBytes(start, end int) []byte {
+	bps := int(f.bs.BytesPerSector())
+	result := make([]byte, (end-start)*bps)
+	first := start * bps / 4
+	for i := first; i < len(f.entries) && i < end*bps/4; i++ {
+		binary.LittleEndian.PutUint32(result[(i-first)*4:], f.entries[i])
+	}
+
+	return result
+}
+
+// Chain returns the chain of clusters starting at a certain cluster.
+func (f *FAT) Chain(start uint32) ([]uint32, error) {
+	chain := make([]uint32, 0, 2)
+
+	cluster := start
+	for {
+		if cluster < FirstCluster || cluster >= uint32(len(f.entries)) {
+			return nil, fmt.Errorf("invalid cluster in chain: %d", cluster)
+		}
+
+		if len(chain) >= len(f.entries) {
+			return nil, fmt.Errorf("cluster chain at %d loops", start)
+		}
+
+		chain = append(chain, cluster)
+		cluster = f.entries[cluster]
+		if cluster == EndOfChain {
+			break
+		}
+	}
+
+	return chain, nil
+}
+
+// setEntry sets the FAT entry of the cluster and marks the sector that
+// holds it as dirty.
+func (f *FAT) setEntry(cluster, value uint32) {
+	f.entries[cluster] = value
+	f.dirty[int(cluster)*4/int(f.bs.BytesPerSector())] = true
+}
+
+// WriteToDevice writes the sectors of the FAT that changed since the
+// last write to every FAT copy on the device. Each run of consecutive
+// dirty sectors is written at once.
+func (f *FAT) WriteToDevice(device fs.BlockDevice) error {
+	bps := int(f.bs.BytesPerSector())
+	for i := 0; i < int(f.bs.NumberOfFATs); i++ {
+		fatOffset := f.bs.FATOffsetBytes(i)
+		for start := 0; start < len(f.dirty); start++ {
+			if !f.dirty[start] {
+				continue
+			}
+
+			end := start + 1
+			for end < len(f.dirty) && f.dirty[end] {
+				end++
+			}
+
+			data := f.sectorBytes(start, end)
+			if _, err := device.WriteAt(data, fatOffset+int64(start*bps)); err != nil {
+				return err
+			}
+
+			start = end
+		}
+	}
+
+	for i := range f.dirty {
+		f.dirty[i] = false
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package exfat
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// File implements fs.File and is used to read and write the contents of
+// a file on an exFAT filesystem.
+type File struct {
+	entry  *DirectoryEntry
+	offset int64
+
+	// lock guards the offset, so that Read, Write and Seek calls on a
+	// shared File don't interleave.
+	lock sync.Mutex
+}
+
+func (f *File) Read(p []byte) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (f *File) Write(p []byte) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err = f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return
+}
+
+// ReadAt reads from the file at the given offset. See io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.entry.dir.fs.lock.RLock()
+	defer f.entry.dir.fs.lock.RUnlock()
+
+	set := f.entry.set
+	size := int64(set.DataLength)
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		err = io.EOF
+	}
+
+	// Data past the valid data length is undefined on disk and must
+	// read as zeros.
+	valid := int64(set.ValidDataLength)
+	if valid > size {
+		valid = size
+	}
+
+	readable := p
+	if off+int64(len(readable)) > valid {
+		if off >= valid {
+			readable = nil
+		} else {
+			readable = p[:valid-off]
+		}
+
+		for i := len(readable); i < len(p); i++ {
+			p[i] = 0
+		}
+	}
+
+	if len(readable) > 0 {
+		fs := f.entry.dir.fs
+		clusters, cerr := fs.clusters(set)
+		if cerr != nil {
+			return 0, cerr
+		}
+
+		bpc := int64(fs.bs.BytesPerCluster())
+		for done := 0; done < len(readable); {
+			pos := off + int64(done)
+			idx := pos / bpc
+			if idx >= int64(len(clusters)) {
+				return done, io.ErrUnexpectedEOF
+			}
+
+			chunk := readable[done:]
+			if int64(len(chunk)) > bpc-pos%bpc {
+				chunk = chunk[:bpc-pos%bpc]
+			}
+
+			offset := fs.bs.ClusterOffset(clusters[idx]) + pos%bpc
+			if _, rerr := fs.device.ReadAt(chunk, offset); rerr != nil {
+				return done, rerr
+			}
+
+			done += len(chunk)
+		}
+	}
+
+	return len(p), err
+}
+
+// Seek sets the offset for the next Read or Write. See io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// WriteAt writes to the file at the given offset, growing the file if
+// necessary. See io.WriterAt.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	fs := f.entry.dir.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	set := f.entry.set
+	bpc := int64(fs.bs.BytesPerCluster())
+	end := off + int64(len(p))
+
+	clusters, err := fs.clusters(set)
+	if err != nil {
+		return 0, err
+	}
+
+	if needed := int((end + bpc - 1) / bpc); needed > len(clusters) {
+		clusters, err = fs.resize(set, needed)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := fs.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Anything between the valid data length and where we start writing
+	// is undefined on disk, so it has to be zeroed first.
+	if valid := int64(set.ValidDataLength); off > valid {
+		if err := fs.writeClusters(clusters, valid, make([]byte, off-valid)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := fs.writeClusters(clusters, off, p); err != nil {
+		return 0, err
+	}
+
+	if uint64(end) > set.DataLength {
+		set.DataLength = uint64(end)
+	}
+
+	if uint64(end) > set.ValidDataLength {
+		set.ValidDataLength = uint64(end)
+	}
+
+	set.ModifyTime = time.Now()
+	if err := f.entry.write(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,373 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// FileSystem is the implementation of fs.FileSystem that can read and
+// write an exFAT filesystem.
+//
+// A FileSystem and the directories, entries and files that come from it
+// are safe for concurrent use by multiple goroutines, the same way as a
+// fat.FileSystem: reads run in parallel with each other, changes are
+// serialized with each other and with reads, and a File is locked for
+// the length of every call.
+//
+// Every Directory of the same directory shares the same entries, so a
+// change made through one is seen by all of them.
+type FileSystem struct {
+	bs     *BootSector
+	device fs.BlockDevice
+	fat    *FAT
+	bitmap *Bitmap
+	upcase *UpcaseTable
+	label  string
+
+	bitmapCluster uint32
+
+	// lock is held for reading by everything that reads the filesystem
+	// and for writing by everything that changes it.
+	lock sync.RWMutex
+
+	// dirs are the directories that were opened, by first cluster. It
+	// is guarded by dirsLock, since it is filled in by readers as well.
+	dirs     map[uint32]*Directory
+	dirsLock sync.Mutex
+}
+
+// New returns a new FileSystem for accessing a previously created
+// exFAT filesystem.
+func New(device fs.BlockDevice) (*FileSystem, error) {
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		return nil, err
+	}
+
+	fat, err := DecodeFAT(device, bs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &FileSystem{
+		bs:     bs,
+		device: device,
+		fat:    fat,
+		dirs:   make(map[uint32]*Directory),
+	}
+
+	rootChain, err := fat.Chain(bs.FirstClusterOfRootDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	rootData, err := result.readClusters(rootChain, int64(len(rootChain))*int64(bs.BytesPerCluster()))
+	if err != nil {
+		return nil, err
+	}
+
+	// The root directory holds the critical primary entries that
+	// describe the allocation bitmap and the up-case table.
+	for i := 0; i+DirectoryEntrySize <= len(rootData); i += DirectoryEntrySize {
+		entry := rootData[i : i+DirectoryEntrySize]
+		if entry[0] == entryTypeEndOfDirectory {
+			break
+		}
+
+		switch entry[0] {
+		case entryTypeAllocBitmap:
+			// Only the first bitmap is used since we only have one FAT
+			if entry[1]&1 != 0 {
+				continue
+			}
+
+			result.bitmapCluster = binary.LittleEndian.Uint32(entry[20:24])
+			length := int64(binary.LittleEndian.Uint64(entry[24:32]))
+			if length < int64(bs.ClusterCount+7)/8 {
+				return nil, errors.New("allocation bitmap too small")
+			}
+
+			data, err := result.readChain(result.bitmapCluster, length)
+			if err != nil {
+				return nil, err
+			}
+
+			result.bitmap = decodeBitmap(data[:(bs.ClusterCount+7)/8], bs.ClusterCount, int(bs.BytesPerSector()))
+		case entryTypeUpcaseTable:
+			checksum := binary.LittleEndian.Uint32(entry[4:8])
+			cluster := binary.LittleEndian.Uint32(entry[20:24])
+			length := int64(binary.LittleEndian.Uint64(entry[24:32]))
+			data, err := result.readChain(cluster, length)
+			if err != nil {
+				return nil, err
+			}
+
+			if tableChecksum(data) != checksum {
+				return nil, errors.New("up-case table checksum mismatch")
+			}
+
+			result.upcase, err = DecodeUpcaseTable(data)
+			if err != nil {
+				return nil, err
+			}
+		case entryTypeVolumeLabel:
+			count := int(entry[1])
+			if count > 11 {
+				count = 11
+			}
+
+			label := make([]uint16, count)
+			for j := range label {
+				label[j] = binary.LittleEndian.Uint16(entry[2+j*2 : 4+j*2])
+			}
+
+			result.label = string(utf16.Decode(label))
+		}
+	}
+
+	if result.bitmap == nil {
+		return nil, errors.New("allocation bitmap not found")
+	}
+
+	if result.upcase == nil {
+		return nil, errors.New("up-case table not found")
+	}
+
+	return result, nil
+}
+
+func (f *FileSystem) RootDir() (fs.Directory, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.directory(nil)
+}
+
+// Label returns the volume label.
+func (f *FileSystem) Label() string {
+	return f.label
+}
+
+// directory returns the directory of the given entry, or the root
+// directory if the entry is nil. Directories are read once and then
+// shared, so that every handle sees the same entries. The caller must
+// hold lock.
+func (f *FileSystem) directory(entry *DirectoryEntry) (*Directory, error) {
+	cluster := f.bs.FirstClusterOfRootDirectory
+	if entry != nil {
+		cluster = entry.set.FirstCluster
+	}
+
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	if dir, ok := f.dirs[cluster]; ok {
+		return dir, nil
+	}
+
+	var clusters []uint32
+	var length int64
+	var err error
+	if entry == nil {
+		clusters, err = f.fat.Chain(cluster)
+		length = int64(len(clusters)) * int64(f.bs.BytesPerCluster())
+	} else {
+		clusters, err = f.clusters(entry.set)
+		length = int64(entry.set.DataLength)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.readClusters(clusters, length)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := &Directory{
+		fs:       f,
+		clusters: clusters,
+		data:     data,
+		entry:    entry,
+	}
+	dir.decodeEntries()
+
+	f.dirs[cluster] = dir
+	return dir, nil
+}
+
+// forgetDirectory drops the directory that starts at the given cluster,
+// which must be done when it is removed since the cluster can be reused.
+// The caller must hold lock for writing.
+func (f *FileSystem) forgetDirectory(cluster uint32) {
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	delete(f.dirs, cluster)
+}
+
+// clusters returns the clusters that hold the data of the entry set.
+func (f *FileSystem) clusters(set *EntrySet) ([]uint32, error) {
+	if set.FirstCluster == 0 {
+		return nil, nil
+	}
+
+	if set.Flags&FlagNoFatChain == 0 {
+		return f.fat.Chain(set.FirstCluster)
+	}
+
+	bpc := uint64(f.bs.BytesPerCluster())
+	count := (set.DataLength + bpc - 1) / bpc
+	if uint64(set.FirstCluster)+count > uint64(f.bs.ClusterCount)+FirstCluster {
+		return nil, fmt.Errorf("contiguous data at %d runs past the end of the volume", set.FirstCluster)
+	}
+
+	result := make([]uint32, count)
+	for i := range result {
+		result[i] = set.FirstCluster + uint32(i)
+	}
+
+	return result, nil
+}
+
+// resize grows or shrinks the clusters of the entry set to n clusters
+// and returns the new list of clusters. Neither the FAT, the bitmap nor
+// the entry set are written out; call flush and write the entry set.
+func (f *FileSystem) resize(set *EntrySet, n int) ([]uint32, error) {
+	chain, err := f.clusters(set)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) == n {
+		return chain, nil
+	}
+
+	// Contiguous data isn't recorded in the FAT, so write it out as a
+	// regular chain before it is modified.
+	if set.Flags&FlagNoFatChain != 0 {
+		for i, cluster := range chain {
+			if i == len(chain)-1 {
+				f.fat.setEntry(cluster, EndOfChain)
+			} else {
+				f.fat.setEntry(cluster, chain[i+1])
+			}
+		}
+
+		set.Flags &^= FlagNoFatChain
+	}
+
+	for len(chain) < n {
+		cluster, err := f.bitmap.Alloc()
+		if err != nil {
+			return nil, err
+		}
+
+		f.fat.setEntry(cluster, EndOfChain)
+		if len(chain) > 0 {
+			f.fat.setEntry(chain[len(chain)-1], cluster)
+		} else {
+			set.FirstCluster = cluster
+		}
+
+		chain = append(chain, cluster)
+	}
+
+	if len(chain) > n {
+		for _, cluster := range chain[n:] {
+			f.fat.setEntry(cluster, 0)
+			f.bitmap.Set(cluster, false)
+		}
+
+		chain = chain[:n]
+		if n == 0 {
+			set.FirstCluster = 0
+		} else {
+			f.fat.setEntry(chain[n-1], EndOfChain)
+		}
+	}
+
+	set.Flags |= FlagAllocationPossible
+	return chain, nil
+}
+
+// flush writes the sectors of the FAT and the allocation bitmap that
+// changed to the device.
+func (f *FileSystem) flush() error {
+	if err := f.fat.WriteToDevice(f.device); err != nil {
+		return err
+	}
+
+	chain, err := f.fat.Chain(f.bitmapCluster)
+	if err != nil {
+		return err
+	}
+
+	return f.bitmap.flush(func(off int64, data []byte) error {
+		return f.writeClusters(chain, off, data)
+	})
+}
+
+// readChain reads length bytes from the chain starting at the cluster.
+func (f *FileSystem) readChain(start uint32, length int64) ([]byte, error) {
+	chain, err := f.fat.Chain(start)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.readClusters(chain, length)
+}
+
+// readClusters reads length bytes from the given clusters.
+func (f *FileSystem) readClusters(clusters []uint32, length int64) ([]byte, error) {
+	bpc := int64(f.bs.BytesPerCluster())
+	if length > int64(len(clusters))*bpc {
+		return nil, errors.New("data is longer than its clusters")
+	}
+
+	data := make([]byte, length)
+	for i := int64(0); i < length; i += bpc {
+		end := i + bpc
+		if end > length {
+			end = length
+		}
+
+		offset := f.bs.ClusterOffset(clusters[i/bpc])
+		if _, err := f.device.ReadAt(data[i:end], offset); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// writeClusters writes the data at the offset within the given clusters.
+func (f *FileSystem) writeClusters(clusters []uint32, off int64, data []byte) error {
+	bpc := int64(f.bs.BytesPerCluster())
+	if off+int64(len(data)) > int64(len(clusters))*bpc {
+		return errors.New("data is longer than its clusters")
+	}
+
+	for len(data) > 0 {
+		n := bpc - off%bpc
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+
+		offset := f.bs.ClusterOffset(clusters[off/bpc]) + off%bpc
+		if _, err := f.device.WriteAt(data[:n], offset); err != nil {
+			return err
+		}
+
+		data = data[n:]
+		off += n
+	}
+
+	return nil
+}
@@ -0,0 +1,528 @@
+package exfat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestFileSystemImplementsFileSystem(t *testing.T) {
+	var raw interface{}
+	raw = new(FileSystem)
+	if _, ok := raw.(fs.FileSystem); !ok {
+		t.Fatal("FileSystem should be a FileSystem")
+	}
+}
+
+func TestFormatSuperFloppy(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	config := &SuperFloppyConfig{Label: "GO-FS"}
+	if err := FormatSuperFloppy(device, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if filesys.Label() != "GO-FS" {
+		t.Fatalf("bad label: %s", filesys.Label())
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(rootDir.Entries()) != 0 {
+		t.Fatalf("bad entries: %#v", rootDir.Entries())
+	}
+
+	// Backup boot region must match the main boot region
+	main := make([]byte, BootRegionSectors*512)
+	backup := make([]byte, BootRegionSectors*512)
+	if _, err := device.ReadAt(main, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := device.ReadAt(backup, BackupBootRegionSector*512); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(main, backup) {
+		t.Fatal("backup boot region should match")
+	}
+}
+
+func TestFileSystem_readWrite(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry, err := rootDir.AddDirectory("Sub Directory")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := dirEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Enough files to grow the directory past a single cluster
+	for i := 0; i < 100; i++ {
+		if _, err := subDir.AddFile(fmt.Sprintf("file-%d.txt", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if _, err := subDir.AddFile("FILE-0.TXT"); err == nil {
+		t.Fatal("should not add a file that differs only in case")
+	}
+
+	contents := bytes.Repeat([]byte("exFAT "), 5000)
+	fileEntry, err := subDir.AddFile("日本語 ファイル.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := fileEntry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write(contents); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Read it all back from a freshly mounted filesystem
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry = rootDir.Entry("sub directory")
+	if dirEntry == nil || !dirEntry.IsDir() {
+		t.Fatal("directory should exist")
+	}
+
+	subDir, err = dirEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(subDir.Entries()) != 101 {
+		t.Fatalf("bad entry count: %d", len(subDir.Entries()))
+	}
+
+	fileEntry = subDir.Entry("日本語 ファイル.TXT")
+	if fileEntry == nil {
+		t.Fatal("file should exist")
+	}
+
+	file, err = fileEntry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(data, contents) {
+		t.Fatalf("bad contents: %d bytes", len(data))
+	}
+
+	if _, err := file.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("should be EOF: %s", err)
+	}
+}
+
+// testDevice returns a BlockDevice of the given size that is kept in
+// memory.
+func testDevice(t *testing.T, size int64) fs.BlockDevice {
+	return fs.NewMemoryDisk(size)
+}
+
+func TestDirectory_Remove(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	freeCount := filesys.bitmap.FreeCount()
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry, err := rootDir.AddDirectory("dir")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir, err := dirEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fileEntry, err := dir.AddFile("file")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := fileEntry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write(make([]byte, 10000)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rootDir.Remove("dir"); err == nil {
+		t.Fatal("should not remove a non-empty directory")
+	}
+
+	if err := rootDir.(*Directory).RemoveAll("DIR"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(rootDir.Entries()) != 0 {
+		t.Fatalf("bad entries: %#v", rootDir.Entries())
+	}
+
+	if filesys.bitmap.FreeCount() != freeCount {
+		t.Fatalf("clusters should be freed: %d != %d", filesys.bitmap.FreeCount(), freeCount)
+	}
+}
+
+func TestFileSystem_IOFS(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry, err := rootDir.AddDirectory("Sub Directory")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := dirEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fileEntry, err := subDir.AddFile("data.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := fileEntry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write([]byte("exfat data")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := fstest.TestFS(fs.NewIOFS(filesys), "Sub Directory/data.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystem_Stat(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{Label: "GO-FS"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	before, err := filesys.Stat()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry, err := rootDir.AddDirectory("Sub Directory")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := dirEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := subDir.AddFile("file.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stat, err := filesys.Stat()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if stat.Type != "exFAT" || stat.Label != "GO-FS" || stat.BadClusters != 0 {
+		t.Fatalf("bad: %#v", stat)
+	}
+
+	if stat.FreeClusters != before.FreeClusters-1 {
+		t.Fatalf("bad: %d %d", before.FreeClusters, stat.FreeClusters)
+	}
+
+	// Each entry set is a file, stream extension and file name entry
+	if stat.DirectoryEntries != before.DirectoryEntries+6 {
+		t.Fatalf("bad: %d %d", before.DirectoryEntries, stat.DirectoryEntries)
+	}
+}
+
+func TestDirectory_sharedHandles(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	root1, _ := filesys.RootDir()
+	root2, _ := filesys.RootDir()
+	if _, err := root1.AddFile("a.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := root2.AddFile("b.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dirEntry, err := root1.AddDirectory("dir")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir1, _ := dirEntry.Dir()
+	dir2, _ := root2.Entry("dir").Dir()
+	if _, err := dir1.AddFile("c.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := dir2.AddFile("d.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A file written through one handle is seen through the other
+	file, _ := root1.Entry("a.txt").File()
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if size := root2.Entry("a.txt").(*DirectoryEntry).Size(); size != 5 {
+		t.Fatalf("bad size: %d", size)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ := filesys.RootDir()
+	for _, name := range []string{"a.txt", "b.txt", "dir"} {
+		if rootDir.Entry(name) == nil {
+			t.Fatalf("missing entry: %s", name)
+		}
+	}
+
+	dir, _ := rootDir.Entry("dir").Dir()
+	if len(dir.Entries()) != 2 {
+		t.Fatalf("bad entries: %#v", dir.Entries())
+	}
+}
+
+func TestFileSystem_concurrent(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			rootDir, err := filesys.RootDir()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for j := 0; j < 10; j++ {
+				entry, err := rootDir.AddFile(fmt.Sprintf("file-%d-%d", i, j))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				file, _ := entry.File()
+				if _, err := file.Write(bytes.Repeat([]byte{byte(i)}, 5000)); err != nil {
+					errs <- err
+					return
+				}
+
+				rootDir.Entries()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ := filesys.RootDir()
+	if len(rootDir.Entries()) != 80 {
+		t.Fatalf("bad entries: %d", len(rootDir.Entries()))
+	}
+
+	for i := 0; i < 8; i++ {
+		file, _ := rootDir.Entry(fmt.Sprintf("file-%d-9", i)).File()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, 5000)) {
+			t.Fatalf("bad data for %d", i)
+		}
+	}
+}
+
+func TestFileSystem_flushDirtySectors(t *testing.T) {
+	device := testDevice(t, 32*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	recorder := &writeRecordingDevice{BlockDevice: device}
+	filesys.device = recorder
+
+	rootDir, _ := filesys.RootDir()
+	entry, err := rootDir.AddFile("hello.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, _ := entry.File()
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the changed sectors of the FAT and the bitmap are written,
+	// never all of them
+	bps := int(filesys.bs.BytesPerSector())
+	for _, size := range recorder.writes {
+		if size > bps {
+			t.Fatalf("bad writes: %v", recorder.writes)
+		}
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ = filesys.RootDir()
+	file, _ = rootDir.Entry("hello.txt").File()
+	data, err := ioutil.ReadAll(file)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("bad data: %q %v", data, err)
+	}
+}
+
+// writeRecordingDevice records the size of every write to a device.
+type writeRecordingDevice struct {
+	fs.BlockDevice
+
+	writes []int
+}
+
+func (d *writeRecordingDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.writes = append(d.writes, len(p))
+	return d.BlockDevice.WriteAt(p, off)
+}
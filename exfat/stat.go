@@ -0,0 +1,73 @@
+package exfat
+
+import (
+	"github.com/mitchellh/go-fs"
+)
+
+// Stat returns statistics about the volume. See fs.StatFileSystem.
+func (f *FileSystem) Stat() (*fs.FileSystemStat, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	result := &fs.FileSystemStat{
+		Type:            "exFAT",
+		Label:           f.label,
+		VolumeID:        f.bs.VolumeSerialNumber,
+		BytesPerCluster: f.bs.BytesPerCluster(),
+		TotalClusters:   f.bs.ClusterCount,
+		FreeClusters:    f.bitmap.FreeCount(),
+	}
+
+	for _, entry := range f.fat.entries[FirstCluster:] {
+		if entry == BadCluster {
+			result.BadClusters++
+		}
+	}
+
+	rootDir, err := f.directory(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result.DirectoryEntries, err = countEntries(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// countEntries returns the number of entries in use in the directory and
+// all the directories below it. The caller must hold lock.
+func countEntries(dir *Directory) (int, error) {
+	result := 0
+	for i := 0; i+DirectoryEntrySize <= len(dir.data); i += DirectoryEntrySize {
+		if dir.data[i] == entryTypeEndOfDirectory {
+			break
+		}
+
+		if dir.data[i]&entryTypeInUse != 0 {
+			result++
+		}
+	}
+
+	for _, entry := range dir.entries() {
+		if !entry.IsDir() {
+			continue
+		}
+
+		subDir, err := dir.fs.directory(entry)
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := countEntries(subDir)
+		if err != nil {
+			return 0, err
+		}
+
+		result += count
+	}
+
+	return result, nil
+}
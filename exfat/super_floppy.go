@@ -0,0 +1,225 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"time"
+	"unicode/utf16"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// SuperFloppyConfig is the configuration for various properties of
+// a new super floppy formatted block device. Once this configuration is used
+// to format a device, it must not be modified.
+type SuperFloppyConfig struct {
+	// The label of the drive. At most 11 characters. Defaults to no label.
+	Label string
+
+	// The size of a cluster in bytes. Must be a power of two that is at
+	// least the sector size. Defaults to a size based on the device size.
+	BytesPerCluster uint32
+}
+
+// Formats an fs.BlockDevice with the "super floppy" format according
+// to the given configuration. The "super floppy" standard means that the
+// device will be formatted so that it does not contain a partition table.
+// Instead, the entire device holds a single exFAT file system.
+func FormatSuperFloppy(device fs.BlockDevice, config *SuperFloppyConfig) error {
+	formatter := &superFloppyFormatter{
+		config: config,
+		device: device,
+	}
+
+	return formatter.format()
+}
+
+// An internal struct that helps maintain state and perform calculations
+// during a single formatting pass.
+type superFloppyFormatter struct {
+	config *SuperFloppyConfig
+	device fs.BlockDevice
+}
+
+// The sector the FAT starts at. This leaves room for both boot regions
+// and aligns the FAT nicely.
+const fatOffset = 128
+
+func (f *superFloppyFormatter) format() error {
+	sectorSize := uint32(f.device.SectorSize())
+	if sectorSize < 512 || sectorSize > 4096 || sectorSize&(sectorSize-1) != 0 {
+		return fmt.Errorf("unsupported sector size: %d", sectorSize)
+	}
+
+	bytesPerCluster := f.config.BytesPerCluster
+	if bytesPerCluster == 0 {
+		bytesPerCluster = f.defaultBytesPerCluster()
+	}
+
+	if bytesPerCluster < sectorSize || bytesPerCluster > 32*1024*1024 ||
+		bytesPerCluster&(bytesPerCluster-1) != 0 {
+		return fmt.Errorf("invalid bytes per cluster: %d", bytesPerCluster)
+	}
+
+	label := utf16.Encode([]rune(f.config.Label))
+	if len(label) > 11 {
+		return errors.New("Label must be 11 characters or less")
+	}
+
+	totalSectors := uint64(f.device.Len()) / uint64(sectorSize)
+	sectorsPerCluster := uint64(bytesPerCluster / sectorSize)
+
+	// The FAT size depends on the cluster count and the cluster count
+	// depends on the FAT size, so start with an overestimate and shrink.
+	if totalSectors <= fatOffset {
+		return errors.New("disk too small for exFAT")
+	}
+
+	clusterCount := (totalSectors - fatOffset) / sectorsPerCluster
+	var fatLength, heapOffset uint64
+	for {
+		fatLength = ((clusterCount+FirstCluster)*4 + uint64(sectorSize) - 1) / uint64(sectorSize)
+		heapOffset = fatOffset + fatLength
+		heapOffset = (heapOffset + sectorsPerCluster - 1) / sectorsPerCluster * sectorsPerCluster
+		if heapOffset >= totalSectors {
+			return errors.New("disk too small for exFAT")
+		}
+
+		count := (totalSectors - heapOffset) / sectorsPerCluster
+		if count >= clusterCount {
+			break
+		}
+
+		clusterCount = count
+	}
+
+	if clusterCount > 0xFFFFFFF5 {
+		return errors.New("disk too large for exFAT with this cluster size")
+	}
+
+	bs := &BootSector{
+		VolumeLength:           totalSectors,
+		FATOffset:              fatOffset,
+		FATLength:              uint32(fatLength),
+		ClusterHeapOffset:      uint32(heapOffset),
+		ClusterCount:           uint32(clusterCount),
+		VolumeSerialNumber:     uint32(time.Now().Unix()),
+		FileSystemRevision:     0x0100,
+		BytesPerSectorShift:    uint8(bits.TrailingZeros32(sectorSize)),
+		SectorsPerClusterShift: uint8(bits.TrailingZeros64(sectorsPerCluster)),
+		NumberOfFATs:           1,
+		DriveSelect:            0x80,
+		PercentInUse:           0xFF,
+	}
+
+	fat := NewFAT(bs)
+	bitmap := NewBitmap(bs.ClusterCount)
+	upcase := NewUpcaseTable()
+	upcaseBytes := upcase.Bytes()
+
+	fs := &FileSystem{
+		bs:     bs,
+		device: f.device,
+		fat:    fat,
+		bitmap: bitmap,
+		upcase: upcase,
+	}
+
+	// Allocate the allocation bitmap, the up-case table and the root
+	// directory, in that order, at the start of the cluster heap.
+	bitmapSet := new(EntrySet)
+	bitmapClusters, err := f.alloc(fs, bitmapSet, len(bitmap.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	upcaseSet := new(EntrySet)
+	upcaseClusters, err := f.alloc(fs, upcaseSet, len(upcaseBytes))
+	if err != nil {
+		return err
+	}
+
+	rootSet := new(EntrySet)
+	rootClusters, err := f.alloc(fs, rootSet, int(bytesPerCluster))
+	if err != nil {
+		return err
+	}
+
+	bs.FirstClusterOfRootDirectory = rootClusters[0]
+	fs.bitmapCluster = bitmapClusters[0]
+
+	// Write both boot regions
+	region := bs.RegionBytes()
+	if _, err := f.device.WriteAt(region, 0); err != nil {
+		return err
+	}
+
+	if _, err := f.device.WriteAt(region, int64(BackupBootRegionSector)*int64(sectorSize)); err != nil {
+		return err
+	}
+
+	// Write the FAT and the allocation bitmap
+	if err := fs.flush(); err != nil {
+		return err
+	}
+
+	if err := fs.writeClusters(upcaseClusters, 0, upcaseBytes); err != nil {
+		return err
+	}
+
+	// Create the root directory with the critical primary entries
+	root := make([]byte, bytesPerCluster)
+	entries := root
+
+	if len(label) > 0 {
+		entries[0] = entryTypeVolumeLabel
+		entries[1] = uint8(len(label))
+		for i, c := range label {
+			binary.LittleEndian.PutUint16(entries[2+i*2:4+i*2], c)
+		}
+
+		entries = entries[DirectoryEntrySize:]
+	}
+
+	entries[0] = entryTypeAllocBitmap
+	binary.LittleEndian.PutUint32(entries[20:24], bitmapSet.FirstCluster)
+	binary.LittleEndian.PutUint64(entries[24:32], uint64(len(bitmap.Bytes())))
+	entries = entries[DirectoryEntrySize:]
+
+	entries[0] = entryTypeUpcaseTable
+	binary.LittleEndian.PutUint32(entries[4:8], upcase.Checksum())
+	binary.LittleEndian.PutUint32(entries[20:24], upcaseSet.FirstCluster)
+	binary.LittleEndian.PutUint64(entries[24:32], uint64(len(upcaseBytes)))
+
+	return fs.writeClusters(rootClusters, 0, root)
+}
+
+// alloc allocates enough clusters to hold size bytes and zeroes them.
+func (f *superFloppyFormatter) alloc(fs *FileSystem, set *EntrySet, size int) ([]uint32, error) {
+	bpc := int(fs.bs.BytesPerCluster())
+	clusters, err := fs.resize(set, (size+bpc-1)/bpc)
+	if err != nil {
+		return nil, err
+	}
+
+	empty := make([]byte, len(clusters)*bpc)
+	if err := fs.writeClusters(clusters, 0, empty); err != nil {
+		return nil, err
+	}
+
+	return clusters, nil
+}
+
+func (f *superFloppyFormatter) defaultBytesPerCluster() uint32 {
+	size := f.device.Len()
+	switch {
+	case size <= 256*1024*1024:
+		return 4 * 1024
+	case size <= 32*1024*1024*1024:
+		return 32 * 1024
+	default:
+		return 128 * 1024
+	}
+}
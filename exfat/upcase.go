@@ -0,0 +1,136 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode"
+	"unicode/utf16"
+)
+
+// UpcaseTable maps every UTF-16 code unit to its upper case equivalent.
+// exFAT uses it to compare and hash file names case-insensitively.
+type UpcaseTable struct {
+	table [0x10000]uint16
+}
+
+// NewUpcaseTable creates the up-case table based on the Unicode case
+// mappings of the basic multilingual plane.
+func NewUpcaseTable() *UpcaseTable {
+	result := new(UpcaseTable)
+	for i := range result.table {
+		result.table[i] = uint16(i)
+
+		r := rune(i)
+		if utf16.IsSurrogate(r) {
+			continue
+		}
+
+		if upper := unicode.ToUpper(r); upper <= 0xFFFF {
+			result.table[i] = uint16(upper)
+		}
+	}
+
+	return result
+}
+
+// DecodeUpcaseTable decodes a compressed or uncompressed up-case table.
+// Code units that the table doesn't cover map to themselves.
+func DecodeUpcaseTable(data []byte) (*UpcaseTable, error) {
+	if len(data)%2 != 0 {
+		return nil, errors.New("up-case table has an odd length")
+	}
+
+	result := new(UpcaseTable)
+	for i := range result.table {
+		result.table[i] = uint16(i)
+	}
+
+	idx := 0
+	for i := 0; i < len(data) && idx < len(result.table); i += 2 {
+		value := binary.LittleEndian.Uint16(data[i : i+2])
+
+		// 0xFFFF is followed by the number of identity mappings
+		// that were compressed away.
+		if value == 0xFFFF && i+2 < len(data) {
+			i += 2
+			idx += int(binary.LittleEndian.Uint16(data[i : i+2]))
+			continue
+		}
+
+		result.table[idx] = value
+		idx++
+	}
+
+	return result, nil
+}
+
+// Bytes returns the compressed on-disk form of the table, where runs of
+// identity mappings are collapsed.
+func (u *UpcaseTable) Bytes() []byte {
+	result := make([]byte, 0, 8192)
+	putUint16 := func(v uint16) {
+		result = append(result, byte(v), byte(v>>8))
+	}
+
+	for i := 0; i < len(u.table); {
+		run := 0
+		for i+run < len(u.table) && run < 0xFFFF && u.table[i+run] == uint16(i+run) {
+			run++
+		}
+
+		// A run is only worth compressing if it is longer than the
+		// two code units the compression itself takes.
+		if run > 2 {
+			putUint16(0xFFFF)
+			putUint16(uint16(run))
+			i += run
+			continue
+		}
+
+		putUint16(u.table[i])
+		i++
+	}
+
+	return result
+}
+
+// Checksum returns the checksum of the on-disk form of the table.
+func (u *UpcaseTable) Checksum() uint32 {
+	return tableChecksum(u.Bytes())
+}
+
+// Upcase returns the upper case form of the given UTF-16 name.
+func (u *UpcaseTable) Upcase(name []uint16) []uint16 {
+	result := make([]uint16, len(name))
+	for i, c := range name {
+		result[i] = u.table[c]
+	}
+
+	return result
+}
+
+// Equal returns true if the two names are equal, ignoring case.
+func (u *UpcaseTable) Equal(a, b string) bool {
+	a16 := utf16.Encode([]rune(a))
+	b16 := utf16.Encode([]rune(b))
+	if len(a16) != len(b16) {
+		return false
+	}
+
+	for i := range a16 {
+		if u.table[a16[i]] != u.table[b16[i]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func tableChecksum(data []byte) uint32 {
+	var checksum uint32
+	for _, b := range data {
+		checksum = ((checksum & 1) << 31) + (checksum >> 1) + uint32(b)
+	}
+
+	return checksum
+}
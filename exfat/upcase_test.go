@@ -0,0 +1,19 @@
+package exfat
+
+import "testing"
+
+func TestUpcaseTable_roundTrip(t *testing.T) {
+	table := NewUpcaseTable()
+	if table.table['a'] != 'A' || table.table['ß'] != 'ß' || table.table['é'] != 'É' {
+		t.Fatal("bad mappings")
+	}
+
+	result, err := DecodeUpcaseTable(table.Bytes())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if result.table != table.table {
+		t.Fatal("decoded table should match")
+	}
+}
@@ -71,8 +71,7 @@ func TestAddFile(t *testing.T) {
 	for i, entry := range entries {
 		expecting := filenames[i]
 		if entry.Name() != expecting {
-			// Name() returns the short name, how do we get the long name?
-			// t.Fatalf("Excepting %s, found %s", expecting, entry.Name())
+			t.Fatalf("Excepting %s, found %s", expecting, entry.Name())
 		}
 	}
 }
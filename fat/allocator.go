@@ -0,0 +1,369 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrFATFull is returned when there aren't enough free clusters left for
+// an allocation.
+var ErrFATFull = errors.New("FAT FULL")
+
+// Allocator chooses the free clusters that are used when a chain is
+// created or grown. Set one for a filesystem with
+// FileSystem.SetAllocator. The default is a NextFitAllocator.
+type Allocator interface {
+	// Allocate returns n free clusters of the FAT, in the order they
+	// will be linked into the chain. If after isn't zero, the clusters
+	// are appended to the chain that ends at that cluster, otherwise
+	// they make up a new chain. ErrFATFull should be returned if there
+	// aren't n free clusters.
+	//
+	// Allocate must not change the FAT, the clusters are only marked as
+	// used after they are returned.
+	Allocate(fat *FAT, n int, after uint32) ([]uint32, error)
+}
+
+// NextFitAllocator allocates the first free clusters after the last
+// allocation, wrapping around at the end of the volume. A chain that is
+// grown is continued right after its last cluster when possible.
+//
+// Before its first allocation it starts right after the last allocated
+// cluster in the FSInfo next free hint, if there is one. The zero value
+// is ready to use.
+type NextFitAllocator struct {
+	next uint32
+}
+
+func (a *NextFitAllocator) Allocate(fat *FAT, n int, after uint32) ([]uint32, error) {
+	start := a.next
+	if start == 0 && fat.fsInfo != nil && fat.fsInfo.NextFree != FSInfoUnknown {
+		start = fat.fsInfo.NextFree + 1
+	}
+
+	if after != 0 && after < fat.MaxCluster() && fat.IsFree(after+1) {
+		start = after + 1
+	}
+
+	clusters, err := scanFree(fat, start, n)
+	if err != nil {
+		return nil, err
+	}
+
+	a.next = clusters[len(clusters)-1] + 1
+	return clusters, nil
+}
+
+// BestFitAllocator allocates the smallest run of free clusters that can
+// hold the whole allocation, so that chains come out contiguous while
+// large free runs are kept for large files. A chain that is grown is
+// continued in place if the run right after its last cluster is large
+// enough. If no single run is large enough, the largest runs are used.
+//
+// The zero value is ready to use.
+type BestFitAllocator struct{}
+
+func (a *BestFitAllocator) Allocate(fat *FAT, n int, after uint32) ([]uint32, error) {
+	runs := freeRuns(fat)
+
+	free := 0
+	for _, r := range runs {
+		free += int(r.length)
+	}
+
+	if free < n {
+		return nil, ErrFATFull
+	}
+
+	var best *clusterRun
+	for i := range runs {
+		r := &runs[i]
+		if int(r.length) < n {
+			continue
+		}
+
+		if after != 0 && r.start == after+1 {
+			best = r
+			break
+		}
+
+		if best == nil || r.length < best.length {
+			best = r
+		}
+	}
+
+	if best != nil {
+		return best.take(n), nil
+	}
+
+	// Fill the allocation from the largest runs, in the order they are
+	// on the volume.
+	byLength := make([]int, len(runs))
+	for i := range byLength {
+		byLength[i] = i
+	}
+
+	for i := 1; i < len(byLength); i++ {
+		for j := i; j > 0 && runs[byLength[j]].length > runs[byLength[j-1]].length; j-- {
+			byLength[j], byLength[j-1] = byLength[j-1], byLength[j]
+		}
+	}
+
+	used := make([]bool, len(runs))
+	remaining := n
+	for _, i := range byLength {
+		if remaining == 0 {
+			break
+		}
+
+		used[i] = true
+		remaining -= int(runs[i].length)
+	}
+
+	result := make([]uint32, 0, n)
+	for i, r := range runs {
+		if used[i] {
+			result = append(result, r.take(n-len(result))...)
+		}
+	}
+
+	return result, nil
+}
+
+// WearSpreadingAllocator spreads the writes over flash media that
+// doesn't do its own wear leveling. It counts how often it handed out
+// each cluster, and only allocates the free clusters that were used the
+// least. Among those it rotates through the volume, starting after the
+// previous allocation. A cluster that was just freed has been used once
+// more than the clusters around it, so it is skipped until every other
+// free cluster has been used as often. Chains are never continued in
+// place.
+//
+// The counts only live as long as the allocator, and each allocation
+// looks at every cluster of the volume. Before its first allocation it
+// starts right after the last allocated cluster in the FSInfo next free
+// hint, if there is one. The zero value is ready to use.
+type WearSpreadingAllocator struct {
+	next uint32
+	uses []uint32
+}
+
+func (a *WearSpreadingAllocator) Allocate(fat *FAT, n int, after uint32) ([]uint32, error) {
+	max := fat.MaxCluster()
+	start := a.next
+	if start == 0 && fat.fsInfo != nil && fat.fsInfo.NextFree != FSInfoUnknown {
+		start = fat.fsInfo.NextFree + 1
+	}
+
+	if start < FirstCluster || start > max {
+		start = FirstCluster
+	}
+
+	if len(a.uses) < int(max)+1 {
+		uses := make([]uint32, max+1)
+		copy(uses, a.uses)
+		a.uses = uses
+	}
+
+	// The free clusters in the order of the rotation, along with how
+	// many of them were used how often
+	var free []uint32
+	levels := make(map[uint32]int)
+	count := max - FirstCluster + 1
+	for i := uint32(0); i < count; i++ {
+		cluster := start + i
+		if cluster > max {
+			cluster -= count
+		}
+
+		if fat.IsFree(cluster) {
+			free = append(free, cluster)
+			levels[a.uses[cluster]]++
+		}
+	}
+
+	if len(free) < n {
+		return nil, ErrFATFull
+	}
+
+	// Find the least number of uses that still leaves n clusters. All
+	// the clusters used less often than that are taken, the rest comes
+	// from the clusters used exactly that often.
+	counts := make([]uint32, 0, len(levels))
+	for uses := range levels {
+		counts = append(counts, uses)
+	}
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+
+	limit := counts[0]
+	below := 0
+	for _, uses := range counts {
+		limit = uses
+		if below+levels[uses] >= n {
+			break
+		}
+
+		below += levels[uses]
+	}
+
+	result := make([]uint32, 0, n)
+	atLimit := n - below
+	for _, cluster := range free {
+		if len(result) == n {
+			break
+		}
+
+		uses := a.uses[cluster]
+		if uses < limit || (uses == limit && atLimit > 0) {
+			if uses == limit {
+				atLimit--
+			}
+
+			result = append(result, cluster)
+		}
+	}
+
+	for _, cluster := range result {
+		a.uses[cluster]++
+	}
+
+	a.next = result[len(result)-1] + 1
+	return result, nil
+}
+
+// IsFree returns true if the given cluster is free.
+func (f *FAT) IsFree(cluster uint32) bool {
+	return cluster >= FirstCluster && cluster <= f.MaxCluster() && f.entries[cluster] == 0
+}
+
+// MaxCluster returns the highest cluster number that can hold data.
+func (f *FAT) MaxCluster() uint32 {
+	last := f.bs.ClusterCount() + FirstCluster
+	if last > uint32(len(f.entries)) {
+		last = uint32(len(f.entries))
+	}
+
+	return last - 1
+}
+
+// alloc asks the allocator for n clusters and links them into a chain,
+// appended to the chain that ends at the given cluster if it isn't zero.
+func (f *FAT) alloc(n int, after uint32) ([]uint32, error) {
+	if n < 1 {
+		return nil, errors.New("must allocate at least one cluster")
+	}
+
+	allocator := f.allocator
+	if allocator == nil {
+		allocator = new(NextFitAllocator)
+		f.allocator = allocator
+	}
+
+	clusters, err := allocator.Allocate(f, n, after)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clusters) != n {
+		return nil, fmt.Errorf("allocator returned %d clusters, wanted %d", len(clusters), n)
+	}
+
+	seen := make(map[uint32]bool, n)
+	for _, cluster := range clusters {
+		if !f.IsFree(cluster) || seen[cluster] {
+			return nil, fmt.Errorf("allocator returned cluster %d that isn't free", cluster)
+		}
+
+		seen[cluster] = true
+	}
+
+	eof := 0xFFFFFFFF & f.entryMask()
+	for i, cluster := range clusters {
+		if i == len(clusters)-1 {
+			f.setEntry(cluster, eof)
+		} else {
+			f.setEntry(cluster, clusters[i+1])
+		}
+
+		if f.fsInfo != nil {
+			f.fsInfo.allocated(cluster)
+			f.fsInfoDirty = true
+		}
+	}
+
+	if after != 0 {
+		f.setEntry(after, clusters[0])
+	}
+
+	return clusters, nil
+}
+
+// scanFree returns the first n free clusters from the given cluster on,
+// wrapping around at the end of the volume.
+func scanFree(fat *FAT, start uint32, n int) ([]uint32, error) {
+	max := fat.MaxCluster()
+	if start < FirstCluster || start > max {
+		start = FirstCluster
+	}
+
+	result := make([]uint32, 0, n)
+	count := max - FirstCluster + 1
+	for i := uint32(0); i < count && len(result) < n; i++ {
+		cluster := start + i
+		if cluster > max {
+			cluster -= count
+		}
+
+		if fat.IsFree(cluster) {
+			result = append(result, cluster)
+		}
+	}
+
+	if len(result) < n {
+		return nil, ErrFATFull
+	}
+
+	return result, nil
+}
+
+// clusterRun is a run of consecutive free clusters.
+type clusterRun struct {
+	start  uint32
+	length uint32
+}
+
+// take returns up to n clusters from the start of the run.
+func (r clusterRun) take(n int) []uint32 {
+	if uint32(n) > r.length {
+		n = int(r.length)
+	}
+
+	result := make([]uint32, n)
+	for i := range result {
+		result[i] = r.start + uint32(i)
+	}
+
+	return result
+}
+
+// freeRuns returns every run of free clusters, in the order they are on
+// the volume.
+func freeRuns(fat *FAT) []clusterRun {
+	var result []clusterRun
+	max := fat.MaxCluster()
+	for cluster := uint32(FirstCluster); cluster <= max; cluster++ {
+		if !fat.IsFree(cluster) {
+			continue
+		}
+
+		if n := len(result); n > 0 && result[n-1].start+result[n-1].length == cluster {
+			result[n-1].length++
+		} else {
+			result = append(result, clusterRun{start: cluster, length: 1})
+		}
+	}
+
+	return result
+}
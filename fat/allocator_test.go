@@ -0,0 +1,201 @@
+package fat
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNextFitAllocator(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	f := filesys.fat
+	f.allocator = new(NextFitAllocator)
+
+	a, _ := f.AllocChain(1)
+	b, _ := f.AllocChain(1)
+	f.FreeChain(b)
+
+	// Growing a chain continues right after it
+	chain, err := f.ResizeChain(a, 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(chain, []uint32{a, a + 1, a + 2}) {
+		t.Fatalf("bad chain: %v", chain)
+	}
+
+	// A new chain starts after the last allocation
+	c, _ := f.AllocChain(2)
+	if c != a+3 {
+		t.Fatalf("bad cluster: %d", c)
+	}
+}
+
+func TestBestFitAllocator(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	f := filesys.fat
+	f.allocator = new(BestFitAllocator)
+
+	// Leave a hole of 5 clusters and a hole of 3 clusters
+	var starts []uint32
+	for _, n := range []int{5, 1, 3, 1} {
+		start, err := f.AllocChain(n)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		starts = append(starts, start)
+	}
+
+	f.FreeChain(starts[0])
+	f.FreeChain(starts[2])
+
+	small, _ := f.AllocChain(3)
+	if small != starts[2] {
+		t.Fatalf("should use the smallest hole: %d", small)
+	}
+
+	large, _ := f.AllocChain(4)
+	if large != starts[0] {
+		t.Fatalf("should use the large hole: %d", large)
+	}
+
+	// Two clusters don't fit in the single cluster left in the hole, so
+	// the chain grows into the free space at the end
+	chain, err := f.ResizeChain(large, 6)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if chain[4] != starts[3]+1 || chain[5] != starts[3]+2 {
+		t.Fatalf("bad chain: %v", chain)
+	}
+}
+
+func TestWearSpreadingAllocator(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	f := filesys.fat
+	allocator := new(WearSpreadingAllocator)
+	f.allocator = allocator
+
+	a, _ := f.AllocChain(1)
+	b, _ := f.AllocChain(1)
+	f.FreeChain(b)
+
+	// The freed cluster isn't reused, even to grow a chain in place
+	chain, err := f.ResizeChain(a, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if chain[1] != b+1 {
+		t.Fatalf("bad chain: %v", chain)
+	}
+
+	// Even when the rotation comes back to it, the freed cluster is
+	// skipped for one that was never used
+	allocator.next = FirstCluster
+	c, _ := f.AllocChain(1)
+	if c != b+2 {
+		t.Fatalf("bad cluster: %d", c)
+	}
+
+	f.FreeChain(c)
+
+	// Once every other cluster has been used, the freed ones are used
+	// again in the order of the rotation
+	free := 0
+	for cluster := uint32(FirstCluster); cluster <= f.MaxCluster(); cluster++ {
+		if f.IsFree(cluster) {
+			free++
+		}
+	}
+
+	if _, err := f.AllocChain(free - 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if d, _ := f.AllocChain(1); d != b {
+		t.Fatalf("bad cluster: %d", d)
+	}
+
+	if d, _ := f.AllocChain(1); d != c {
+		t.Fatalf("bad cluster: %d", d)
+	}
+
+	if _, err := f.AllocChain(1); err != ErrFATFull {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFileSystem_SetAllocator(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	filesys.SetAllocator(new(BestFitAllocator))
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Fill the start of the volume with holes of one cluster
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		if _, err := rootDir.AddFile(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for _, name := range []string{"a", "c", "e"} {
+		if err := rootDir.Remove(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	entry, err := rootDir.AddFile("big")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := bytes.Repeat([]byte("x"), int(filesys.bs.BytesPerCluster())*4)
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The file got the first hole when it was created, but everything
+	// it grew by is a single run after the holes.
+	chain := filesys.fat.Chain(entry.(*DirectoryEntry).entry.cluster)
+	if len(chain) != 4 || fragmented(chain[1:]) || chain[1] < chain[0] {
+		t.Fatalf("chain should be contiguous: %v", chain)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
+
+func TestFAT_alloc_badAllocator(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	used, _ := filesys.fat.AllocChain(1)
+
+	filesys.SetAllocator(fixedAllocator{used})
+	if _, err := filesys.fat.AllocChain(1); err == nil {
+		t.Fatal("should not allocate a used cluster")
+	}
+}
+
+// fixedAllocator always allocates the same clusters.
+type fixedAllocator []uint32
+
+func (a fixedAllocator) Allocate(fat *FAT, n int, after uint32) ([]uint32, error) {
+	return a, nil
+}
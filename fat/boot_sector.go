@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
 	"unicode"
 
 	"github.com/mitchellh/go-fs"
@@ -27,13 +28,29 @@ type BootSectorCommon struct {
 	SectorsPerFat       uint32
 	SectorsPerTrack     uint16
 	NumHeads            uint16
+
+	// HiddenSectors is the number of sectors before the filesystem on
+	// the disk, which is the first sector of its partition. It is 0 for
+	// a super floppy.
+	HiddenSectors uint32
 }
 
 // DecodeBootSector takes a BlockDevice and decodes the FAT boot sector
 // from it.
 func DecodeBootSector(device fs.BlockDevice) (*BootSectorCommon, error) {
-	var sector [512]byte
-	if _, err := device.ReadAt(sector[:], 0); err != nil {
+	sector, err := readBootSector(device, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBootSectorCommon(sector), nil
+}
+
+// readBootSector reads a raw boot sector from the device at the given
+// offset and verifies its signature.
+func readBootSector(device fs.BlockDevice, offset int64) ([]byte, error) {
+	sector := make([]byte, 512)
+	if _, err := device.ReadAt(sector, offset); err != nil {
 		return nil, err
 	}
 
@@ -41,6 +58,10 @@ func DecodeBootSector(device fs.BlockDevice) (*BootSectorCommon, error) {
 		return nil, errors.New("corrupt boot sector signature")
 	}
 
+	return sector, nil
+}
+
+func decodeBootSectorCommon(sector []byte) *BootSectorCommon {
 	result := new(BootSectorCommon)
 
 	// BS_OEMName
@@ -70,6 +91,9 @@ func DecodeBootSector(device fs.BlockDevice) (*BootSectorCommon, error) {
 	// BPB_NumHeads
 	result.NumHeads = binary.LittleEndian.Uint16(sector[26:28])
 
+	// BPB_HiddSec
+	result.HiddenSectors = binary.LittleEndian.Uint32(sector[28:32])
+
 	// BPB_TotSec16 / BPB_TotSec32
 	result.TotalSectors = uint32(binary.LittleEndian.Uint16(sector[19:21]))
 	if result.TotalSectors == 0 {
@@ -82,7 +106,7 @@ func DecodeBootSector(device fs.BlockDevice) (*BootSectorCommon, error) {
 		result.SectorsPerFat = binary.LittleEndian.Uint32(sector[36:40])
 	}
 
-	return result, nil
+	return result
 }
 
 func (b *BootSectorCommon) Bytes() ([]byte, error) {
@@ -130,8 +154,8 @@ func (b *BootSectorCommon) Bytes() ([]byte, error) {
 	// BPB_Numheads
 	binary.LittleEndian.PutUint16(sector[26:28], b.NumHeads)
 
-	// BPB_Hiddsec
-	// sector[28:32] - it is always set to 0 because we don't partition drives yet.
+	// BPB_HiddSec
+	binary.LittleEndian.PutUint32(sector[28:32], b.HiddenSectors)
 
 	// Important signature of every FAT boot sector
 	sector[510] = 0x55
@@ -147,28 +171,28 @@ func (b *BootSectorCommon) BytesPerCluster() uint32 {
 
 // ClusterOffset returns the offset of the data section of a particular
 // cluster.
-func (b *BootSectorCommon) ClusterOffset(n int) uint32 {
+func (b *BootSectorCommon) ClusterOffset(n int) int64 {
 	offset := b.DataOffset()
-	offset += (uint32(n) - FirstCluster) * b.BytesPerCluster()
+	offset += int64(uint32(n)-FirstCluster) * int64(b.BytesPerCluster())
 	return offset
 }
 
 // DataOffset returns the offset of the data section of the disk.
-func (b *BootSectorCommon) DataOffset() uint32 {
-	offset := uint32(b.RootDirOffset())
-	offset += uint32(b.RootEntryCount * DirectoryEntrySize)
+func (b *BootSectorCommon) DataOffset() int64 {
+	offset := int64(b.RootDirOffset())
+	offset += int64(b.RootEntryCount) * DirectoryEntrySize
 	return offset
 }
 
 // FATOffset returns the offset in bytes for the given index of the FAT
 func (b *BootSectorCommon) FATOffset(n int) int {
-	offset := uint32(b.ReservedSectorCount * b.BytesPerSector)
+	offset := uint32(b.ReservedSectorCount) * uint32(b.BytesPerSector)
 	offset += b.SectorsPerFat * uint32(b.BytesPerSector) * uint32(n)
 	return int(offset)
 }
 
-// Calculates the FAT type that this boot sector represents.
-func (b *BootSectorCommon) FATType() FATType {
+// ClusterCount returns the number of clusters in the data region.
+func (b *BootSectorCommon) ClusterCount() uint32 {
 	var rootDirSectors uint32
 	rootDirSectors = (uint32(b.RootEntryCount) * 32) + (uint32(b.BytesPerSector) - 1)
 	rootDirSectors /= uint32(b.BytesPerSector)
@@ -176,7 +200,12 @@ func (b *BootSectorCommon) FATType() FATType {
 	dataSectors += uint32(b.ReservedSectorCount)
 	dataSectors += rootDirSectors
 	dataSectors = b.TotalSectors - dataSectors
-	countClusters := dataSectors / uint32(b.SectorsPerCluster)
+	return dataSectors / uint32(b.SectorsPerCluster)
+}
+
+// Calculates the FAT type that this boot sector represents.
+func (b *BootSectorCommon) FATType() FATType {
+	countClusters := b.ClusterCount()
 
 	switch {
 	case countClusters < 4085:
@@ -210,6 +239,32 @@ type BootSectorFat16 struct {
 	FileSystemTypeLabel string
 }
 
+// DecodeBootSectorFat16 takes a BlockDevice and decodes the FAT12/FAT16
+// boot sector, including the extended BPB, from it.
+func DecodeBootSectorFat16(device fs.BlockDevice) (*BootSectorFat16, error) {
+	sector, err := readBootSector(device, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BootSectorFat16{
+		BootSectorCommon: *decodeBootSectorCommon(sector),
+	}
+
+	// BS_DrvNum
+	result.DriveNumber = sector[36]
+
+	// BS_VolID, BS_VolLab and BS_FilSysType are only valid if the
+	// extended boot signature is present.
+	if sector[38] == 0x29 {
+		result.VolumeID = binary.LittleEndian.Uint32(sector[39:43])
+		result.VolumeLabel = strings.TrimRight(string(sector[43:54]), " \x00")
+		result.FileSystemTypeLabel = string(sector[54:62])
+	}
+
+	return result, nil
+}
+
 func (b *BootSectorFat16) Bytes() ([]byte, error) {
 	sector, err := b.BootSectorCommon.Bytes()
 	if err != nil {
@@ -268,9 +323,18 @@ func (b *BootSectorFat16) Bytes() ([]byte, error) {
 	return sector, nil
 }
 
+// BootSectorFat32 is the BootSector for FAT32 filesystems. It contains
+// the common fields to all FAT filesystems and the extended BPB fields
+// that are unique to FAT32.
 type BootSectorFat32 struct {
 	BootSectorCommon
 
+	// ActiveFAT is the zero-based index of the only FAT that is active
+	// and MirroringDisabled is true if the FATs are not kept in sync at
+	// runtime. These make up BPB_ExtFlags.
+	ActiveFAT         uint8
+	MirroringDisabled bool
+
 	RootCluster         uint32
 	FSInfoSector        uint16
 	BackupBootSector    uint16
@@ -280,20 +344,87 @@ type BootSectorFat32 struct {
 	FileSystemTypeLabel string
 }
 
+// DecodeBootSectorFat32 takes a BlockDevice and decodes the FAT32 boot
+// sector, including the extended BPB, from it.
+func DecodeBootSectorFat32(device fs.BlockDevice) (*BootSectorFat32, error) {
+	sector, err := readBootSector(device, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBootSectorFat32(sector)
+}
+
+func decodeBootSectorFat32(sector []byte) (*BootSectorFat32, error) {
+	result := &BootSectorFat32{
+		BootSectorCommon: *decodeBootSectorCommon(sector),
+	}
+
+	// BPB_ExtFlags
+	extFlags := binary.LittleEndian.Uint16(sector[40:42])
+	result.ActiveFAT = uint8(extFlags & 0x0F)
+	result.MirroringDisabled = extFlags&0x80 == 0x80
+
+	// BPB_RootClus
+	result.RootCluster = binary.LittleEndian.Uint32(sector[44:48])
+
+	// BPB_FSInfo
+	result.FSInfoSector = binary.LittleEndian.Uint16(sector[48:50])
+
+	// BPB_BkBootSec
+	result.BackupBootSector = binary.LittleEndian.Uint16(sector[50:52])
+
+	// BS_DrvNum
+	result.DriveNumber = sector[64]
+
+	// BS_VolID, BS_VolLab and BS_FilSysType are only valid if the
+	// extended boot signature is present.
+	if sector[66] == 0x29 {
+		result.VolumeID = binary.LittleEndian.Uint32(sector[67:71])
+		result.VolumeLabel = strings.TrimRight(string(sector[71:82]), " \x00")
+		result.FileSystemTypeLabel = string(sector[82:90])
+	}
+
+	if result.RootCluster < FirstCluster {
+		return nil, fmt.Errorf("invalid FAT32 root cluster: %d", result.RootCluster)
+	}
+
+	if result.MirroringDisabled && result.ActiveFAT >= result.NumFATs {
+		return nil, fmt.Errorf("active FAT #%d greater than total FATs: %d", result.ActiveFAT, result.NumFATs)
+	}
+
+	return result, nil
+}
+
 func (b *BootSectorFat32) Bytes() ([]byte, error) {
 	sector, err := b.BootSectorCommon.Bytes()
 	if err != nil {
 		return nil, err
 	}
 
+	// BS_jmpBoot, which jumps past the larger FAT32 BPB
+	sector[1] = 0x58
+
 	// BPB_RootEntCount - must be 0
 	sector[17] = 0
 	sector[18] = 0
 
-	// BPB_FATSz32
+	// BPB_TotSec16 must be 0, so always use BPB_TotSec32
+	binary.LittleEndian.PutUint32(sector[32:36], b.TotalSectors)
+
+	// BPB_FATSz16 must be 0, so always use BPB_FATSz32
 	binary.LittleEndian.PutUint32(sector[36:40], b.SectorsPerFat)
 
-	// BPB_ExtFlags - Unused?
+	// BPB_ExtFlags
+	if b.ActiveFAT > 0x0F {
+		return nil, fmt.Errorf("ActiveFAT must be 15 or less: %d", b.ActiveFAT)
+	}
+
+	extFlags := uint16(b.ActiveFAT)
+	if b.MirroringDisabled {
+		extFlags |= 0x80
+	}
+	binary.LittleEndian.PutUint16(sector[40:42], extFlags)
 
 	// BPB_FSVer. Explicitly set to 0 because that is really important
 	// to get correct.
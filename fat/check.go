@@ -0,0 +1,654 @@
+package fat
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// FindingKind is the type of problem found by Check.
+type FindingKind int
+
+const (
+	// FindingLostChain is a chain of allocated clusters that no
+	// directory entry refers to.
+	FindingLostChain FindingKind = iota
+
+	// FindingCrossLink is a cluster that is part of more than one chain.
+	FindingCrossLink
+
+	// FindingChainTooShort is a file whose chain has fewer clusters than
+	// its size needs.
+	FindingChainTooShort
+
+	// FindingChainTooLong is a file whose chain has more clusters than
+	// its size needs.
+	FindingChainTooLong
+
+	// FindingInvalidCluster is a chain that refers to a free, bad or
+	// out of range cluster, or that loops back on itself.
+	FindingInvalidCluster
+
+	// FindingBadDotEntry is a "." or ".." entry of a directory that is
+	// missing or points to the wrong cluster.
+	FindingBadDotEntry
+
+	// FindingOrphanLongName is a run of long name entries that doesn't
+	// belong to the short entry that follows it.
+	FindingOrphanLongName
+
+	// FindingFATMismatch is a copy of the FAT that differs from the FAT
+	// in use.
+	FindingFATMismatch
+
+	// FindingDirtyVolume is a volume that wasn't unmounted cleanly.
+	FindingDirtyVolume
+)
+
+func (k FindingKind) String() string {
+	switch k {
+	case FindingLostChain:
+		return "lost chain"
+	case FindingCrossLink:
+		return "cross-link"
+	case FindingChainTooShort:
+		return "chain too short"
+	case FindingChainTooLong:
+		return "chain too long"
+	case FindingInvalidCluster:
+		return "invalid cluster"
+	case FindingBadDotEntry:
+		return "bad dot entry"
+	case FindingOrphanLongName:
+		return "orphan long name"
+	case FindingFATMismatch:
+		return "FAT mismatch"
+	case FindingDirtyVolume:
+		return "dirty volume"
+	default:
+		return fmt.Sprintf("FindingKind(%d)", int(k))
+	}
+}
+
+// Finding is a single problem found by Check. Which fields are set
+// depends on the kind of the finding.
+type Finding struct {
+	Kind FindingKind
+
+	// Path is the path of the file or directory the problem was found
+	// in, such as "/DIR/FILE.TXT". Directories end in a slash, so the
+	// root directory is "/". It is empty for lost chains, FAT mismatches
+	// and dirty volumes.
+	Path string
+
+	// Cluster is the cluster the problem is about:
+	//
+	//   * lost chain: the first cluster of the chain
+	//   * cross-link: the cluster that is already used by Other
+	//   * invalid cluster: the invalid cluster number
+	//   * bad dot entry: the cluster the entry should point to
+	//   * FAT mismatch: the first entry that differs
+	Cluster uint32
+
+	// Length is a number of clusters or entries:
+	//
+	//   * lost chain: the clusters in the chain
+	//   * chain too short/long, invalid cluster, cross-link: the valid
+	//     clusters in the chain before the problem
+	//   * orphan long name: the long name entries
+	//   * FAT mismatch: the entries that differ
+	Length int
+
+	// Expected is the number of clusters the size of a file needs, for
+	// chains that are too short or too long.
+	Expected int
+
+	// Entry is the index of the directory entry in the directory at Path,
+	// for bad dot entries and orphan long names.
+	Entry int
+
+	// Other is the path of the other user of a cross-linked cluster.
+	Other string
+
+	// FAT is the index of the FAT copy that differs, for FAT mismatches.
+	FAT int
+
+	// dir and entry are the directory and the directory entry that the
+	// finding is about, and chain is the valid part of the chain that
+	// the finding is about, for use by Repair.
+	dir   *DirectoryCluster
+	entry *DirectoryClusterEntry
+	chain []uint32
+}
+
+func (f Finding) String() string {
+	switch f.Kind {
+	case FindingLostChain:
+		return fmt.Sprintf("lost chain of %d clusters at cluster %d", f.Length, f.Cluster)
+	case FindingCrossLink:
+		return fmt.Sprintf("%s: cluster %d is cross-linked with %s", f.Path, f.Cluster, f.Other)
+	case FindingChainTooShort, FindingChainTooLong:
+		return fmt.Sprintf("%s: %s, %d clusters but size needs %d",
+			f.Path, f.Kind, f.Length, f.Expected)
+	case FindingInvalidCluster:
+		return fmt.Sprintf("%s: invalid cluster %d after %d clusters", f.Path, f.Cluster, f.Length)
+	case FindingBadDotEntry:
+		return fmt.Sprintf("%s: bad dot entry %d, should point to cluster %d", f.Path, f.Entry, f.Cluster)
+	case FindingOrphanLongName:
+		return fmt.Sprintf("%s: %d orphan long name entries at entry %d", f.Path, f.Length, f.Entry)
+	case FindingFATMismatch:
+		return fmt.Sprintf("FAT #%d differs in %d entries, first at %d", f.FAT, f.Length, f.Cluster)
+	case FindingDirtyVolume:
+		return "volume was not unmounted cleanly"
+	default:
+		return f.Kind.String()
+	}
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	FATType FATType
+
+	// Files and Directories are the number of files and directories
+	// found, not counting the root directory.
+	Files       int
+	Directories int
+
+	// Findings are the problems found, in the order they were found.
+	Findings []Finding
+}
+
+// OK returns true if no problems were found.
+func (r *CheckReport) OK() bool {
+	return len(r.Findings) == 0
+}
+
+// Check checks the consistency of the FAT filesystem on the device,
+// much like fsck, and reports every problem it finds. The device is
+// only read, never written.
+//
+// An error is only returned if the filesystem can't be checked at all,
+// such as when the boot sector is damaged or the device can't be read.
+func Check(device fs.BlockDevice) (*CheckReport, error) {
+	c, err := newChecker(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	return c.report, nil
+}
+
+// checker holds the state of a single run of Check.
+type checker struct {
+	device fs.BlockDevice
+	bs     *BootSectorCommon
+	bs32   *BootSectorFat32
+	fat    *FAT
+	report *CheckReport
+
+	// owners maps every cluster that is part of a chain to the path of
+	// the file or directory that uses it.
+	owners map[uint32]string
+
+	// root is the root directory and chains are all the chains that were
+	// walked, in the order they were walked.
+	root   *DirectoryCluster
+	chains []*checkedChain
+}
+
+// checkedChain is a chain walked by the checker along with the entry
+// that refers to it.
+type checkedChain struct {
+	clusters []uint32
+
+	// entry is the entry that refers to the chain, which is stored in
+	// the directory parent. Both are nil for the FAT32 root directory.
+	entry  *DirectoryClusterEntry
+	parent *DirectoryCluster
+
+	// dir is the contents of the chain if it is a directory.
+	dir *DirectoryCluster
+}
+
+func newChecker(device fs.BlockDevice) (*checker, error) {
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var bs32 *BootSectorFat32
+	activeFAT := 0
+	if bs.FATType() == FAT32 {
+		bs32, err = DecodeBootSectorFat32(device)
+		if err != nil {
+			return nil, err
+		}
+
+		if bs32.MirroringDisabled {
+			activeFAT = int(bs32.ActiveFAT)
+		}
+	}
+
+	fat, err := DecodeFAT(device, bs, activeFAT)
+	if err != nil {
+		return nil, err
+	}
+
+	fat.activeFAT = activeFAT
+	if bs32 != nil {
+		fat.mirroringDisabled = bs32.MirroringDisabled
+	}
+
+	result := &checker{
+		device: device,
+		bs:     bs,
+		bs32:   bs32,
+		fat:    fat,
+		report: &CheckReport{FATType: bs.FATType()},
+		owners: make(map[uint32]string),
+	}
+
+	return result, nil
+}
+
+func (c *checker) check() error {
+	if err := c.checkFATCopies(); err != nil {
+		return err
+	}
+
+	if err := c.checkRoot(); err != nil {
+		return err
+	}
+
+	c.checkLostClusters()
+	return c.checkDirty()
+}
+
+func (c *checker) add(f Finding) {
+	c.report.Findings = append(c.report.Findings, f)
+}
+
+// checkFATCopies compares every copy of the FAT against the one in use.
+func (c *checker) checkFATCopies() error {
+	if c.fat.mirroringDisabled {
+		return nil
+	}
+
+	for i := 0; i < int(c.bs.NumFATs); i++ {
+		if i == c.fat.activeFAT {
+			continue
+		}
+
+		other, err := DecodeFAT(c.device, c.bs, i)
+		if err != nil {
+			return err
+		}
+
+		finding := Finding{Kind: FindingFATMismatch, FAT: i}
+		for n, entry := range c.fat.entries {
+			if other.entries[n] != entry {
+				if finding.Length == 0 {
+					finding.Cluster = uint32(n)
+				}
+
+				finding.Length++
+			}
+		}
+
+		if finding.Length > 0 {
+			c.add(finding)
+		}
+	}
+
+	return nil
+}
+
+func (c *checker) checkRoot() error {
+	if c.bs32 == nil {
+		dir, err := DecodeFAT16RootDirectoryCluster(c.device, c.bs)
+		if err != nil {
+			return err
+		}
+
+		c.root = dir
+		return c.checkEntries("/", dir)
+	}
+
+	chain, ok := c.chain("/", c.bs32.RootCluster, nil, nil)
+	if !ok && len(chain) == 0 {
+		return nil
+	}
+
+	dir, err := c.readDirectory(chain)
+	if err != nil {
+		return err
+	}
+
+	dir.root = true
+	dir.startCluster = c.bs32.RootCluster
+	c.root = dir
+	c.chains = append(c.chains, &checkedChain{clusters: chain, dir: dir})
+	return c.checkEntries("/", dir)
+}
+
+// checkDirectory checks the subdirectory described by the given entry
+// of the parent directory.
+func (c *checker) checkDirectory(path string, parent *DirectoryCluster, entry *DirectoryClusterEntry) error {
+	chain, ok := c.chain(path, entry.cluster, parent, entry)
+	if !ok && len(chain) == 0 {
+		return nil
+	}
+
+	dir, err := c.readDirectory(chain)
+	if err != nil {
+		return err
+	}
+
+	dir.startCluster = entry.cluster
+	c.chains = append(c.chains, &checkedChain{
+		clusters: chain,
+		entry:    entry,
+		parent:   parent,
+		dir:      dir,
+	})
+
+	// The first two entries must be "." and "..", pointing to this
+	// directory and the parent directory.
+	dots := []struct {
+		name    string
+		cluster uint32
+	}{
+		{".", dir.startCluster},
+		{"..", parent.dotDotCluster()},
+	}
+
+	for i, dot := range dots {
+		if i >= len(dir.entries) ||
+			dir.entries[i].name != dot.name ||
+			dir.entries[i].attr&AttrDirectory == 0 ||
+			dir.entries[i].cluster != dot.cluster {
+			c.add(Finding{
+				Kind:    FindingBadDotEntry,
+				Path:    path,
+				Cluster: dot.cluster,
+				Entry:   i,
+				dir:     dir,
+			})
+		}
+	}
+
+	return c.checkEntries(path, dir)
+}
+
+// checkEntries checks the entries of a directory and everything below
+// them.
+func (c *checker) checkEntries(path string, dir *DirectoryCluster) error {
+	c.checkLongNames(path, dir)
+
+	d := &Directory{device: c.device, dirCluster: dir, fat: c.fat}
+	entries := dir.entries
+	for len(entries) > 0 {
+		var entry *DirectoryEntry
+		entry, entries, _ = DecodeDirectoryEntry(d, entries)
+		if entry == nil || entry.name == "." || entry.name == ".." {
+			continue
+		}
+
+		entryPath := path + entry.name
+		if entry.IsDir() {
+			c.report.Directories++
+			if err := c.checkDirectory(entryPath+"/", dir, entry.entry); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		c.report.Files++
+		c.checkFile(entryPath, dir, entry.entry)
+	}
+
+	return nil
+}
+
+// checkFile checks that the chain of a file matches its size.
+func (c *checker) checkFile(path string, dir *DirectoryCluster, entry *DirectoryClusterEntry) {
+	bpc := int(c.bs.BytesPerCluster())
+	expected := (int(entry.fileSize) + bpc - 1) / bpc
+
+	var chain []uint32
+	if entry.cluster != 0 {
+		var ok bool
+		chain, ok = c.chain(path, entry.cluster, dir, entry)
+		if !ok {
+			return
+		}
+	}
+
+	if len(chain) > 0 {
+		c.chains = append(c.chains, &checkedChain{
+			clusters: chain,
+			entry:    entry,
+			parent:   dir,
+		})
+	}
+
+	// Empty files may keep a single cluster, which is what this package
+	// does when creating files.
+	max := expected
+	if max == 0 {
+		max = 1
+	}
+
+	finding := Finding{
+		Path:     path,
+		Length:   len(chain),
+		Expected: expected,
+		dir:      dir,
+		entry:    entry,
+		chain:    chain,
+	}
+
+	if len(chain) < expected {
+		finding.Kind = FindingChainTooShort
+		c.add(finding)
+	} else if len(chain) > max {
+		finding.Kind = FindingChainTooLong
+		c.add(finding)
+	}
+}
+
+// checkLongNames finds runs of long name entries that don't belong to
+// the short entry that follows them.
+func (c *checker) checkLongNames(path string, dir *DirectoryCluster) {
+	entries := dir.entries
+	for i := 0; i < len(entries); {
+		if !entries[i].IsLong() || entries[i].deleted {
+			i++
+			continue
+		}
+
+		start := i
+		lfnEntries := []*DirectoryClusterEntry{entries[i]}
+		for i++; i < len(entries); i++ {
+			entry := entries[i]
+			if !entry.IsLong() || entry.deleted || entry.longOrd&LastLongEntryMask != 0 {
+				break
+			}
+
+			lfnEntries = append(lfnEntries, entry)
+		}
+
+		if i < len(entries) && !entries[i].IsLong() && !entries[i].deleted {
+			if decodeLongName(lfnEntries, entries[i]) != "" {
+				continue
+			}
+		}
+
+		c.add(Finding{
+			Kind:   FindingOrphanLongName,
+			Path:   path,
+			Entry:  start,
+			Length: len(lfnEntries),
+			dir:    dir,
+		})
+	}
+}
+
+// chain follows the chain starting at the given cluster and claims its
+// clusters for the given path. It stops at the first invalid or
+// cross-linked cluster, reports it, and returns false along with the
+// valid part of the chain.
+func (c *checker) chain(path string, start uint32, dir *DirectoryCluster, entry *DirectoryClusterEntry) ([]uint32, bool) {
+	var result []uint32
+	cluster := start
+	for {
+		finding := Finding{
+			Path:    path,
+			Cluster: cluster,
+			Length:  len(result),
+			dir:     dir,
+			entry:   entry,
+			chain:   result,
+		}
+
+		if !c.validCluster(cluster) {
+			finding.Kind = FindingInvalidCluster
+			c.add(finding)
+			return result, false
+		}
+
+		if other, ok := c.owners[cluster]; ok {
+			finding.Kind = FindingCrossLink
+			finding.Other = other
+			if other == path {
+				finding.Kind = FindingInvalidCluster
+				finding.Other = ""
+			}
+
+			c.add(finding)
+			return result, false
+		}
+
+		c.owners[cluster] = path
+		result = append(result, cluster)
+
+		cluster = c.fat.entries[cluster]
+		if c.fat.isEofCluster(cluster) {
+			return result, true
+		}
+	}
+}
+
+// validCluster returns true if the cluster can be part of a chain.
+func (c *checker) validCluster(cluster uint32) bool {
+	if cluster < FirstCluster || cluster >= c.lastCluster() {
+		return false
+	}
+
+	value := c.fat.entries[cluster]
+	return value != 0 && value != c.fat.badCluster()
+}
+
+// lastCluster returns the number one past the last valid cluster.
+func (c *checker) lastCluster() uint32 {
+	last := c.bs.ClusterCount() + FirstCluster
+	if last > uint32(len(c.fat.entries)) {
+		last = uint32(len(c.fat.entries))
+	}
+
+	return last
+}
+
+// readDirectory reads and decodes the directory stored in the chain.
+func (c *checker) readDirectory(chain []uint32) (*DirectoryCluster, error) {
+	bpc := c.bs.BytesPerCluster()
+	data := make([]byte, uint32(len(chain))*bpc)
+	for i, cluster := range chain {
+		offset := uint32(i) * bpc
+		if _, err := c.device.ReadAt(data[offset:offset+bpc], c.bs.ClusterOffset(int(cluster))); err != nil {
+			return nil, err
+		}
+	}
+
+	return decodeDirectoryCluster(data, c.bs)
+}
+
+// checkLostClusters finds allocated clusters that aren't part of any
+// chain and groups them into chains.
+func (c *checker) checkLostClusters() {
+	last := c.lastCluster()
+	lost := make(map[uint32]bool)
+	for cluster := uint32(FirstCluster); cluster < last; cluster++ {
+		value := c.fat.entries[cluster]
+		if value == 0 || value == c.fat.badCluster() {
+			continue
+		}
+
+		if _, ok := c.owners[cluster]; !ok {
+			lost[cluster] = true
+		}
+	}
+
+	// A chain starts at a lost cluster that no other lost cluster
+	// points to. Anything left after that is a loop.
+	referenced := make(map[uint32]bool)
+	for cluster := range lost {
+		referenced[c.fat.entries[cluster]] = true
+	}
+
+	for _, heads := range []bool{true, false} {
+		for cluster := uint32(FirstCluster); cluster < last; cluster++ {
+			if !lost[cluster] || (heads && referenced[cluster]) {
+				continue
+			}
+
+			finding := Finding{Kind: FindingLostChain, Cluster: cluster}
+			for next := cluster; lost[next]; next = c.fat.entries[next] {
+				delete(lost, next)
+				c.owners[next] = ""
+				finding.chain = append(finding.chain, next)
+				finding.Length++
+			}
+
+			c.add(finding)
+		}
+	}
+}
+
+// checkDirty checks the dirty flags of the volume. Windows keeps one in
+// the boot sector and FAT16 and FAT32 have another in the second entry
+// of the FAT.
+func (c *checker) checkDirty() error {
+	sector, err := readBootSector(c.device, 0)
+	if err != nil {
+		return err
+	}
+
+	dirty := sector[c.dirtyFlagOffset()]&dirtyFlag != 0
+	if mask := c.fat.cleanShutdownMask(); mask != 0 && c.fat.entries[1]&mask == 0 {
+		dirty = true
+	}
+
+	if dirty {
+		c.add(Finding{Kind: FindingDirtyVolume})
+	}
+
+	return nil
+}
+
+// The bit of BS_Reserved1 that Windows sets while a volume is mounted.
+const dirtyFlag = 0x01
+
+// dirtyFlagOffset returns the offset of BS_Reserved1 in the boot sector.
+func (c *checker) dirtyFlagOffset() int {
+	if c.bs32 != nil {
+		return 65
+	}
+
+	return 37
+}
@@ -0,0 +1,239 @@
+package fat
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestCheck(t *testing.T) {
+	for _, tc := range checkTestDamage {
+		filesys, device := checkTestFileSystem(t)
+		tc.damage(filesys, device)
+
+		report, err := Check(device)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		found := false
+		for _, finding := range report.Findings {
+			if finding.Kind == tc.kind && finding.Path == tc.path {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("%s: bad findings: %v", tc.name, report.Findings)
+		}
+	}
+}
+
+// checkTestDamage are ways to damage the filesystem created by
+// checkTestFileSystem, along with the finding they cause.
+var checkTestDamage = []struct {
+	name   string
+	damage func(*FileSystem, fs.BlockDevice)
+	kind   FindingKind
+	path   string
+}{
+	{
+		"lost chain",
+		func(f *FileSystem, device fs.BlockDevice) {
+			f.fat.AllocChain(1)
+			f.fat.WriteToDevice(device)
+		},
+		FindingLostChain,
+		"",
+	},
+	{
+		"cross-link",
+		func(f *FileSystem, device fs.BlockDevice) {
+			other := checkTestEntry(f, "other.txt").entry.cluster
+			chain := f.fat.Chain(checkTestEntry(f, "hello.txt").entry.cluster)
+			f.fat.setEntry(chain[len(chain)-1], other)
+			f.fat.WriteToDevice(device)
+		},
+		FindingCrossLink,
+		"/other.txt",
+	},
+	{
+		"chain too long",
+		func(f *FileSystem, device fs.BlockDevice) {
+			entry := checkTestEntry(f, "hello.txt")
+			entry.entry.fileSize = 10
+			entry.dir.dirCluster.WriteToDevice(device, f.fat)
+		},
+		FindingChainTooLong,
+		"/hello.txt",
+	},
+	{
+		"chain too short",
+		func(f *FileSystem, device fs.BlockDevice) {
+			entry := checkTestEntry(f, "other.txt")
+			entry.entry.fileSize = f.bs.BytesPerCluster() * 3
+			entry.dir.dirCluster.WriteToDevice(device, f.fat)
+		},
+		FindingChainTooShort,
+		"/other.txt",
+	},
+	{
+		"invalid cluster",
+		func(f *FileSystem, device fs.BlockDevice) {
+			chain := f.fat.Chain(checkTestEntry(f, "hello.txt").entry.cluster)
+			f.fat.setEntry(chain[0], 0xFFF0)
+			f.fat.WriteToDevice(device)
+		},
+		FindingInvalidCluster,
+		"/hello.txt",
+	},
+	{
+		"bad dot entry",
+		func(f *FileSystem, device fs.BlockDevice) {
+			dir, _ := checkTestEntry(f, "dir").Dir()
+			dirCluster := dir.(*Directory).dirCluster
+			dirCluster.entries[1].cluster = 1234
+			dirCluster.WriteToDevice(device, f.fat)
+		},
+		FindingBadDotEntry,
+		"/dir/",
+	},
+	{
+		"orphan long name",
+		func(f *FileSystem, device fs.BlockDevice) {
+			entry := checkTestEntry(f, "hello.txt")
+			entry.entry.name = "RENAMED"
+			entry.dir.dirCluster.WriteToDevice(device, f.fat)
+		},
+		FindingOrphanLongName,
+		"/",
+	},
+	{
+		"dirty volume",
+		func(f *FileSystem, device fs.BlockDevice) {
+			f.fat.setEntry(1, f.fat.entries[1]&^f.fat.cleanShutdownMask())
+			f.fat.WriteToDevice(device)
+		},
+		FindingDirtyVolume,
+		"",
+	},
+	{
+		"FAT mismatch",
+		func(f *FileSystem, device fs.BlockDevice) {
+			data := f.fat.Bytes()
+			data[len(data)-1] = 0xFF
+			device.WriteAt(data, int64(f.bs.FATOffset(1)))
+		},
+		FindingFATMismatch,
+		"",
+	},
+}
+
+func TestCheck_clean(t *testing.T) {
+	for _, fatType := range []FATType{FAT12, FAT16, FAT32} {
+		size := int64(16 * 1024 * 1024)
+		switch fatType {
+		case FAT12:
+			size = 1440 * 1024
+		case FAT32:
+			size = 64 * 1024 * 1024
+		}
+
+		filesys, device := testFileSystem(t, fatType, size)
+		checkTestFiles(t, filesys)
+
+		before := make([]byte, size)
+		device.ReadAt(before, 0)
+
+		report, err := Check(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !report.OK() {
+			t.Fatalf("%d: bad findings: %v", fatType, report.Findings)
+		}
+
+		if report.Files != 3 || report.Directories != 1 {
+			t.Fatalf("bad counts: %d %d", report.Files, report.Directories)
+		}
+
+		after := make([]byte, size)
+		device.ReadAt(after, 0)
+		if !bytes.Equal(before, after) {
+			t.Fatal("device should not be modified")
+		}
+	}
+}
+
+// checkTestFileSystem returns a FAT16 filesystem with a few files in it
+// for checking.
+func checkTestFileSystem(t *testing.T) (*FileSystem, fs.BlockDevice) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	checkTestFiles(t, filesys)
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+
+	return filesys, device
+}
+
+// checkTestFiles creates "hello.txt" with two clusters, "other.txt"
+// with one cluster and "dir/inner.txt" in the root directory.
+func checkTestFiles(t *testing.T, filesys *FileSystem) {
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bpc := int(filesys.bs.BytesPerCluster())
+	files := []struct {
+		name string
+		size int
+	}{
+		{"hello.txt", bpc + 1},
+		{"other.txt", 10},
+	}
+
+	for _, f := range files {
+		entry, err := rootDir.AddFile(f.name)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file, err := entry.File()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, err := file.Write(bytes.Repeat([]byte("x"), f.size)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	entry, err := rootDir.AddDirectory("dir")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := dir.AddFile("inner.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func checkTestEntry(f *FileSystem, name string) *DirectoryEntry {
+	rootDir, _ := f.RootDir()
+	return rootDir.Entry(name).(*DirectoryEntry)
+}
@@ -15,31 +15,40 @@ type ClusterChain struct {
 	writeOffset  uint32
 }
 
+// Read reads from the cluster chain. The chain has no notion of the size
+// of the file it holds, so this reads up to the end of the last cluster.
 func (c *ClusterChain) Read(p []byte) (n int, err error) {
+	n, err = c.readAt(p, c.readOffset)
+	c.readOffset += uint32(n)
+	return
+}
+
+// readAt reads from the cluster chain at the given offset.
+func (c *ClusterChain) readAt(p []byte, off uint32) (n int, err error) {
 	bpc := c.fat.bs.BytesPerCluster()
 	chain := c.fat.Chain(c.startCluster)
 
 	dataOffset := uint32(0)
 	for dataOffset < uint32(len(p)) {
-		chainIdx := c.readOffset / bpc
+		chainIdx := off / bpc
 		if int(chainIdx) >= len(chain) {
 			err = io.EOF
 			return
 		}
 
 		clusterOffset := c.fat.bs.ClusterOffset(int(chain[chainIdx]))
-		clusterOffset += c.readOffset % bpc
+		clusterOffset += int64(off % bpc)
 		dataOffsetEnd := dataOffset + bpc
-		dataOffsetEnd -= c.readOffset % bpc
+		dataOffsetEnd -= off % bpc
 		dataOffsetEnd = uint32(math.Min(float64(dataOffsetEnd), float64(len(p))))
 
 		var nw int
-		nw, err = c.device.ReadAt(p[dataOffset:dataOffsetEnd], int64(clusterOffset))
+		nw, err = c.device.ReadAt(p[dataOffset:dataOffsetEnd], clusterOffset)
 		if err != nil {
 			return
 		}
 
-		c.readOffset += uint32(nw)
+		off += uint32(nw)
 		dataOffset += uint32(nw)
 		n += nw
 	}
@@ -49,13 +58,21 @@ func (c *ClusterChain) Read(p []byte) (n int, err error) {
 
 // Write will write to the cluster chain, expanding it if necessary.
 func (c *ClusterChain) Write(p []byte) (n int, err error) {
+	n, err = c.writeAt(p, c.writeOffset)
+	c.writeOffset += uint32(n)
+	return
+}
+
+// writeAt writes to the cluster chain at the given offset, expanding it
+// if necessary.
+func (c *ClusterChain) writeAt(p []byte, off uint32) (n int, err error) {
 	bpc := c.fat.bs.BytesPerCluster()
 	chain := c.fat.Chain(c.startCluster)
 	chainLength := uint32(len(chain)) * bpc
 
-	if chainLength < c.writeOffset+uint32(len(p)) {
+	if chainLength < off+uint32(len(p)) {
 		// We need to grow the chain
-		bytesNeeded := (c.writeOffset + uint32(len(p))) - chainLength
+		bytesNeeded := (off + uint32(len(p))) - chainLength
 		clustersNeeded := int(math.Ceil(float64(bytesNeeded) / float64(bpc)))
 		chain, err = c.fat.ResizeChain(c.startCluster, len(chain)+clustersNeeded)
 		if err != nil {
@@ -70,20 +87,20 @@ func (c *ClusterChain) Write(p []byte) (n int, err error) {
 
 	dataOffset := uint32(0)
 	for dataOffset < uint32(len(p)) {
-		chainIdx := c.writeOffset / bpc
+		chainIdx := off / bpc
 		clusterOffset := c.fat.bs.ClusterOffset(int(chain[chainIdx]))
-		clusterOffset += c.writeOffset % bpc
+		clusterOffset += int64(off % bpc)
 		dataOffsetEnd := dataOffset + bpc
-		dataOffsetEnd -= c.writeOffset % bpc
+		dataOffsetEnd -= off % bpc
 		dataOffsetEnd = uint32(math.Min(float64(dataOffsetEnd), float64(len(p))))
 
 		var nw int
-		nw, err = c.device.WriteAt(p[dataOffset:dataOffsetEnd], int64(clusterOffset))
+		nw, err = c.device.WriteAt(p[dataOffset:dataOffsetEnd], clusterOffset)
 		if err != nil {
 			return
 		}
 
-		c.writeOffset += uint32(nw)
+		off += uint32(nw)
 		dataOffset += uint32(nw)
 		n += nw
 	}
@@ -0,0 +1,286 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// These tests are most useful with the race detector: go test -race
+
+func TestFileSystem_concurrentAdd(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddDirectory("sub"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Every goroutine opens the directory on its own, so they don't
+	// share the Directory, only what is behind it.
+	const workers = 8
+	const files = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			rootDir, _ := filesys.RootDir()
+			subDir, err := rootDir.Entry("sub").Dir()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for j := 0; j < files; j++ {
+				entry, err := subDir.AddFile(fmt.Sprintf("file %d-%d.txt", i, j))
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				file, err := entry.File()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if _, err := file.Write([]byte(entry.Name())); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Everything has to be there when the filesystem is mounted again
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ = filesys.RootDir()
+	subDir, err := rootDir.Entry("sub").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n := len(subDir.Entries()); n != workers*files+2 {
+		t.Fatalf("bad entry count: %d", n)
+	}
+
+	for _, entry := range subDir.Entries() {
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+
+		file, _ := entry.File()
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if string(data) != entry.Name() {
+			t.Fatalf("bad data for %s: %q", entry.Name(), data)
+		}
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
+
+func TestFileSystem_concurrentReadWrite(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT32, 64*1024*1024)
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	entry, err := rootDir.AddFile("read.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, _ := entry.File()
+	if _, err := file.Write(contents); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err = rootDir.AddFile("write.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A single File shared by all the writers
+	shared, _ := entry.File()
+
+	const workers = 4
+	const writes = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*3)
+	for i := 0; i < workers; i++ {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+
+			file, _ := rootDir.Entry("read.txt").File()
+			for j := 0; j < writes; j++ {
+				data := make([]byte, len(contents))
+				if _, err := file.ReadAt(data, 0); err != nil {
+					errs <- err
+					return
+				}
+
+				if !bytes.Equal(data, contents) {
+					errs <- fmt.Errorf("bad data")
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < writes; j++ {
+				if _, err := shared.Write([]byte("0123456789")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < writes; j++ {
+				if _, err := filesys.Stat(); err != nil {
+					errs <- err
+					return
+				}
+
+				for _, entry := range rootDir.Entries() {
+					entry.(*DirectoryEntry).Size()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+
+	if size := rootDir.Entry("write.txt").(*DirectoryEntry).Size(); size != workers*writes*10 {
+		t.Fatalf("bad size: %d", size)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
+
+func TestFileSystem_concurrentRemove(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	const workers = 8
+	for i := 0; i < workers; i++ {
+		entry, err := rootDir.AddDirectory(fmt.Sprintf("dir%d", i))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		dir, _ := entry.Dir()
+		if _, err := dir.AddFile("file"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Remove every directory while others are creating new ones in
+	// its place.
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if err := rootDir.(*Directory).RemoveAll(fmt.Sprintf("dir%d", i)); err != nil {
+				errs <- err
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+
+			entry, err := rootDir.AddDirectory(fmt.Sprintf("new%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			dir, err := entry.Dir()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err := dir.AddFile("file"); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n := len(rootDir.Entries()); n != workers {
+		t.Fatalf("bad entry count: %d", n)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
@@ -0,0 +1,421 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// DefragmentOptions are the options for Defragment.
+type DefragmentOptions struct {
+	// Compact packs every chain at the start of the data area, in the
+	// order of the directory tree, so that all the free space ends up at
+	// the end of the volume. Otherwise only fragmented chains are moved,
+	// each to the first free run that is large enough.
+	Compact bool
+
+	// Progress, if not nil, is called after every cluster that is moved
+	// with the number of clusters moved so far and the total number of
+	// clusters to move.
+	Progress func(moved, total int)
+}
+
+// DefragmentReport is the result of Defragment.
+type DefragmentReport struct {
+	// Before and After are the fragmentation of the volume before and
+	// after defragmenting.
+	Before Fragmentation
+	After  Fragmentation
+
+	// Moved is the number of clusters that were moved.
+	Moved int
+}
+
+// Fragmentation describes how fragmented the chains of a volume are.
+type Fragmentation struct {
+	// Chains is the number of chains with at least one cluster, and
+	// Fragmented is the number of those that aren't a single run.
+	Chains     int
+	Fragmented int
+
+	// Links is the number of links from one cluster of a chain to the
+	// next, and Breaks is the number of those that jump to a cluster
+	// that isn't the next one on disk.
+	Links  int
+	Breaks int
+}
+
+// Score returns the fraction of links that are breaks, from 0 for a
+// volume where every chain is contiguous up to 1.
+func (f Fragmentation) Score() float64 {
+	if f.Links == 0 {
+		return 0
+	}
+
+	return float64(f.Breaks) / float64(f.Links)
+}
+
+func (f Fragmentation) String() string {
+	return fmt.Sprintf("%d of %d chains fragmented, score %.3f",
+		f.Fragmented, f.Chains, f.Score())
+}
+
+// Defragment moves the clusters of the FAT filesystem on the device so
+// that every file and directory occupies a single run of clusters. The
+// FAT, the start clusters of the directory entries, the "." and ".."
+// entries and, on FAT32, the root cluster in the boot sector are all
+// rewritten to match.
+//
+// The filesystem must be consistent, so run Repair first if Check finds
+// problems. Defragment is not safe to interrupt: if it stops halfway the
+// volume will be corrupt.
+//
+// If options is nil, the defaults are used.
+func Defragment(device fs.BlockDevice, options *DefragmentOptions) (*DefragmentReport, error) {
+	if options == nil {
+		options = new(DefragmentOptions)
+	}
+
+	c, err := newChecker(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	for _, finding := range c.report.Findings {
+		if finding.Kind != FindingDirtyVolume {
+			return nil, fmt.Errorf("filesystem needs repair: %s", finding)
+		}
+	}
+
+	d := &defragmenter{checker: c, options: options}
+	return d.defragment()
+}
+
+// defragmenter holds the state of a single run of Defragment.
+type defragmenter struct {
+	*checker
+
+	options *DefragmentOptions
+
+	// moves maps the clusters that move to their new location.
+	moves map[uint32]uint32
+}
+
+func (d *defragmenter) defragment() (*DefragmentReport, error) {
+	report := &DefragmentReport{Before: d.fragmentation()}
+
+	layout, err := d.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	d.moves = make(map[uint32]uint32)
+	for i, chain := range d.chains {
+		for j, cluster := range chain.clusters {
+			if layout[i][j] != cluster {
+				d.moves[cluster] = layout[i][j]
+			}
+		}
+	}
+
+	report.Moved = len(d.moves)
+	if report.Moved == 0 {
+		report.After = report.Before
+		return report, nil
+	}
+
+	if err := d.moveClusters(); err != nil {
+		return nil, err
+	}
+
+	if err := d.rewriteFAT(layout); err != nil {
+		return nil, err
+	}
+
+	if err := d.rewriteEntries(); err != nil {
+		return nil, err
+	}
+
+	report.After = d.fragmentation()
+	return report, nil
+}
+
+// plan returns the new clusters of every chain.
+func (d *defragmenter) plan() ([][]uint32, error) {
+	last := d.lastCluster()
+	bad := d.fat.badCluster()
+
+	// used marks the clusters that can't be moved into
+	used := make([]bool, last)
+	for cluster := uint32(FirstCluster); cluster < last; cluster++ {
+		used[cluster] = d.fat.entries[cluster] == bad
+	}
+
+	if !d.options.Compact {
+		for _, chain := range d.chains {
+			if !fragmented(chain.clusters) {
+				for _, cluster := range chain.clusters {
+					used[cluster] = true
+				}
+			}
+		}
+	}
+
+	result := make([][]uint32, len(d.chains))
+	next := uint32(FirstCluster)
+	for i, chain := range d.chains {
+		if !d.options.Compact && !fragmented(chain.clusters) {
+			result[i] = chain.clusters
+			continue
+		}
+
+		n := uint32(len(chain.clusters))
+		start, ok := findFreeRun(used, next, n)
+		if !ok {
+			return nil, errors.New("no free run of clusters large enough, try compacting")
+		}
+
+		result[i] = make([]uint32, n)
+		for j := range result[i] {
+			result[i][j] = start + uint32(j)
+			used[start+uint32(j)] = true
+		}
+
+		if d.options.Compact {
+			next = start + n
+		}
+	}
+
+	return result, nil
+}
+
+// findFreeRun returns the first cluster of the first run of n clusters
+// that aren't used, starting the search at the given cluster.
+func findFreeRun(used []bool, from uint32, n uint32) (uint32, bool) {
+	run := uint32(0)
+	for cluster := from; cluster < uint32(len(used)); cluster++ {
+		if used[cluster] {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == n {
+			return cluster - n + 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// moveClusters copies the data of every cluster that moves to its new
+// location. Moves may form chains and cycles, where the destination of
+// one move is the source of another, so the data of a destination is
+// read before it is overwritten and then moved on in turn.
+func (d *defragmenter) moveClusters() error {
+	bpc := d.bs.BytesPerCluster()
+	done := make(map[uint32]bool)
+	moved := 0
+
+	read := func(cluster uint32) ([]byte, error) {
+		data := make([]byte, bpc)
+		_, err := d.device.ReadAt(data, d.bs.ClusterOffset(int(cluster)))
+		return data, err
+	}
+
+	for _, chain := range d.chains {
+		for _, source := range chain.clusters {
+			target, ok := d.moves[source]
+			if !ok || done[source] {
+				continue
+			}
+
+			data, err := read(source)
+			if err != nil {
+				return err
+			}
+
+			done[source] = true
+			for {
+				var next []byte
+				_, pending := d.moves[target]
+				if pending && !done[target] {
+					if next, err = read(target); err != nil {
+						return err
+					}
+
+					done[target] = true
+				}
+
+				if _, err := d.device.WriteAt(data, d.bs.ClusterOffset(int(target))); err != nil {
+					return err
+				}
+
+				moved++
+				if d.options.Progress != nil {
+					d.options.Progress(moved, len(d.moves))
+				}
+
+				if next == nil {
+					break
+				}
+
+				data = next
+				target = d.moves[target]
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteFAT replaces every chain in the FAT with its new layout.
+func (d *defragmenter) rewriteFAT(layout [][]uint32) error {
+	eof := 0xFFFFFFFF & d.fat.entryMask()
+	for _, chain := range d.chains {
+		for _, cluster := range chain.clusters {
+			d.fat.setEntry(cluster, 0)
+		}
+	}
+
+	for i, chain := range d.chains {
+		clusters := layout[i]
+		for j, cluster := range clusters {
+			if j == len(clusters)-1 {
+				d.fat.setEntry(cluster, eof)
+			} else {
+				d.fat.setEntry(cluster, clusters[j+1])
+			}
+		}
+
+		chain.clusters = clusters
+	}
+
+	// The FSInfo hints are stale now, so point the next free hint, the
+	// last allocated cluster, right before the first free cluster.
+	if d.bs32 != nil {
+		if fsInfo, err := DecodeFSInfo(d.device, d.bs32); err == nil {
+			fsInfo.NextFree = FSInfoUnknown
+			for cluster := uint32(FirstCluster); cluster < d.lastCluster(); cluster++ {
+				if d.fat.entries[cluster] == 0 {
+					if cluster > FirstCluster {
+						fsInfo.NextFree = cluster - 1
+					}
+					break
+				}
+			}
+
+			d.fat.fsInfo = fsInfo
+			d.fat.fsInfoDirty = true
+			d.fat.fsInfoSector = d.bs32.FSInfoSector
+		}
+	}
+
+	return d.fat.WriteToDevice(d.device)
+}
+
+// rewriteEntries points every directory entry, including the "." and
+// ".." entries, at the new start of its chain and writes out every
+// directory.
+func (d *defragmenter) rewriteEntries() error {
+	for _, chain := range d.chains {
+		start := chain.clusters[0]
+		if chain.entry != nil {
+			chain.entry.cluster = start
+		}
+
+		if chain.dir != nil {
+			chain.dir.startCluster = start
+		}
+	}
+
+	for _, chain := range d.chains {
+		if chain.dir == nil || chain.entry == nil {
+			continue
+		}
+
+		chain.dir.entries[0].cluster = chain.dir.startCluster
+		chain.dir.entries[1].cluster = chain.parent.dotDotCluster()
+	}
+
+	if err := d.root.WriteToDevice(d.device, d.fat); err != nil {
+		return err
+	}
+
+	for _, chain := range d.chains {
+		if chain.dir == nil || chain.dir == d.root {
+			continue
+		}
+
+		if err := chain.dir.WriteToDevice(d.device, d.fat); err != nil {
+			return err
+		}
+	}
+
+	if d.bs32 != nil && d.bs32.RootCluster != d.root.startCluster {
+		return d.rewriteRootCluster()
+	}
+
+	return nil
+}
+
+// rewriteRootCluster points BPB_RootClus of the boot sector and its
+// backup copy at the new start of the FAT32 root directory.
+func (d *defragmenter) rewriteRootCluster() error {
+	sectors := []int64{0}
+	if d.bs32.BackupBootSector != 0 {
+		sectors = append(sectors, int64(d.bs32.BackupBootSector))
+	}
+
+	for _, sector := range sectors {
+		offset := sector * int64(d.bs.BytesPerSector)
+		data, err := readBootSector(d.device, offset)
+		if err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint32(data[44:48], d.root.startCluster)
+		if _, err := d.device.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+
+	d.bs32.RootCluster = d.root.startCluster
+	return nil
+}
+
+func (d *defragmenter) fragmentation() Fragmentation {
+	var result Fragmentation
+	for _, chain := range d.chains {
+		result.Chains++
+		result.Links += len(chain.clusters) - 1
+		for i := 1; i < len(chain.clusters); i++ {
+			if chain.clusters[i] != chain.clusters[i-1]+1 {
+				result.Breaks++
+			}
+		}
+
+		if fragmented(chain.clusters) {
+			result.Fragmented++
+		}
+	}
+
+	return result
+}
+
+// fragmented returns true if the clusters aren't a single run.
+func fragmented(clusters []uint32) bool {
+	for i := 1; i < len(clusters); i++ {
+		if clusters[i] != clusters[i-1]+1 {
+			return true
+		}
+	}
+
+	return false
+}
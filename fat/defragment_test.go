@@ -0,0 +1,196 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestDefragment(t *testing.T) {
+	cases := []struct {
+		fatType FATType
+		size    int64
+		compact bool
+	}{
+		{FAT16, 16 * 1024 * 1024, false},
+		{FAT16, 16 * 1024 * 1024, true},
+		{FAT32, 64 * 1024 * 1024, false},
+		{FAT32, 64 * 1024 * 1024, true},
+	}
+
+	for _, tc := range cases {
+		filesys, device := testFileSystem(t, tc.fatType, tc.size)
+		contents := defragmentTestFiles(t, filesys)
+
+		before, err := Check(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !before.OK() {
+			t.Fatalf("bad findings: %v", before.Findings)
+		}
+
+		progress := 0
+		options := &DefragmentOptions{
+			Compact: tc.compact,
+			Progress: func(moved, total int) {
+				progress = moved
+			},
+		}
+
+		report, err := Defragment(device, options)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if report.Before.Fragmented == 0 || report.Before.Score() == 0 {
+			t.Fatalf("should be fragmented before: %s", report.Before)
+		}
+
+		if report.After.Fragmented != 0 || report.After.Score() != 0 {
+			t.Fatalf("should not be fragmented after: %s", report.After)
+		}
+
+		if report.Moved == 0 || progress != report.Moved {
+			t.Fatalf("bad progress: %d %d", progress, report.Moved)
+		}
+
+		after, err := Check(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !after.OK() {
+			t.Fatalf("bad findings after: %v", after.Findings)
+		}
+
+		defragmentTestVerify(t, device, contents)
+
+		// Compacting leaves all the free space at the end
+		if tc.compact {
+			filesys, err := New(device)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			free := false
+			for cluster := uint32(FirstCluster); cluster < filesys.bs.ClusterCount()+FirstCluster; cluster++ {
+				if filesys.fat.entries[cluster] == 0 {
+					free = true
+				} else if free {
+					t.Fatalf("cluster %d used after free space", cluster)
+				}
+			}
+		}
+	}
+}
+
+func TestDefragment_needsRepair(t *testing.T) {
+	filesys, device := checkTestFileSystem(t)
+	filesys.fat.AllocChain(1)
+	filesys.fat.WriteToDevice(device)
+
+	if _, err := Defragment(device, nil); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+// defragmentTestFiles creates files and directories whose chains are
+// interleaved and returns the contents of every file by path.
+func defragmentTestFiles(t *testing.T, filesys *FileSystem) map[string][]byte {
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddDirectory("sub")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bpc := int(filesys.bs.BytesPerCluster())
+	contents := make(map[string][]byte)
+	var files []fs.File
+	var paths []string
+	for i, dir := range []fs.Directory{rootDir, subDir, rootDir} {
+		name := fmt.Sprintf("file%d.txt", i)
+		entry, err := dir.AddFile(name)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file, err := entry.File()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		path := name
+		if dir == subDir {
+			path = "sub/" + name
+		}
+
+		files = append(files, file)
+		paths = append(paths, path)
+	}
+
+	// Write a cluster to each file in turn so the chains interleave
+	for round := 0; round < 4; round++ {
+		for i, file := range files {
+			data := bytes.Repeat([]byte{byte('a' + i + round)}, bpc)
+			if _, err := file.Write(data); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			contents[paths[i]] = append(contents[paths[i]], data...)
+		}
+
+		// Grow the directories too
+		for _, dir := range []fs.Directory{rootDir, subDir} {
+			for i := 0; i < bpc/DirectoryEntrySize/4; i++ {
+				name := fmt.Sprintf("F%d_%d", round, i)
+				if _, err := dir.AddFile(name); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+
+				if dir == subDir {
+					name = "sub/" + name
+				}
+
+				contents[name] = nil
+			}
+		}
+	}
+
+	return contents
+}
+
+func defragmentTestVerify(t *testing.T, device fs.BlockDevice, contents map[string][]byte) {
+	fsys := fs.NewIOFS(mustNew(t, device))
+	for path, expected := range contents {
+		data, err := fsys.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: err: %s", path, err)
+		}
+
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("%s: bad contents", path)
+		}
+	}
+}
+
+func mustNew(t *testing.T, device fs.BlockDevice) *FileSystem {
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return filesys
+}
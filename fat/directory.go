@@ -2,6 +2,7 @@ package fat
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ type Directory struct {
 	device     fs.BlockDevice
 	dirCluster *DirectoryCluster
 	fat        *FAT
+	filesys    *FileSystem
 }
 
 // DirectoryEntry implements fs.DirectoryEntry and represents a single
@@ -36,13 +38,9 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 	var entry *DirectoryClusterEntry
 	var name string
 
-	// Skip all the deleted entries
-	for len(entries) > 0 && entries[0].deleted {
-		entries = entries[1:]
-	}
-
-	// Skip the volume ID
-	if len(entries) > 0 && entries[0].IsVolumeId() {
+	// Skip all the deleted entries and volume IDs. Long entries have the
+	// volume ID attribute set as well, so don't mistake them for one.
+	for len(entries) > 0 && (entries[0].deleted || (entries[0].IsVolumeId() && !entries[0].IsLong())) {
 		entries = entries[1:]
 	}
 
@@ -51,23 +49,23 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 	}
 
 	// We have a long entry, so we have to traverse to the point where
-	// we're done. Also, calculate out the name and such.
+	// we're done.
 	if entries[0].IsLong() {
-		lfnEntries := make([]*DirectoryClusterEntry, 0, 3)
-		for entries[0].IsLong() {
+		lfnEntries = make([]*DirectoryClusterEntry, 0, 3)
+		for len(entries) > 0 && entries[0].IsLong() && !entries[0].deleted {
+			// The start of another long name ends this one
+			if len(lfnEntries) > 0 && entries[0].longOrd&LastLongEntryMask != 0 {
+				break
+			}
+
 			lfnEntries = append(lfnEntries, entries[0])
 			entries = entries[1:]
 		}
 
-		var nameBytes []rune
-		nameBytes = make([]rune, 13*len(lfnEntries))
-		for i := len(lfnEntries) - 1; i >= 0; i-- {
-			for _, char := range lfnEntries[i].longName {
-				nameBytes = append(nameBytes, char)
-			}
+		// Long entries that aren't followed by a short entry are orphans
+		if len(entries) == 0 || entries[0].IsLong() {
+			return nil, entries, nil
 		}
-
-		name = string(nameBytes)
 	}
 
 	// Get the short entry
@@ -79,9 +77,26 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 		return nil, entries, nil
 	}
 
+	// The long entries only count if they belong to the short entry,
+	// otherwise we fall back to the short name.
+	if len(lfnEntries) > 0 {
+		name = decodeLongName(lfnEntries, entry)
+		if name == "" {
+			lfnEntries = nil
+		}
+	}
+
 	if name == "" {
 		name = strings.TrimSpace(entry.name)
+		if entry.caseFlags&caseLowerName != 0 {
+			name = strings.ToLower(name)
+		}
+
 		ext := strings.TrimSpace(entry.ext)
+		if entry.caseFlags&caseLowerExt != 0 {
+			ext = strings.ToLower(ext)
+		}
+
 		if ext != "" {
 			name = fmt.Sprintf("%s.%s", name, ext)
 		}
@@ -102,8 +117,16 @@ func (d *DirectoryEntry) Dir() (fs.Directory, error) {
 		panic("not a directory")
 	}
 
-	dirCluster, err := DecodeDirectoryCluster(
-		d.entry.cluster, d.dir.device, d.dir.fat)
+	d.dir.filesys.lock.RLock()
+	defer d.dir.filesys.lock.RUnlock()
+
+	return d.openDir()
+}
+
+// openDir returns the directory of this entry. The caller must hold the
+// filesystem lock.
+func (d *DirectoryEntry) openDir() (*Directory, error) {
+	dirCluster, err := d.dir.filesys.directory(d.entry.cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -112,6 +135,7 @@ func (d *DirectoryEntry) Dir() (fs.Directory, error) {
 		device:     d.dir.device,
 		dirCluster: dirCluster,
 		fat:        d.dir.fat,
+		filesys:    d.dir.filesys,
 	}
 
 	return result, nil
@@ -143,8 +167,47 @@ func (d *DirectoryEntry) Name() string {
 	return d.name
 }
 
+// Size returns the size of the file in bytes. Directories have no size.
+func (d *DirectoryEntry) Size() int64 {
+	d.dir.filesys.lock.RLock()
+	defer d.dir.filesys.lock.RUnlock()
+
+	return int64(d.entry.fileSize)
+}
+
+// Mode maps the DOS attributes of the entry to a file mode. Directories
+// are ModeDir with 0777 permissions and files have 0666 permissions,
+// without the write permissions if the read-only attribute is set. The
+// hidden, system and archive attributes have no file mode equivalent,
+// they are only returned by Sys.
+func (d *DirectoryEntry) Mode() os.FileMode {
+	mode := os.FileMode(0666)
+	if d.IsDir() {
+		mode = os.ModeDir | 0777
+	}
+
+	if d.entry.attr&AttrReadOnly == AttrReadOnly {
+		mode &^= 0222
+	}
+
+	return mode
+}
+
+// ModTime returns the time the entry was last written.
+func (d *DirectoryEntry) ModTime() time.Time {
+	d.dir.filesys.lock.RLock()
+	defer d.dir.filesys.lock.RUnlock()
+
+	return d.entry.writeTime
+}
+
+// Sys returns the DOS attributes of the entry as a DirectoryAttr.
+func (d *DirectoryEntry) Sys() interface{} {
+	return d.entry.attr
+}
+
 func (d *DirectoryEntry) ShortName() string {
-	if d.entry.name == "." || d.entry.name == ".." {
+	if d.entry.name == "." || d.entry.name == ".." || d.entry.ext == "" {
 		return d.entry.name
 	}
 
@@ -152,6 +215,9 @@ func (d *DirectoryEntry) ShortName() string {
 }
 
 func (d *Directory) AddDirectory(name string) (fs.DirectoryEntry, error) {
+	d.filesys.lock.Lock()
+	defer d.filesys.lock.Unlock()
+
 	entry, err := d.addEntry(name, AttrDirectory)
 	if err != nil {
 		return nil, err
@@ -159,7 +225,7 @@ func (d *Directory) AddDirectory(name string) (fs.DirectoryEntry, error) {
 
 	// Create the new directory cluster
 	newDirCluster := NewDirectoryCluster(
-		entry.entry.cluster, d.dirCluster.startCluster, entry.entry.createTime)
+		entry.entry.cluster, d.dirCluster.dotDotCluster(), entry.entry.createTime)
 
 	if err := newDirCluster.WriteToDevice(d.device, d.fat); err != nil {
 		return nil, err
@@ -169,6 +235,9 @@ func (d *Directory) AddDirectory(name string) (fs.DirectoryEntry, error) {
 }
 
 func (d *Directory) AddFile(name string) (fs.DirectoryEntry, error) {
+	d.filesys.lock.Lock()
+	defer d.filesys.lock.Unlock()
+
 	entry, err := d.addEntry(name, DirectoryAttr(0))
 	if err != nil {
 		return nil, err
@@ -178,6 +247,15 @@ func (d *Directory) AddFile(name string) (fs.DirectoryEntry, error) {
 }
 
 func (d *Directory) Entries() []fs.DirectoryEntry {
+	d.filesys.lock.RLock()
+	defer d.filesys.lock.RUnlock()
+
+	return d.entries()
+}
+
+// entries returns the entries of the directory. The caller must hold the
+// filesystem lock.
+func (d *Directory) entries() []fs.DirectoryEntry {
 	entries := d.dirCluster.entries
 	result := make([]fs.DirectoryEntry, 0, len(entries)/2)
 	for len(entries) > 0 {
@@ -192,63 +270,125 @@ func (d *Directory) Entries() []fs.DirectoryEntry {
 }
 
 func (d *Directory) Entry(name string) fs.DirectoryEntry {
+	d.filesys.lock.RLock()
+	defer d.filesys.lock.RUnlock()
+
+	if entry := d.entry(name); entry != nil {
+		return entry
+	}
+
+	return nil
+}
+
+// entry returns the entry with the given name, or nil. The caller must
+// hold the filesystem lock.
+func (d *Directory) entry(name string) *DirectoryEntry {
 	name = strings.ToUpper(name)
 
-	for _, entry := range d.Entries() {
+	for _, entry := range d.entries() {
 		if strings.ToUpper(entry.Name()) == name {
-			return entry
+			return entry.(*DirectoryEntry)
 		}
 	}
 
 	return nil
 }
 
-func (d *Directory) addEntry(name string, attr DirectoryAttr) (*DirectoryEntry, error) {
-	name = strings.TrimSpace(name)
+// Remove removes the file or empty directory with the given name. The
+// clusters it used are freed.
+func (d *Directory) Remove(name string) error {
+	d.filesys.lock.Lock()
+	defer d.filesys.lock.Unlock()
 
-	entries := d.Entries()
-	usedNames := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if strings.ToUpper(entry.Name()) == strings.ToUpper(name) {
-			return nil, fmt.Errorf("name already exists: %s", name)
+	return d.remove(name, false)
+}
+
+// RemoveAll removes the file or directory with the given name, along
+// with everything the directory contains.
+func (d *Directory) RemoveAll(name string) error {
+	d.filesys.lock.Lock()
+	defer d.filesys.lock.Unlock()
+
+	return d.remove(name, true)
+}
+
+func (d *Directory) remove(name string, recursive bool) error {
+	entry := d.entry(name)
+	if entry == nil {
+		return fmt.Errorf("file not found: %s", name)
+	}
+
+	if entry.entry.name == "." || entry.entry.name == ".." {
+		return fmt.Errorf("cannot remove: %s", name)
+	}
+
+	if entry.IsDir() {
+		dir, err := entry.openDir()
+		if err != nil {
+			return err
 		}
 
-		// Add it to the list of used names
-		dirEntry := entry.(*DirectoryEntry)
-		usedNames = append(usedNames, dirEntry.ShortName())
+		for _, child := range dir.entries() {
+			childName := child.(*DirectoryEntry).entry.name
+			if childName == "." || childName == ".." {
+				continue
+			}
+
+			if !recursive {
+				return fmt.Errorf("directory not empty: %s", name)
+			}
+
+			if err := dir.remove(child.Name(), true); err != nil {
+				return err
+			}
+		}
 	}
 
-	shortName, err := generateShortName(name, usedNames)
+	if entry.IsDir() {
+		d.filesys.forgetDirectory(entry.entry.cluster)
+	}
+
+	// Mark the short entry and all its long entries as deleted and write
+	// them out before the clusters are freed, so that a crash in between
+	// can only leak the clusters and never leaves an entry that points at
+	// free clusters.
+	for _, lfn := range entry.lfnEntries {
+		lfn.deleted = true
+	}
+	entry.entry.deleted = true
+
+	if err := d.dirCluster.WriteToDevice(d.device, d.fat); err != nil {
+		return err
+	}
+
+	// Free the clusters and write the new FAT out
+	d.fat.FreeChain(entry.entry.cluster)
+	return d.fat.WriteToDevice(d.device)
+}
+
+func (d *Directory) addEntry(name string, attr DirectoryAttr) (*DirectoryEntry, error) {
+	name = strings.TrimSpace(name)
+
+	shortEntry, lfnEntries, err := d.newEntryNames(name, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	var lfnEntries []*DirectoryClusterEntry
-	if shortName != strings.ToUpper(name) {
-		lfnEntries, err = NewLongDirectoryClusterEntry(name, shortName)
-		if err != nil {
-			return nil, err
-		}
+	// Make sure there is room for the entries before allocating anything
+	if _, err := d.dirCluster.freeSlots(len(lfnEntries) + 1); err != nil {
+		return nil, err
 	}
 
 	// Allocate space for a cluster
-	startCluster, err := d.fat.AllocChain()
+	startCluster, err := d.fat.AllocChain(1)
 	if err != nil {
 		return nil, err
 	}
 
 	createTime := time.Now()
 
-	// Create the entry for the short name
-	shortParts := strings.Split(shortName, ".")
-	if len(shortParts) == 1 {
-		shortParts = append(shortParts, "")
-	}
-
-	shortEntry := new(DirectoryClusterEntry)
+	// Fill in the rest of the entry for the short name
 	shortEntry.attr = attr
-	shortEntry.name = shortParts[0]
-	shortEntry.ext = shortParts[1]
 	shortEntry.cluster = startCluster
 	shortEntry.accessTime = createTime
 	shortEntry.createTime = createTime
@@ -259,13 +399,11 @@ func (d *Directory) addEntry(name string, attr DirectoryAttr) (*DirectoryEntry,
 		return nil, err
 	}
 
-	// Write the entries out in this directory
-	if lfnEntries != nil {
-		d.dirCluster.entries = append(d.dirCluster.entries, lfnEntries...)
-	}
-	d.dirCluster.entries = append(d.dirCluster.entries, shortEntry)
-
-	if err := d.dirCluster.WriteToDevice(d.device, d.fat); err != nil {
+	if err := d.appendEntries(lfnEntries, shortEntry); err != nil {
+		// Free the cluster again so it isn't left behind as a lost chain.
+		// The original error is what matters to the caller.
+		d.fat.FreeChain(startCluster)
+		d.fat.WriteToDevice(d.device)
 		return nil, err
 	}
 
@@ -273,7 +411,82 @@ func (d *Directory) addEntry(name string, attr DirectoryAttr) (*DirectoryEntry,
 		dir:        d,
 		lfnEntries: lfnEntries,
 		entry:      shortEntry,
+		name:       name,
 	}
 
 	return newEntry, nil
 }
+
+// newEntryNames verifies that the name is available in this directory and
+// returns a short entry with only its name filled in, along with the long
+// entries that are needed to store the name. The ignore entry, if given,
+// is allowed to already have the name, which is used for renames.
+func (d *Directory) newEntryNames(name string, ignore *DirectoryEntry) (*DirectoryClusterEntry, []*DirectoryClusterEntry, error) {
+	entries := d.entries()
+	usedNames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		dirEntry := entry.(*DirectoryEntry)
+		if ignore != nil && dirEntry.entry == ignore.entry {
+			continue
+		}
+
+		if strings.ToUpper(entry.Name()) == strings.ToUpper(name) {
+			return nil, nil, fmt.Errorf("name already exists: %s", name)
+		}
+
+		// Add it to the list of used names
+		usedNames = append(usedNames, dirEntry.ShortName())
+	}
+
+	shortName, err := generateShortName(name, usedNames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A long name is needed whenever the short name can't represent the
+	// name exactly, including its case.
+	var lfnEntries []*DirectoryClusterEntry
+	if shortName != name {
+		lfnEntries, err = NewLongDirectoryClusterEntry(name, shortName)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	shortParts := strings.Split(shortName, ".")
+	if len(shortParts) == 1 {
+		shortParts = append(shortParts, "")
+	}
+
+	shortEntry := &DirectoryClusterEntry{
+		name: shortParts[0],
+		ext:  shortParts[1],
+	}
+
+	return shortEntry, lfnEntries, nil
+}
+
+// appendEntries adds the long entries and the short entry to this
+// directory and writes it out. The entries reuse the first run of deleted
+// entries that is large enough to hold them.
+func (d *Directory) appendEntries(lfnEntries []*DirectoryClusterEntry, shortEntry *DirectoryClusterEntry) error {
+	entries := make([]*DirectoryClusterEntry, 0, len(lfnEntries)+1)
+	entries = append(entries, lfnEntries...)
+	entries = append(entries, shortEntry)
+
+	idx, err := d.dirCluster.freeSlots(len(entries))
+	if err != nil {
+		return err
+	}
+
+	// If the directory can't be written, such as when it can't grow, it
+	// must not list the entries that never made it to the device.
+	saved := append([]*DirectoryClusterEntry(nil), d.dirCluster.entries...)
+	d.dirCluster.putEntries(idx, entries)
+	if err := d.dirCluster.WriteToDevice(d.device, d.fat); err != nil {
+		d.dirCluster.entries = saved
+		return err
+	}
+
+	return nil
+}
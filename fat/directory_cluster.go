@@ -1,11 +1,9 @@
 package fat
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
 	"strings"
 	"time"
 	"unicode/utf16"
@@ -31,12 +29,25 @@ const DirectoryEntrySize = 32
 // Mask applied to the ord of the last long entry.
 const LastLongEntryMask = 0x40
 
+// The maximum number of entries in a directory, including the "." and
+// ".." entries and long name entries. This limits a directory to 2MB.
+const MaxDirectoryEntries = 65536
+
+// ErrDirectoryFull is returned when a directory has no room for new
+// entries. This happens mostly with the fixed size root directory of
+// FAT12/FAT16 filesystems.
+var ErrDirectoryFull = errors.New("directory full")
+
 // DirectoryCluster represents a cluster on the disk that contains
 // entries/contents.
 type DirectoryCluster struct {
 	entries      []*DirectoryClusterEntry
 	fat16Root    bool
+	root         bool
 	startCluster uint32
+
+	// The number of entries that fit in a FAT12/FAT16 root directory.
+	maxEntries int
 }
 
 // DirectoryClusterEntry is a single 32-byte entry that is part of the
@@ -52,18 +63,36 @@ type DirectoryClusterEntry struct {
 	fileSize   uint32
 	deleted    bool
 
+	// The NT reserved byte, which Windows uses to record that the
+	// name and/or extension of a short name are lower case.
+	caseFlags uint8
+
 	longOrd      uint8
-	longName     string
+	longName     []uint16
 	longChecksum uint8
+
+	// parent is the directory that holds the entry. Open files write
+	// their entry through it, so they keep working after a rename moved
+	// the entry to another directory.
+	parent *DirectoryCluster
 }
 
+// Flags in DIR_NTRes that mark parts of a short name as lower case.
+const (
+	caseLowerName = 0x08
+	caseLowerExt  = 0x10
+)
+
+// The maximum length of a long name in UTF-16 code units.
+const MaxLongNameLength = 255
+
 func DecodeDirectoryCluster(startCluster uint32, device fs.BlockDevice, fat *FAT) (*DirectoryCluster, error) {
 	bs := fat.bs
 	chain := fat.Chain(startCluster)
 	data := make([]byte, uint32(len(chain))*bs.BytesPerCluster())
 	for i, clusterNumber := range chain {
 		dataOffset := uint32(i) * bs.BytesPerCluster()
-		devOffset := int64(bs.ClusterOffset(int(clusterNumber)))
+		devOffset := bs.ClusterOffset(int(clusterNumber))
 		chainData := data[dataOffset : dataOffset+bs.BytesPerCluster()]
 
 		if _, err := device.ReadAt(chainData, devOffset); err != nil {
@@ -94,12 +123,14 @@ func DecodeFAT16RootDirectoryCluster(device fs.BlockDevice, bs *BootSectorCommon
 	}
 
 	result.fat16Root = true
+	result.root = true
+	result.maxEntries = int(bs.RootEntryCount)
 	return result, nil
 }
 
 func decodeDirectoryCluster(data []byte, bs *BootSectorCommon) (*DirectoryCluster, error) {
-	entries := make([]*DirectoryClusterEntry, 0, bs.RootEntryCount)
-	for i := uint16(0); i < uint16(len(data)/DirectoryEntrySize); i++ {
+	entries := make([]*DirectoryClusterEntry, 0, len(data)/DirectoryEntrySize)
+	for i := 0; i < len(data)/DirectoryEntrySize; i++ {
 		offset := i * DirectoryEntrySize
 		entryData := data[offset : offset+DirectoryEntrySize]
 		if entryData[0] == 0 {
@@ -118,6 +149,10 @@ func decodeDirectoryCluster(data []byte, bs *BootSectorCommon) (*DirectoryCluste
 		entries: entries,
 	}
 
+	for _, entry := range entries {
+		entry.parent = result
+	}
+
 	return result, nil
 }
 
@@ -156,7 +191,10 @@ func NewFat16RootDirectoryCluster(bs *BootSectorCommon, label string) (*Director
 	}
 
 	result := &DirectoryCluster{
-		entries: make([]*DirectoryClusterEntry, 1, bs.RootEntryCount),
+		entries:    make([]*DirectoryClusterEntry, 1, bs.RootEntryCount),
+		fat16Root:  true,
+		root:       true,
+		maxEntries: int(bs.RootEntryCount),
 	}
 
 	// Create the volume ID entry
@@ -169,9 +207,99 @@ func NewFat16RootDirectoryCluster(bs *BootSectorCommon, label string) (*Director
 	return result, nil
 }
 
-// Bytes returns the on-disk byte data for this directory structure.
+// NewFat32RootDirectoryCluster creates a new DirectoryCluster that is
+// meant only to be the root directory of a FAT32 filesystem.
+func NewFat32RootDirectoryCluster(start uint32, label string) (*DirectoryCluster, error) {
+	if start < FirstCluster {
+		return nil, fmt.Errorf("invalid root directory cluster: %d", start)
+	}
+
+	result := &DirectoryCluster{
+		root:         true,
+		startCluster: start,
+	}
+
+	// Create the volume ID entry
+	result.entries = []*DirectoryClusterEntry{
+		{
+			attr:    AttrVolumeId,
+			name:    label,
+			cluster: 0,
+		},
+	}
+
+	return result, nil
+}
+
+// dotDotCluster returns the cluster that the ".." entries of the
+// subdirectories of this directory point to. A ".." entry that points to
+// the root directory always uses cluster 0, even on FAT32.
+func (d *DirectoryCluster) dotDotCluster() uint32 {
+	if d.root {
+		return 0
+	}
+
+	return d.startCluster
+}
+
+// freeSlots returns the index of the first run of n free entries. The run
+// is made of deleted entries and may extend past the last entry, into the
+// unused space at the end of the directory.
+func (d *DirectoryCluster) freeSlots(n int) (int, error) {
+	idx := len(d.entries)
+	for i := len(d.entries) - 1; i >= 0 && d.entries[i].deleted; i-- {
+		idx = i
+	}
+
+	run := 0
+	for i, entry := range d.entries {
+		if !entry.deleted {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == n {
+			idx = i - n + 1
+			break
+		}
+	}
+
+	max := MaxDirectoryEntries
+	if d.fat16Root {
+		max = d.maxEntries
+	}
+
+	if idx+n > max {
+		return 0, ErrDirectoryFull
+	}
+
+	return idx, nil
+}
+
+// putEntries stores the given entries in the directory starting at the
+// given index, overwriting the free entries that are there and growing
+// the directory if necessary.
+func (d *DirectoryCluster) putEntries(idx int, entries []*DirectoryClusterEntry) {
+	for i, entry := range entries {
+		entry.parent = d
+		if idx+i < len(d.entries) {
+			d.entries[idx+i] = entry
+		} else {
+			d.entries = append(d.entries, entry)
+		}
+	}
+}
+
+// Bytes returns the on-disk byte data for this directory structure. The
+// FAT12/FAT16 root directory is always returned at its full size.
 func (d *DirectoryCluster) Bytes() []byte {
-	result := make([]byte, cap(d.entries)*DirectoryEntrySize)
+	size := len(d.entries)
+	if d.fat16Root {
+		size = d.maxEntries
+	}
+
+	result := make([]byte, size*DirectoryEntrySize)
 
 	for i, entry := range d.entries {
 		offset := i * DirectoryEntrySize
@@ -197,7 +325,15 @@ func (d *DirectoryCluster) WriteToDevice(device fs.BlockDevice, fat *FAT) error
 			startCluster: d.startCluster,
 		}
 
-		if _, err := chain.Write(d.Bytes()); err != nil {
+		// Pad the data to a whole number of clusters so that a newly
+		// allocated cluster never contains stale entries.
+		data := d.Bytes()
+		bpc := int(fat.bs.BytesPerCluster())
+		if len(data)%bpc != 0 {
+			data = append(data, make([]byte, bpc-len(data)%bpc)...)
+		}
+
+		if _, err := chain.Write(data); err != nil {
 			return err
 		}
 	}
@@ -209,15 +345,16 @@ func (d *DirectoryCluster) WriteToDevice(device fs.BlockDevice, fat *FAT) error
 func (d *DirectoryClusterEntry) Bytes() []byte {
 	var result [DirectoryEntrySize]byte
 
-	if d.longName != "" {
-		runes := bytes.Runes([]byte(d.longName))
+	if d.IsLong() {
+		chars := make([]uint16, 13)
+		n := copy(chars, d.longName)
 
-		// The name must be zero-terminated then padded with 0xFF
+		// The name must be zero-terminated then padded with 0xFFFF
 		// up to 13 characters
-		if len(runes) < 13 {
-			runes = append(runes, 0)
-			for len(runes) < 13 {
-				runes = append(runes, 0xFFFF)
+		if n < 13 {
+			chars[n] = 0
+			for i := n + 1; i < 13; i++ {
+				chars[i] = 0xFFFF
 			}
 		}
 
@@ -225,10 +362,10 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		result[0] = d.longOrd
 
 		// LDIR_Name1
-		for i := 0; i < int(math.Min(float64(len(runes)), 5)); i++ {
+		for i := 0; i < 5; i++ {
 			offset := 1 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i]))
+			binary.LittleEndian.PutUint16(data, chars[i])
 		}
 
 		// LDIR_Attr
@@ -244,7 +381,7 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		for i := 0; i < 6; i++ {
 			offset := 14 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i+5]))
+			binary.LittleEndian.PutUint16(data, chars[i+5])
 		}
 
 		// LDIR_FstClusLO
@@ -255,21 +392,18 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		for i := 0; i < 2; i++ {
 			offset := 28 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i+11]))
+			binary.LittleEndian.PutUint16(data, chars[i+11])
 		}
 	} else {
 		// DIR_Name
-		var simpleName string
-		if d.name == "." || d.name == ".." {
-			simpleName = d.name
-		} else {
-			simpleName = fmt.Sprintf("%s.%s", d.name, d.ext)
-		}
-		copy(result[0:11], shortNameEntryValue(simpleName))
+		copy(result[0:11], d.shortNameValue())
 
 		// DIR_Attr
 		result[11] = byte(d.attr)
 
+		// DIR_NTRes
+		result[12] = d.caseFlags
+
 		// DIR_CrtTime
 		crtDate, crtTime, crtTenths := encodeDOSTime(d.createTime)
 		result[13] = crtTenths
@@ -295,9 +429,23 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		binary.LittleEndian.PutUint32(result[28:32], d.fileSize)
 	}
 
+	// Deleted entries of both kinds are marked by their first byte
+	if d.deleted {
+		result[0] = 0xE5
+	}
+
 	return result[:]
 }
 
+// shortNameValue returns the raw 11 byte short name of this entry.
+func (d *DirectoryClusterEntry) shortNameValue() string {
+	if d.name == "." || d.name == ".." {
+		return shortNameEntryValue(d.name)
+	}
+
+	return shortNameEntryValue(fmt.Sprintf("%s.%s", d.name, d.ext))
+}
+
 // IsLong returns true if this is a long entry.
 func (d *DirectoryClusterEntry) IsLong() bool {
 	return (d.attr & AttrLongName) == AttrLongName
@@ -315,6 +463,7 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 	// Do the attributes so we can determine if we're dealing with long names
 	result.attr = DirectoryAttr(data[11])
 	if (result.attr & AttrLongName) == AttrLongName {
+		result.deleted = data[0] == 0xE5
 		result.longOrd = data[0]
 
 		chars := make([]uint16, 13)
@@ -333,7 +482,7 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 			chars[i+11] = binary.LittleEndian.Uint16(data[offset : offset+2])
 		}
 
-		result.longName = string(utf16.Decode(chars))
+		result.longName = chars
 		result.longChecksum = data[13]
 	} else {
 		result.deleted = data[0] == 0xE5
@@ -345,6 +494,7 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 
 		result.name = strings.TrimRight(string(data[0:8]), " ")
 		result.ext = strings.TrimRight(string(data[8:11]), " ")
+		result.caseFlags = data[12] & (caseLowerName | caseLowerExt)
 
 		// Creation time
 		createTimeTenths := data[13]
@@ -363,7 +513,7 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 
 		// Cluster
 		result.cluster = uint32(binary.LittleEndian.Uint16(data[20:22]))
-		result.cluster <<= 4
+		result.cluster <<= 16
 		result.cluster |= uint32(binary.LittleEndian.Uint16(data[26:28]))
 
 		// File size
@@ -380,10 +530,15 @@ func NewLongDirectoryClusterEntry(name string, shortName string) ([]*DirectoryCl
 	// Split up the shortName properly
 	checksum := checksumShortName(shortNameEntryValue(shortName))
 
-	// Calcualte the number of entries we'll actually need to store
+	chars := utf16.Encode([]rune(name))
+	if len(chars) > MaxLongNameLength {
+		return nil, fmt.Errorf("name longer than %d UTF-16 characters: %s", MaxLongNameLength, name)
+	}
+
+	// Calculate the number of entries we'll actually need to store
 	// the long name.
-	numLongEntries := len(name) / 13
-	if len(name)%13 != 0 {
+	numLongEntries := len(chars) / 13
+	if len(chars)%13 != 0 {
 		numLongEntries++
 	}
 
@@ -401,17 +556,56 @@ func NewLongDirectoryClusterEntry(name string, shortName string) ([]*DirectoryCl
 		// Calculate the offsets of the string for this entry
 		j := (numLongEntries - i - 1) * 13
 		k := j + 13
-		if k > len(name) {
-			k = len(name)
+		if k > len(chars) {
+			k = len(chars)
 		}
 
 		entry.longChecksum = checksum
-		entry.longName = name[j:k]
+		entry.longName = chars[j:k]
 	}
 
 	return entries, nil
 }
 
+// decodeLongName returns the long name stored in the given long entries,
+// which are in on-disk order, as long as they belong to the short entry.
+// An empty string is returned if the long entries are orphaned.
+func decodeLongName(lfnEntries []*DirectoryClusterEntry, entry *DirectoryClusterEntry) string {
+	if lfnEntries[0].longOrd&LastLongEntryMask == 0 {
+		return ""
+	}
+
+	checksum := checksumShortName(entry.shortNameValue())
+	chars := make([]uint16, 0, 13*len(lfnEntries))
+	for i := len(lfnEntries) - 1; i >= 0; i-- {
+		lfn := lfnEntries[i]
+		if int(lfn.longOrd&^LastLongEntryMask) != len(lfnEntries)-i {
+			return ""
+		}
+
+		if lfn.longChecksum != checksum {
+			return ""
+		}
+
+		chars = append(chars, lfn.longName...)
+	}
+
+	// The name is zero-terminated and padded with 0xFFFF, unless it
+	// fills the last entry exactly.
+	for i, c := range chars {
+		if c == 0 {
+			chars = chars[:i]
+			break
+		}
+	}
+
+	for len(chars) > 0 && chars[len(chars)-1] == 0xFFFF {
+		chars = chars[:len(chars)-1]
+	}
+
+	return string(utf16.Decode(chars))
+}
+
 func decodeDOSTime(date, dosTime uint16, tenths uint8) time.Time {
 	return time.Date(
 		1980+int(date>>9),
@@ -0,0 +1,138 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDirectoryClusterEntry_highCluster(t *testing.T) {
+	entry := &DirectoryClusterEntry{
+		name:    "FOO",
+		ext:     "BAR",
+		cluster: 0x00123456,
+	}
+
+	result, err := DecodeDirectoryClusterEntry(entry.Bytes())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if result.cluster != 0x00123456 {
+		t.Fatalf("bad cluster: %#x", result.cluster)
+	}
+}
+
+func TestNewLongDirectoryClusterEntry_unicode(t *testing.T) {
+	names := []string{
+		"a file with a long name.txt",
+		"日本語のファイル名.txt",
+		"emoji 🎉🎉🎉🎉🎉🎉🎉.txt",
+		strings.Repeat("x", 12) + "🎉",
+	}
+
+	for _, name := range names {
+		shortName, err := generateShortName(name, []string{})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		lfnEntries, err := NewLongDirectoryClusterEntry(name, shortName)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		entries := make([]*DirectoryClusterEntry, 0, len(lfnEntries)+1)
+		for _, lfn := range lfnEntries {
+			decoded, err := DecodeDirectoryClusterEntry(lfn.Bytes())
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			entries = append(entries, decoded)
+		}
+
+		shortParts := strings.Split(shortName, ".")
+		short := &DirectoryClusterEntry{name: shortParts[0], ext: shortParts[1]}
+		entries = append(entries, short)
+
+		entry, _, err := DecodeDirectoryEntry(nil, entries)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if entry.Name() != name {
+			t.Fatalf("expected %q, got %q", name, entry.Name())
+		}
+	}
+}
+
+func TestNewLongDirectoryClusterEntry_tooLong(t *testing.T) {
+	name := strings.Repeat("🎉", 128)
+	if _, err := NewLongDirectoryClusterEntry(name, "FOO~1"); err == nil {
+		t.Fatal("should error")
+	}
+
+	name = strings.Repeat("a", 255)
+	if _, err := NewLongDirectoryClusterEntry(name, "FOO~1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestDecodeDirectoryEntry_windows(t *testing.T) {
+	// A long name as written by Windows for "Readme.md", followed by
+	// its short entry "README.MD".
+	short := &DirectoryClusterEntry{name: "README", ext: "MD"}
+	checksum := checksumShortName(short.shortNameValue())
+
+	var data [DirectoryEntrySize]byte
+	data[0] = 0x41
+	data[11] = byte(AttrLongName)
+	data[13] = checksum
+	chars := []uint16{'R', 'e', 'a', 'd', 'm', 'e', '.', 'm', 'd', 0, 0xFFFF, 0xFFFF, 0xFFFF}
+	offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint16(data[offset:offset+2], chars[i])
+	}
+
+	lfn, err := DecodeDirectoryClusterEntry(data[:])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, _, err := DecodeDirectoryEntry(nil, []*DirectoryClusterEntry{lfn, short})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if entry.Name() != "Readme.md" {
+		t.Fatalf("bad name: %q", entry.Name())
+	}
+
+	// With a bad checksum the long name is an orphan and ignored
+	data[13]++
+	lfn, err = DecodeDirectoryClusterEntry(data[:])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, _, err = DecodeDirectoryEntry(nil, []*DirectoryClusterEntry{lfn, short})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if entry.Name() != "README.MD" {
+		t.Fatalf("bad name: %q", entry.Name())
+	}
+
+	// Lower case short names are recorded in the NT reserved byte
+	short.caseFlags = caseLowerName | caseLowerExt
+	entry, _, err = DecodeDirectoryEntry(nil, []*DirectoryClusterEntry{short})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if entry.Name() != "readme.md" {
+		t.Fatalf("bad name: %q", entry.Name())
+	}
+}
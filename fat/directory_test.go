@@ -0,0 +1,218 @@
+package fat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDirectory_reuseDeletedEntries(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := rootDir.(*Directory)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("a long file name %d.txt", i)
+		if _, err := rootDir.AddFile(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := rootDir.Remove(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The volume ID plus a single long and short entry group
+	if len(dir.dirCluster.entries) != 4 {
+		t.Fatalf("bad entry count: %d", len(dir.dirCluster.entries))
+	}
+
+	// A short name fits in the slots freed by a long name
+	if _, err := rootDir.AddFile("a long file name.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rootDir.Remove("a long file name.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("SHORT"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(dir.dirCluster.entries) != 4 {
+		t.Fatalf("bad entry count: %d", len(dir.dirCluster.entries))
+	}
+
+	if dir.Entry("SHORT") == nil {
+		t.Fatal("should have entry")
+	}
+}
+
+func TestDirectory_fat16RootFull(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT12, 1440*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The volume ID uses the first of the 224 entries
+	for i := 0; i < 223; i++ {
+		if _, err := rootDir.AddFile(fmt.Sprintf("FILE%d", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	free := 0
+	for _, entry := range filesys.fat.entries {
+		if entry == 0 {
+			free++
+		}
+	}
+
+	if _, err := rootDir.AddFile("ONEMORE"); err != ErrDirectoryFull {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if _, err := rootDir.AddDirectory("ONEDIR"); err != ErrDirectoryFull {
+		t.Fatalf("bad: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("a long file name.txt"); err != ErrDirectoryFull {
+		t.Fatalf("bad: %s", err)
+	}
+
+	for _, entry := range filesys.fat.entries {
+		if entry == 0 {
+			free--
+		}
+	}
+
+	if free != 0 {
+		t.Fatalf("clusters leaked: %d", -free)
+	}
+
+	// The data area right after the root directory must be untouched
+	data := make([]byte, DirectoryEntrySize)
+	offset := int64(filesys.bs.RootDirOffset()) + 224*DirectoryEntrySize
+	if _, err := device.ReadAt(data, offset); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, b := range data {
+		if b != 0 {
+			t.Fatal("root directory overflowed")
+		}
+	}
+}
+
+func TestDirectory_growFATFull(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT12, 1440*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddDirectory("sub")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Fill the one cluster of the directory, after "." and ".."
+	perCluster := int(filesys.bs.BytesPerCluster()) / DirectoryEntrySize
+	for i := 0; i < perCluster-2; i++ {
+		if _, err := subDir.AddFile(fmt.Sprintf("FILE%d", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Leave a single free cluster, which the new file takes, so the
+	// directory can't grow
+	free := 0
+	for cluster := uint32(FirstCluster); cluster <= filesys.fat.MaxCluster(); cluster++ {
+		if filesys.fat.IsFree(cluster) {
+			free++
+		}
+	}
+
+	if _, err := filesys.fat.AllocChain(free - 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := subDir.AddFile("ONEMORE"); err != ErrFATFull {
+		t.Fatalf("bad: %v", err)
+	}
+
+	free = 0
+	for cluster := uint32(FirstCluster); cluster <= filesys.fat.MaxCluster(); cluster++ {
+		if filesys.fat.IsFree(cluster) {
+			free++
+		}
+	}
+
+	if free != 1 {
+		t.Fatalf("clusters leaked: %d free", free)
+	}
+
+	if subDir.Entry("ONEMORE") != nil {
+		t.Fatal("entry should not be listed")
+	}
+}
+
+func TestDirectory_growSubdirectory(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddDirectory("sub")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bpc := int(filesys.bs.BytesPerCluster())
+	count := bpc/DirectoryEntrySize + 10
+	for i := 0; i < count; i++ {
+		if _, err := subDir.AddFile(fmt.Sprintf("FILE%d", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	cluster := entry.(*DirectoryEntry).entry.cluster
+	if len(filesys.fat.Chain(cluster)) != 2 {
+		t.Fatalf("bad chain: %#v", filesys.fat.Chain(cluster))
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err = rootDir.Entry("sub").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Plus the "." and ".." entries
+	if len(subDir.Entries()) != count+2 {
+		t.Fatalf("bad entry count: %d", len(subDir.Entries()))
+	}
+}
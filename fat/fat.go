@@ -3,7 +3,6 @@ package fat
 import (
 	"errors"
 	"fmt"
-	"math"
 
 	"github.com/mitchellh/go-fs"
 )
@@ -13,13 +12,39 @@ const FirstCluster = 2
 
 // FAT is the actual file allocation table data structure that is
 // stored on disk to describe the various clusters on the disk.
+//
+// Entries are changed in memory and only written out by WriteToDevice,
+// which writes just the sectors that changed since the last write. Many
+// allocations can therefore be batched into a single write.
 type FAT struct {
 	bs      *BootSectorCommon
 	entries []uint32
+
+	// data is the encoded table, kept in step with entries by setEntry,
+	// and dirty marks the sectors of data that changed since the last
+	// write.
+	data  []byte
+	dirty []bool
+
+	// fsInfo is the FAT32 FSInfo structure that is kept up to date as
+	// clusters are allocated and freed. This is nil if the filesystem
+	// has none.
+	fsInfo       *FSInfo
+	fsInfoSector uint16
+	fsInfoDirty  bool
+
+	// If mirroringDisabled is true, only the FAT at index activeFAT is
+	// written. Otherwise, every FAT is kept identical.
+	activeFAT         int
+	mirroringDisabled bool
+
+	// allocator chooses the clusters to allocate. If it is nil, a
+	// NextFitAllocator is used.
+	allocator Allocator
 }
 
 func DecodeFAT(device fs.BlockDevice, bs *BootSectorCommon, n int) (*FAT, error) {
-	if n > int(bs.NumFATs) {
+	if n >= int(bs.NumFATs) {
 		return nil, fmt.Errorf("FAT #%d greater than total FATs: %d", n, bs.NumFATs)
 	}
 
@@ -31,6 +56,8 @@ func DecodeFAT(device fs.BlockDevice, bs *BootSectorCommon, n int) (*FAT, error)
 	result := &FAT{
 		bs:      bs,
 		entries: make([]uint32, FATEntryCount(bs)),
+		data:    data,
+		dirty:   make([]bool, bs.SectorsPerFat),
 	}
 
 	fatType := bs.FATType()
@@ -42,7 +69,8 @@ func DecodeFAT(device fs.BlockDevice, bs *BootSectorCommon, n int) (*FAT, error)
 		case FAT16:
 			entryData = fatReadEntry16(data, i)
 		default:
-			entryData = fatReadEntry32(data, i)
+			// The high 4 bits of a FAT32 entry are reserved
+			entryData = fatReadEntry32(data, i) & 0x0FFFFFFF
 		}
 
 		result.entries[i] = entryData
@@ -56,12 +84,17 @@ func NewFAT(bs *BootSectorCommon) (*FAT, error) {
 	result := &FAT{
 		bs:      bs,
 		entries: make([]uint32, FATEntryCount(bs)),
+		data:    make([]byte, bs.SectorsPerFat*uint32(bs.BytesPerSector)),
+		dirty:   make([]bool, bs.SectorsPerFat),
 	}
 
 	// Set the initial two entries according to spec
-	result.entries[0] = (uint32(bs.Media) & 0xFF) |
-		(0xFFFFFF00 & result.entryMask())
-	result.entries[1] = 0xFFFFFFFF & result.entryMask()
+	result.setEntry(0, (uint32(bs.Media)&0xFF)|(0xFFFFFF00&result.entryMask()))
+	result.setEntry(1, 0xFFFFFFFF&result.entryMask())
+
+	// Whatever is on the device isn't a valid FAT, so all of it has to
+	// be written.
+	result.markAllDirty()
 
 	return result, nil
 }
@@ -69,55 +102,66 @@ func NewFAT(bs *BootSectorCommon) (*FAT, error) {
 // Bytes returns the raw bytes for the FAT that should be written to
 // the block device.
 func (f *FAT) Bytes() []byte {
-	result := make([]byte, f.bs.SectorsPerFat*uint32(f.bs.BytesPerSector))
-
-	for i, entry := range f.entries {
-		switch f.bs.FATType() {
-		case FAT12:
-			f.writeEntry12(result, i, entry)
-		case FAT16:
-			f.writeEntry16(result, i, entry)
-		default:
-			f.writeEntry32(result, i, entry)
-		}
-	}
-
+	result := make([]byte, len(f.data))
+	copy(result, f.data)
 	return result
 }
 
-func (f *FAT) AllocChain() (uint32, error) {
-	return f.allocNew()
-}
+// setEntry sets the entry for the given cluster and marks the sectors
+// that hold it as dirty.
+func (f *FAT) setEntry(cluster uint32, value uint32) {
+	f.entries[cluster] = value
 
-func (f *FAT) allocNew() (uint32, error) {
-	dataSize := (f.bs.TotalSectors * uint32(f.bs.BytesPerSector))
-	dataSize -= f.bs.DataOffset()
-	clusterCount := dataSize / f.bs.BytesPerCluster()
-	lastClusterIndex := clusterCount + FirstCluster
-
-	var availIdx uint32
-	found := false
-	for i := uint32(FirstCluster); i < lastClusterIndex; i++ {
-		if f.entries[i] == 0 {
-			availIdx = i
-			found = true
-			break
-		}
+	var offset, size int
+	switch f.bs.FATType() {
+	case FAT12:
+		offset, size = int(cluster)+int(cluster/2), 2
+		f.writeEntry12(f.data, int(cluster), value)
+	case FAT16:
+		offset, size = int(cluster)*2, 2
+		f.writeEntry16(f.data, int(cluster), value)
+	default:
+		// Keep the reserved high 4 bits as they were
+		offset, size = int(cluster)*4, 4
+		value |= fatReadEntry32(f.data, int(cluster)) & 0xF0000000
+		f.writeEntry32(f.data, int(cluster), value)
 	}
 
-	if !found {
-		return 0, errors.New("FAT FULL")
+	// A FAT12 entry can straddle two sectors
+	bps := int(f.bs.BytesPerSector)
+	for sector := offset / bps; sector <= (offset+size-1)/bps; sector++ {
+		f.dirty[sector] = true
 	}
+}
+
+// markAllDirty marks every sector of the FAT as dirty, so that the next
+// write copies the whole table to every FAT.
+func (f *FAT) markAllDirty() {
+	for i := range f.dirty {
+		f.dirty[i] = true
+	}
+
+	f.fsInfoDirty = f.fsInfo != nil
+}
 
-	// Mark that this is now in use
-	f.entries[availIdx] = 0xFFFFFFFF & f.entryMask()
+// AllocChain allocates a new chain of the given number of clusters and
+// returns its first cluster.
+func (f *FAT) AllocChain(length int) (uint32, error) {
+	clusters, err := f.alloc(length, 0)
+	if err != nil {
+		return 0, err
+	}
 
-	return availIdx, nil
+	return clusters[0], nil
 }
 
-// Chain returns the chain of clusters starting at a certain cluster.
+// Chain returns the chain of clusters starting at a certain cluster. An
+// empty file has a start cluster of 0, which is an empty chain.
 func (f *FAT) Chain(start uint32) []uint32 {
 	chain := make([]uint32, 0, 2)
+	if start < FirstCluster {
+		return chain
+	}
 
 	cluster := start
 	for {
@@ -132,50 +176,96 @@ func (f *FAT) Chain(start uint32) []uint32 {
 	return chain
 }
 
+// FreeChain marks every cluster in the chain starting at the given
+// cluster as free.
+func (f *FAT) FreeChain(start uint32) {
+	if start < FirstCluster {
+		return
+	}
+
+	chain := f.Chain(start)
+	for _, cluster := range chain {
+		f.setEntry(cluster, 0)
+	}
+
+	if f.fsInfo != nil {
+		f.fsInfo.freed(uint32(len(chain)))
+		f.fsInfoDirty = true
+	}
+}
+
 // ResizeChain takes a given cluster number and resizes the chain
-// to the given length. It returns the new chain of clusters.
+// to the given length. It returns the new chain of clusters. Resizing
+// the empty chain of start cluster 0 allocates a new chain, whose first
+// cluster the caller must store.
 func (f *FAT) ResizeChain(start uint32, length int) ([]uint32, error) {
 	chain := f.Chain(start)
 	if len(chain) == length {
 		return chain, nil
 	}
 
-	change := int(math.Abs(float64(length - len(chain))))
-	if length > len(chain) {
-		var lastCluster uint32
-
-		lastCluster = chain[0]
-		for i := 1; i < len(chain); i++ {
-			if f.isEofCluster(f.entries[lastCluster]) {
-				break
-			}
-
-			lastCluster = chain[i]
-		}
+	if length < 1 {
+		return nil, errors.New("chain must have at least one cluster")
+	}
 
-		for i := 0; i < change; i++ {
-			newCluster, err := f.allocNew()
-			if err != nil {
-				return nil, err
-			}
+	if len(chain) == 0 {
+		return f.alloc(length, 0)
+	}
 
-			f.entries[lastCluster] = newCluster
-			lastCluster = newCluster
+	if length > len(chain) {
+		if _, err := f.alloc(length-len(chain), chain[len(chain)-1]); err != nil {
+			return nil, err
 		}
 	} else {
-		panic("making chains smaller not implemented yet")
+		// Cut the chain off and free everything after it
+		f.FreeChain(chain[length])
+		f.setEntry(chain[length-1], 0xFFFFFFFF&f.entryMask())
 	}
 
 	return f.Chain(start), nil
 }
 
+// WriteToDevice writes the sectors of the FAT that changed since the last
+// write to every FAT on the device, along with the FSInfo structure if it
+// changed. Each run of consecutive dirty sectors is written at once.
 func (f *FAT) WriteToDevice(device fs.BlockDevice) error {
-	fatBytes := f.Bytes()
+	bps := int(f.bs.BytesPerSector)
 	for i := 0; i < int(f.bs.NumFATs); i++ {
-		offset := int64(f.bs.FATOffset(i))
-		if _, err := device.WriteAt(fatBytes, offset); err != nil {
+		if f.mirroringDisabled && i != f.activeFAT {
+			continue
+		}
+
+		fatOffset := int64(f.bs.FATOffset(i))
+		for start := 0; start < len(f.dirty); start++ {
+			if !f.dirty[start] {
+				continue
+			}
+
+			end := start + 1
+			for end < len(f.dirty) && f.dirty[end] {
+				end++
+			}
+
+			data := f.data[start*bps : end*bps]
+			if _, err := device.WriteAt(data, fatOffset+int64(start*bps)); err != nil {
+				return err
+			}
+
+			start = end
+		}
+	}
+
+	for i := range f.dirty {
+		f.dirty[i] = false
+	}
+
+	if f.fsInfo != nil && f.fsInfoDirty {
+		offset := int64(f.fsInfoSector) * int64(f.bs.BytesPerSector)
+		if _, err := device.WriteAt(f.fsInfo.Bytes(), offset); err != nil {
 			return err
 		}
+
+		f.fsInfoDirty = false
 	}
 
 	return nil
@@ -196,18 +286,36 @@ func (f *FAT) isEofCluster(cluster uint32) bool {
 	return cluster >= (0xFFFFFF8 & f.entryMask())
 }
 
+// cleanShutdownMask returns the bit of the second FAT entry that is set
+// while the volume is unmounted cleanly. FAT12 has no such bit.
+func (f *FAT) cleanShutdownMask() uint32 {
+	switch f.bs.FATType() {
+	case FAT16:
+		return 0x8000
+	case FAT32:
+		return 0x08000000
+	default:
+		return 0
+	}
+}
+
+// badCluster returns the value that marks a cluster as bad.
+func (f *FAT) badCluster() uint32 {
+	return 0xFFFFFF7 & f.entryMask()
+}
+
 func (f *FAT) writeEntry12(data []byte, idx int, entry uint32) {
 	dataIdx := idx + (idx / 2)
 	data = data[dataIdx : dataIdx+2]
 
 	if idx%2 == 1 {
 		// ODD
-		data[0] |= byte((entry & 0x0F) << 4)
+		data[0] = (data[0] & 0x0F) | byte((entry&0x0F)<<4)
 		data[1] = byte((entry >> 4) & 0xFF)
 	} else {
 		// Even
 		data[0] = byte(entry & 0xFF)
-		data[1] = byte((entry >> 8) & 0x0F)
+		data[1] = (data[1] & 0xF0) | byte((entry>>8)&0x0F)
 	}
 }
 
@@ -245,9 +353,9 @@ func FATEntryCount(bs *BootSectorCommon) uint32 {
 }
 
 func fatReadEntry12(data []byte, idx int) uint32 {
-	idx += idx / 2
+	dataIdx := idx + (idx / 2)
 
-	var result uint32 = (uint32(data[idx+1]) << 8) | uint32(data[idx])
+	var result uint32 = (uint32(data[dataIdx+1]) << 8) | uint32(data[dataIdx])
 	if idx%2 == 0 {
 		return result & 0xFFF
 	} else {
@@ -0,0 +1,193 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestFAT_mirroringDisabled(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Disable mirroring and make the second FAT the active one
+	var extFlags [2]byte
+	binary.LittleEndian.PutUint16(extFlags[:], 0x81)
+	if _, err := device.WriteAt(extFlags[:], 40); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSectorFat32(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bs.MirroringDisabled || bs.ActiveFAT != 1 {
+		t.Fatalf("bad ExtFlags: %#v", bs)
+	}
+
+	fat0Before, err := DecodeFAT(device, &bs.BootSectorCommon, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if filesys.fat.activeFAT != 1 {
+		t.Fatalf("should read the active FAT: %d", filesys.fat.activeFAT)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("hello.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat0, err := DecodeFAT(device, &bs.BootSectorCommon, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat1, err := DecodeFAT(device, &bs.BootSectorCommon, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(fat0.Bytes(), fat0Before.Bytes()) {
+		t.Fatal("inactive FAT should not be written")
+	}
+
+	if bytes.Equal(fat0.Bytes(), fat1.Bytes()) {
+		t.Fatal("active FAT should be written")
+	}
+}
+
+func TestFAT_mirroringEnabled(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("hello.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat0, err := DecodeFAT(device, filesys.bs, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat1, err := DecodeFAT(device, filesys.bs, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(fat0.Bytes(), fat1.Bytes()) {
+		t.Fatal("FATs should be mirrored")
+	}
+}
+
+func TestFAT_WriteToDevice_dirtySectors(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT32, 64*1024*1024)
+	recorder := &writeRecordingDevice{BlockDevice: device}
+
+	// Allocate a run of clusters, which all fit in one FAT sector
+	start, err := filesys.fat.AllocChain(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := filesys.fat.ResizeChain(start, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := filesys.fat.WriteToDevice(recorder); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// One sector for each FAT, then the FSInfo sector
+	bps := int(filesys.bs.BytesPerSector)
+	if len(recorder.writes) != 3 {
+		t.Fatalf("bad writes: %v", recorder.writes)
+	}
+
+	for _, size := range recorder.writes {
+		if size != bps {
+			t.Fatalf("bad writes: %v", recorder.writes)
+		}
+	}
+
+	// Nothing changed, so nothing is written
+	recorder.writes = nil
+	if err := filesys.fat.WriteToDevice(recorder); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(recorder.writes) != 0 {
+		t.Fatalf("bad writes: %v", recorder.writes)
+	}
+
+	fat1, err := DecodeFAT(device, filesys.bs, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(filesys.fat.Bytes(), fat1.Bytes()) {
+		t.Fatal("FATs should be mirrored")
+	}
+}
+
+func TestFAT_setEntry_fat12Straddle(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT12, 1440*1024)
+
+	// Entry 341 starts at byte 511, the last byte of the first sector
+	filesys.fat.setEntry(341, 0xABC)
+	if !filesys.fat.dirty[0] || !filesys.fat.dirty[1] || filesys.fat.dirty[2] {
+		t.Fatalf("bad dirty sectors: %v", filesys.fat.dirty[:3])
+	}
+
+	if err := filesys.fat.WriteToDevice(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat, err := DecodeFAT(device, filesys.bs, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if fat.entries[340] != filesys.fat.entries[340] || fat.entries[341] != 0xABC || fat.entries[342] != 0 {
+		t.Fatalf("bad entries: %x", fat.entries[340:343])
+	}
+}
+
+// writeRecordingDevice records the size of every write to a device.
+type writeRecordingDevice struct {
+	fs.BlockDevice
+
+	writes []int
+}
+
+func (d *writeRecordingDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.writes = append(d.writes, len(p))
+	return d.BlockDevice.WriteAt(p, off)
+}
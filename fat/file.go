@@ -1,26 +1,249 @@
 package fat
 
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// File implements fs.File and is used to read and write the contents of
+// a file on a FAT filesystem. Reads never go past the size of the file.
 type File struct {
 	chain *ClusterChain
 	dir   *Directory
 	entry *DirectoryClusterEntry
+
+	// lock guards offset, and makes every Read, Write and Seek happen
+	// as a whole.
+	lock   sync.Mutex
+	offset int64
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
-	return f.chain.Read(p)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+// ReadAt reads from the file at the given offset. See io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.dir.filesys.lock.RLock()
+	defer f.dir.filesys.lock.RUnlock()
+
+	size := int64(f.entry.fileSize)
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > size-off {
+		p = p[:size-off]
+		err = io.EOF
+	}
+
+	n, rerr := f.chain.readAt(p, uint32(off))
+	if rerr != nil {
+		err = rerr
+	}
+
+	return
+}
+
+// Seek sets the offset for the next Read or Write. See io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.dir.filesys.lock.RLock()
+		offset += int64(f.entry.fileSize)
+		f.dir.filesys.lock.RUnlock()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.offset = offset
+	return offset, nil
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
-	lastByte := f.chain.writeOffset + uint32(len(p))
-	if lastByte > f.entry.fileSize {
-		// Increase the file size since we're writing past the end of the file
-		f.entry.fileSize = lastByte
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err = f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return
+}
+
+// WriteAt writes to the file at the given offset, growing the file if
+// necessary. See io.WriterAt.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	lastByte := off + int64(len(p))
+	if lastByte > 0xFFFFFFFF {
+		return 0, errors.New("file too large for FAT")
+	}
 
-		// Write the entry out
-		if err := f.dir.dirCluster.WriteToDevice(f.dir.device, f.dir.fat); err != nil {
+	f.dir.filesys.lock.Lock()
+	defer f.dir.filesys.lock.Unlock()
+
+	// Writing past the end of the file leaves a gap that must read as
+	// zeros, which is exactly what growing the file does.
+	if off > int64(f.entry.fileSize) {
+		if err := f.truncate(off); err != nil {
 			return 0, err
 		}
 	}
 
-	return f.chain.Write(p)
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// A file without clusters gets a new chain for the data first, as
+	// there is no chain yet that writeAt could grow.
+	if f.chain.startCluster == 0 {
+		bpc := int64(f.dir.fat.bs.BytesPerCluster())
+		start, err := f.dir.fat.AllocChain(int((lastByte + bpc - 1) / bpc))
+		if err != nil {
+			return 0, err
+		}
+
+		if err := f.dir.fat.WriteToDevice(f.dir.device); err != nil {
+			return 0, err
+		}
+
+		f.chain.startCluster = start
+		f.entry.cluster = start
+	}
+
+	n, err = f.chain.writeAt(p, uint32(off))
+	if err != nil {
+		return
+	}
+
+	if lastByte > int64(f.entry.fileSize) {
+		// Increase the file size since we wrote past the end of the file
+		f.entry.fileSize = uint32(lastByte)
+	}
+
+	// Every write changes the contents, so the write time is updated and
+	// the entry written out even if the size stays the same.
+	f.entry.writeTime = time.Now()
+	if err := f.writeEntry(); err != nil {
+		return 0, err
+	}
+
+	return
+}
+
+// Truncate changes the size of the file. If the file grows, the new
+// region reads as zeros. If it shrinks, the clusters that are no longer
+// needed are freed.
+func (f *File) Truncate(size int64) error {
+	if size < 0 || size > 0xFFFFFFFF {
+		return errors.New("invalid file size")
+	}
+
+	f.dir.filesys.lock.Lock()
+	defer f.dir.filesys.lock.Unlock()
+
+	return f.truncate(size)
+}
+
+// truncate changes the size of the file. The caller must hold the
+// filesystem lock for writing.
+func (f *File) truncate(size int64) error {
+	oldSize := int64(f.entry.fileSize)
+	bpc := int64(f.dir.fat.bs.BytesPerCluster())
+
+	clusters := (size + bpc - 1) / bpc
+	if f.chain.startCluster == 0 {
+		// An empty file may have no clusters at all, in which case it
+		// gets a new chain once it grows.
+		if clusters > 0 {
+			start, err := f.dir.fat.AllocChain(int(clusters))
+			if err != nil {
+				return err
+			}
+
+			f.chain.startCluster = start
+			f.entry.cluster = start
+			oldSize = 0
+		}
+	} else {
+		// A file always keeps at least its start cluster
+		if clusters < 1 {
+			clusters = 1
+		}
+
+		if _, err := f.dir.fat.ResizeChain(f.chain.startCluster, int(clusters)); err != nil {
+			return err
+		}
+	}
+
+	if err := f.dir.fat.WriteToDevice(f.dir.device); err != nil {
+		return err
+	}
+
+	// Zero out everything from the old end of the file when growing, or
+	// the slack in the last cluster when shrinking, so that no stale
+	// data ever becomes part of the file.
+	zeroStart := oldSize
+	zeroEnd := size
+	if size < oldSize {
+		zeroStart = size
+		zeroEnd = clusters * bpc
+	}
+
+	zeros := make([]byte, bpc)
+	for off := zeroStart; off < zeroEnd; {
+		n := bpc - off%bpc
+		if n > zeroEnd-off {
+			n = zeroEnd - off
+		}
+
+		if _, err := f.chain.writeAt(zeros[:n], uint32(off)); err != nil {
+			return err
+		}
+
+		off += n
+	}
+
+	f.entry.fileSize = uint32(size)
+	f.entry.writeTime = time.Now()
+	return f.writeEntry()
+}
+
+// writeEntry writes out the directory that holds the entry of the file,
+// which is no longer the one the file was opened from if the file was
+// moved by a rename. The caller must hold the filesystem lock.
+func (f *File) writeEntry() error {
+	dirCluster := f.entry.parent
+	if dirCluster == nil {
+		dirCluster = f.dir.dirCluster
+	}
+
+	return dirCluster.WriteToDevice(f.dir.device, f.dir.fat)
 }
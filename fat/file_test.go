@@ -0,0 +1,270 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestFile_implements(t *testing.T) {
+	var raw interface{}
+	raw = new(File)
+	if _, ok := raw.(fs.File); !ok {
+		t.Fatal("should be a fs.File")
+	}
+}
+
+func TestFile_ReadAtSeek(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("data.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := []byte("hello, world")
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Reads must stop at the file size, not the end of the cluster
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	result, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(result, data) {
+		t.Fatalf("bad: %q", result)
+	}
+
+	buf := make([]byte, 10)
+	n, err := file.ReadAt(buf, 7)
+	if err != io.EOF || n != 5 || string(buf[:n]) != "world" {
+		t.Fatalf("bad: %d %s %q", n, err, buf[:n])
+	}
+
+	section := io.NewSectionReader(file, 7, 3)
+	result, err = ioutil.ReadAll(section)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(result) != "wor" {
+		t.Fatalf("bad: %q", result)
+	}
+
+	pos, err := file.Seek(-5, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if pos != 7 {
+		t.Fatalf("bad: %d", pos)
+	}
+
+	if _, err := file.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestFile_WriteAt(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("data.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Write past the end of a cluster, the gap must be zeros
+	bpc := int64(filesys.bs.BytesPerCluster())
+	if _, err := file.WriteAt([]byte("end"), bpc+10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.WriteAt([]byte("start"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err = rootDir.Entry("data.bin").File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	result, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := make([]byte, bpc+13)
+	copy(expected, "start")
+	copy(expected[bpc+10:], "end")
+	if !bytes.Equal(result, expected) {
+		t.Fatalf("bad: %d bytes", len(result))
+	}
+}
+
+func TestFile_WriteAt_noClusters(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := rootDir.AddFile(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Other implementations give empty files no clusters at all
+	entry := rootDir.Entry("a.txt").(*DirectoryEntry)
+	filesys.fat.FreeChain(entry.entry.cluster)
+	entry.entry.cluster = 0
+	filesys.fat.WriteToDevice(device)
+	rootDir.(*Directory).dirCluster.WriteToDevice(device, filesys.fat)
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := rootDir.Entry("a.txt").File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// An empty write doesn't need any clusters
+	if _, err := file.Write(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if file.(*File).chain.startCluster != 0 {
+		t.Fatal("empty write should not allocate")
+	}
+
+	if _, err := file.Write([]byte("hello world")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err = rootDir.Entry("a.txt").File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	result, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(result) != "hello world" {
+		t.Fatalf("bad: %q", result)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
+
+func TestFile_WriteAt_modTime(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("data.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.WriteAt([]byte("hello world"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+	entry.(*DirectoryEntry).entry.writeTime = old
+	if err := rootDir.(*Directory).dirCluster.WriteToDevice(device, filesys.fat); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Overwriting keeps the size, but must still count as a write
+	if _, err := file.WriteAt([]byte("HELLO"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	modTime := rootDir.Entry("data.bin").(*DirectoryEntry).ModTime()
+	if !modTime.After(old) {
+		t.Fatalf("bad mod time: %s", modTime)
+	}
+}
@@ -1,16 +1,46 @@
 package fat
 
 import (
+	"sync"
+
 	"github.com/mitchellh/go-fs"
 )
 
 // FileSystem is the implementation of fs.FileSystem that can read a
 // FAT filesystem.
+//
+// A FileSystem and the directories, entries and files that come from it
+// are safe for concurrent use by multiple goroutines:
+//
+//   - Reads, such as listing directories, reading files and Stat, run in
+//     parallel with each other.
+//   - Changes, such as adding, removing and renaming entries and writing
+//     or truncating files, are serialized with each other and with reads,
+//     so every read sees a change either completely or not at all.
+//   - A File is locked for the length of every call, so a File that is
+//     shared by goroutines keeps a consistent offset and its Read, Write
+//     and Seek calls never interleave.
+//
+// Every Directory of the same directory shares the same entries, so a
+// change made through one is seen by all of them.
+//
+// The device itself must be safe for concurrent reads. Nothing else may
+// write to the device while it is mounted, including Check, Repair and
+// Defragment.
 type FileSystem struct {
 	bs      *BootSectorCommon
 	device  fs.BlockDevice
 	fat     *FAT
 	rootDir *DirectoryCluster
+
+	// lock is held for reading by everything that reads the filesystem
+	// and for writing by everything that changes it.
+	lock sync.RWMutex
+
+	// dirs are the directories that were opened, by start cluster. It
+	// is guarded by dirsLock, since it is filled in by readers as well.
+	dirs     map[uint32]*DirectoryCluster
+	dirsLock sync.Mutex
 }
 
 // New returns a new FileSystem for accessing a previously created
@@ -21,14 +51,44 @@ func New(device fs.BlockDevice) (*FileSystem, error) {
 		return nil, err
 	}
 
-	fat, err := DecodeFAT(device, bs, 0)
+	// FAT32 can disable FAT mirroring, in which case only the active
+	// FAT is valid.
+	var bs32 *BootSectorFat32
+	activeFAT := 0
+	if bs.FATType() == FAT32 {
+		bs32, err = DecodeBootSectorFat32(device)
+		if err != nil {
+			return nil, err
+		}
+
+		if bs32.MirroringDisabled {
+			activeFAT = int(bs32.ActiveFAT)
+		}
+	}
+
+	fat, err := DecodeFAT(device, bs, activeFAT)
 	if err != nil {
 		return nil, err
 	}
 
 	var rootDir *DirectoryCluster
-	if bs.FATType() == FAT32 {
-		panic("FAT32 not implemented yet")
+	if bs32 != nil {
+		fat.activeFAT = activeFAT
+		fat.mirroringDisabled = bs32.MirroringDisabled
+
+		// The FSInfo sector only holds hints, so if it is damaged we
+		// just go on without it.
+		if fsInfo, err := DecodeFSInfo(device, bs32); err == nil {
+			fat.fsInfo = fsInfo
+			fat.fsInfoSector = bs32.FSInfoSector
+		}
+
+		rootDir, err = DecodeDirectoryCluster(bs32.RootCluster, device, fat)
+		if err != nil {
+			return nil, err
+		}
+
+		rootDir.root = true
 	} else {
 		rootDir, err = DecodeFAT16RootDirectoryCluster(device, bs)
 		if err != nil {
@@ -41,6 +101,11 @@ func New(device fs.BlockDevice) (*FileSystem, error) {
 		device:  device,
 		fat:     fat,
 		rootDir: rootDir,
+		dirs:    make(map[uint32]*DirectoryCluster),
+	}
+
+	if bs32 != nil {
+		result.dirs[bs32.RootCluster] = rootDir
 	}
 
 	return result, nil
@@ -51,7 +116,53 @@ func (f *FileSystem) RootDir() (fs.Directory, error) {
 		device:     f.device,
 		dirCluster: f.rootDir,
 		fat:        f.fat,
+		filesys:    f,
 	}
 
 	return dir, nil
 }
+
+// SetAllocator sets the strategy that chooses which clusters are used
+// when files and directories are created or grown. If allocator is nil,
+// the default NextFitAllocator is used.
+func (f *FileSystem) SetAllocator(allocator Allocator) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.fat.allocator = allocator
+}
+
+// directory returns the directory that starts at the given cluster. It
+// is only read from the device the first time, so that everything shares
+// the same entries. The caller must hold lock.
+func (f *FileSystem) directory(cluster uint32) (*DirectoryCluster, error) {
+	if cluster == 0 {
+		// The ".." entry of a directory in the root has cluster 0
+		return f.rootDir, nil
+	}
+
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	if dir, ok := f.dirs[cluster]; ok {
+		return dir, nil
+	}
+
+	dir, err := DecodeDirectoryCluster(cluster, f.device, f.fat)
+	if err != nil {
+		return nil, err
+	}
+
+	f.dirs[cluster] = dir
+	return dir, nil
+}
+
+// forgetDirectory drops the directory that starts at the given cluster,
+// which must be done when it is removed since the cluster can be reused.
+// The caller must hold lock for writing.
+func (f *FileSystem) forgetDirectory(cluster uint32) {
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	delete(f.dirs, cluster)
+}
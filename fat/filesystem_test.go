@@ -1,6 +1,7 @@
 package fat
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/mitchellh/go-fs"
@@ -13,3 +14,128 @@ func TestFileSystemImplementsFileSystem(t *testing.T) {
 		t.Fatal("FileSystem should be a FileSystem")
 	}
 }
+
+func TestNew_FAT32(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+
+	bs := &BootSectorFat32{
+		BootSectorCommon: BootSectorCommon{
+			BytesPerSector:      512,
+			Media:               MediaFixed,
+			NumFATs:             2,
+			ReservedSectorCount: 32,
+			SectorsPerCluster:   1,
+			SectorsPerFat:       1024,
+			TotalSectors:        uint32(device.Len() / 512),
+		},
+		FileSystemTypeLabel: "FAT32   ",
+		FSInfoSector:        1,
+		RootCluster:         2,
+		VolumeLabel:         "GOFS",
+	}
+
+	bsBytes, err := bs.Bytes()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	binary.LittleEndian.PutUint32(bsBytes[32:36], bs.TotalSectors)
+	if _, err := device.WriteAt(bsBytes, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat, err := NewFAT(&bs.BootSectorCommon)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat.setEntry(2, 0x0FFFFFFF)
+	if err := fat.WriteToDevice(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir := &DirectoryCluster{startCluster: 2}
+	rootDir.entries = []*DirectoryClusterEntry{
+		{name: "HELLO", ext: "TXT", cluster: 3, fileSize: 5},
+	}
+	if err := rootDir.WriteToDevice(device, fat); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry := dir.Entry("HELLO.TXT")
+	if entry == nil {
+		t.Fatal("entry should exist")
+	}
+
+	if entry.IsDir() {
+		t.Fatal("entry should not be a directory")
+	}
+}
+
+// testDevice returns a BlockDevice of the given size that is kept in
+// memory.
+func testDevice(t *testing.T, size int64) fs.BlockDevice {
+	return fs.NewMemoryDisk(size)
+}
+
+// testFileSystem formats a new device of the given size with the given
+// FAT type and returns the mounted filesystem.
+func testFileSystem(t *testing.T, fatType FATType, size int64) (*FileSystem, fs.BlockDevice) {
+	device := testDevice(t, size)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: fatType}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return filesys, device
+}
+
+func TestFileSystem_cachedDevice(t *testing.T) {
+	device := testDevice(t, 16*1024*1024)
+	cache, err := fs.NewCachedDevice(device, &fs.CachedDeviceOptions{
+		BlockSize: 4096,
+		MaxMemory: 64 * 1024,
+		ReadAhead: 8,
+		Mode:      fs.WriteBack,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := FormatSuperFloppy(cache, &SuperFloppyConfig{FATType: FAT16}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(cache)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	checkTestFiles(t, filesys)
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() || report.Files != 3 {
+		t.Fatalf("bad report: %d %v", report.Files, report.Findings)
+	}
+}
@@ -0,0 +1,120 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// The value of the FSInfo free count and next free fields when they
+// are unknown and must be computed.
+const FSInfoUnknown = 0xFFFFFFFF
+
+// FSInfo is the FAT32 FSInfo structure, which stores hints about the
+// free clusters on the volume. None of the values in here are
+// authoritative, the FAT itself always is.
+type FSInfo struct {
+	// FreeCount is the last known free cluster count on the volume.
+	FreeCount uint32
+
+	// NextFree is the last cluster that was allocated. The driver
+	// should start looking for free clusters right after it. This is
+	// how the FAT specification and Linux use the field.
+	NextFree uint32
+}
+
+// Bytes returns the on-disk byte data for the FSInfo sector.
+func (f *FSInfo) Bytes() []byte {
+	var sector [512]byte
+
+	// FSI_LeadSig
+	binary.LittleEndian.PutUint32(sector[0:4], 0x41615252)
+
+	// FSI_StrucSig
+	binary.LittleEndian.PutUint32(sector[484:488], 0x61417272)
+
+	// FSI_Free_Count
+	binary.LittleEndian.PutUint32(sector[488:492], f.FreeCount)
+
+	// FSI_Nxt_Free
+	binary.LittleEndian.PutUint32(sector[492:496], f.NextFree)
+
+	// FSI_TrailSig
+	binary.LittleEndian.PutUint32(sector[508:512], 0xAA550000)
+
+	return sector[:]
+}
+
+// DecodeFSInfo decodes the FSInfo sector of the given FAT32 filesystem.
+// Values that are implausible for the volume are invalidated by setting
+// them to FSInfoUnknown.
+func DecodeFSInfo(device fs.BlockDevice, bs *BootSectorFat32) (*FSInfo, error) {
+	if bs.FSInfoSector == 0 || bs.FSInfoSector == 0xFFFF {
+		return nil, errors.New("filesystem has no FSInfo sector")
+	}
+
+	sector := make([]byte, 512)
+	offset := int64(bs.FSInfoSector) * int64(bs.BytesPerSector)
+	if _, err := device.ReadAt(sector, offset); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(sector[0:4]) != 0x41615252 ||
+		binary.LittleEndian.Uint32(sector[484:488]) != 0x61417272 ||
+		binary.LittleEndian.Uint32(sector[508:512]) != 0xAA550000 {
+		return nil, errors.New("corrupt FSInfo signature")
+	}
+
+	result := &FSInfo{
+		FreeCount: binary.LittleEndian.Uint32(sector[488:492]),
+		NextFree:  binary.LittleEndian.Uint32(sector[492:496]),
+	}
+
+	clusterCount := bs.ClusterCount()
+	if result.FreeCount > clusterCount {
+		result.FreeCount = FSInfoUnknown
+	}
+
+	if result.NextFree < FirstCluster || result.NextFree >= clusterCount+FirstCluster {
+		result.NextFree = FSInfoUnknown
+	}
+
+	return result, nil
+}
+
+// countFSInfo returns hints that are computed from the FAT itself: the
+// number of free clusters, and the cluster right before the first free
+// one as the last allocated cluster.
+func countFSInfo(fat *FAT) *FSInfo {
+	result := &FSInfo{NextFree: FSInfoUnknown}
+	for cluster := uint32(FirstCluster); cluster <= fat.MaxCluster(); cluster++ {
+		if fat.entries[cluster] != 0 {
+			continue
+		}
+
+		if result.FreeCount == 0 && cluster > FirstCluster {
+			result.NextFree = cluster - 1
+		}
+
+		result.FreeCount++
+	}
+
+	return result
+}
+
+// allocated updates the hints after the given cluster was allocated.
+func (f *FSInfo) allocated(cluster uint32) {
+	if f.FreeCount != FSInfoUnknown && f.FreeCount > 0 {
+		f.FreeCount--
+	}
+
+	f.NextFree = cluster
+}
+
+// freed updates the hints after the given number of clusters were freed.
+func (f *FSInfo) freed(n uint32) {
+	if f.FreeCount != FSInfoUnknown {
+		f.FreeCount += n
+	}
+}
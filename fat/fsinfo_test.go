@@ -0,0 +1,93 @@
+package fat
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeFSInfo_implausible(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSectorFat32(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var values [8]byte
+	binary.LittleEndian.PutUint32(values[0:4], bs.ClusterCount()+10)
+	binary.LittleEndian.PutUint32(values[4:8], 1)
+	offset := int64(bs.FSInfoSector)*512 + 488
+	if _, err := device.WriteAt(values[:], offset); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsInfo, err := DecodeFSInfo(device, bs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if fsInfo.FreeCount != FSInfoUnknown {
+		t.Fatalf("bad free count: %d", fsInfo.FreeCount)
+	}
+
+	if fsInfo.NextFree != FSInfoUnknown {
+		t.Fatalf("bad next free: %d", fsInfo.NextFree)
+	}
+}
+
+func TestFAT_fsInfoMaintained(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat := filesys.fat
+	freeCount := fat.fsInfo.FreeCount
+
+	// Start allocating somewhere in the middle of the volume, right
+	// after the last allocated cluster
+	fat.fsInfo.NextFree = 99
+	cluster, err := fat.AllocChain(1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if cluster != 100 {
+		t.Fatalf("should allocate after the hint: %d", cluster)
+	}
+
+	if fat.fsInfo.FreeCount != freeCount-1 {
+		t.Fatalf("bad free count: %d", fat.fsInfo.FreeCount)
+	}
+
+	if err := fat.WriteToDevice(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSectorFat32(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsInfo, err := DecodeFSInfo(device, bs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if fsInfo.FreeCount != freeCount-1 || fsInfo.NextFree != 100 {
+		t.Fatalf("FSInfo not flushed: %#v", fsInfo)
+	}
+
+	fat.FreeChain(cluster)
+	if fat.fsInfo.FreeCount != freeCount {
+		t.Fatalf("bad free count: %d", fat.fsInfo.FreeCount)
+	}
+}
@@ -0,0 +1,158 @@
+package fat
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	gofs "github.com/mitchellh/go-fs"
+)
+
+func TestIOFS(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("Hello World.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write([]byte("hello, world\n")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err = rootDir.AddDirectory("docs")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := subDir.AddFile("empty"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsys := gofs.NewIOFS(filesys)
+	if err := fstest.TestFS(fsys, "Hello World.txt", "docs/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Stat(fsys, "Hello World.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info.Size() != 13 || info.Mode() != 0666 {
+		t.Fatalf("bad: %d %s", info.Size(), info.Mode())
+	}
+
+	if info.Sys().(DirectoryAttr) != 0 {
+		t.Fatalf("bad: %#v", info.Sys())
+	}
+
+	if _, err := fs.Stat(fsys, "docs/missing"); err == nil {
+		t.Fatal("should error")
+	}
+
+	// Lookups ignore case, but the name is the one that is stored
+	info, err = fs.Stat(fsys, "HELLO WORLD.TXT")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info.Name() != "Hello World.txt" {
+		t.Fatalf("bad name: %s", info.Name())
+	}
+
+	opened, err := fsys.Open("DOCS")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if info, err := opened.Stat(); err != nil || info.Name() != "docs" {
+		t.Fatalf("bad: %v %v", info, err)
+	}
+}
+
+func TestIOFS_attributes(t *testing.T) {
+	device := testDevice(t, 16*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT16, Label: "MYDISK"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	attrs := map[string]DirectoryAttr{
+		"hidden.txt":   AttrHidden,
+		"system.sys":   AttrSystem | AttrReadOnly,
+		"readonly.txt": AttrReadOnly | AttrArchive,
+	}
+
+	for name, attr := range attrs {
+		entry, err := rootDir.AddFile(name)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		entry.(*DirectoryEntry).entry.attr = attr
+	}
+
+	// A second volume label right after the one of the format
+	dirCluster := rootDir.(*Directory).dirCluster
+	label := &DirectoryClusterEntry{name: "OTHER", attr: AttrVolumeId}
+	dirCluster.entries = append(dirCluster.entries[:1], append([]*DirectoryClusterEntry{label}, dirCluster.entries[1:]...)...)
+	if err := dirCluster.WriteToDevice(device, filesys.fat); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fsys := gofs.NewIOFS(filesys)
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(entries) != len(attrs) {
+		t.Fatalf("bad entries: %v", entries)
+	}
+
+	modes := map[string]fs.FileMode{
+		"hidden.txt":   0666,
+		"system.sys":   0444,
+		"readonly.txt": 0444,
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if info.Mode() != modes[entry.Name()] || info.Sys().(DirectoryAttr) != attrs[entry.Name()] {
+			t.Fatalf("bad %s: %s %#v", entry.Name(), info.Mode(), info.Sys())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// The sector that the backup boot sector is stored in if the primary
+// boot sector is too damaged to tell us.
+const DefaultBackupBootSector = 6
+
+// BootSectorRecovery is the result of RecoverBootSector.
+type BootSectorRecovery struct {
+	// BackupSector is the sector the valid backup boot sector was
+	// found in.
+	BackupSector uint16
+
+	// Changes are the fields of the primary boot sector that differ
+	// from the backup copy.
+	Changes []BootSectorChange
+
+	// Written is true if the primary boot sector was rewritten from the
+	// backup copy.
+	Written bool
+}
+
+// BootSectorChange is a single field of the primary boot sector that
+// differs from the backup boot sector.
+type BootSectorChange struct {
+	Field  string
+	Offset int
+	Old    []byte
+	New    []byte
+}
+
+func (c BootSectorChange) String() string {
+	return fmt.Sprintf("%s: % X -> % X", c.Field, c.Old, c.New)
+}
+
+// The layout of a FAT32 boot sector, used to report changes.
+var bootSectorFat32Fields = []struct {
+	name  string
+	start int
+	end   int
+}{
+	{"BS_jmpBoot", 0, 3},
+	{"BS_OEMName", 3, 11},
+	{"BPB_BytsPerSec", 11, 13},
+	{"BPB_SecPerClus", 13, 14},
+	{"BPB_RsvdSecCnt", 14, 16},
+	{"BPB_NumFATs", 16, 17},
+	{"BPB_RootEntCnt", 17, 19},
+	{"BPB_TotSec16", 19, 21},
+	{"BPB_Media", 21, 22},
+	{"BPB_FATSz16", 22, 24},
+	{"BPB_SecPerTrk", 24, 26},
+	{"BPB_NumHeads", 26, 28},
+	{"BPB_HiddSec", 28, 32},
+	{"BPB_TotSec32", 32, 36},
+	{"BPB_FATSz32", 36, 40},
+	{"BPB_ExtFlags", 40, 42},
+	{"BPB_FSVer", 42, 44},
+	{"BPB_RootClus", 44, 48},
+	{"BPB_FSInfo", 48, 50},
+	{"BPB_BkBootSec", 50, 52},
+	{"BPB_Reserved", 52, 64},
+	{"BS_DrvNum", 64, 65},
+	{"BS_Reserved1", 65, 66},
+	{"BS_BootSig", 66, 67},
+	{"BS_VolID", 67, 71},
+	{"BS_VolLab", 71, 82},
+	{"BS_FilSysType", 82, 90},
+	{"BootCode", 90, 510},
+	{"Signature_word", 510, 512},
+}
+
+// RecoverBootSector looks for a valid FAT32 backup boot sector when the
+// primary boot sector is damaged. The fields that differ between the two
+// are returned and, if write is true, the primary boot sector is
+// rewritten from the backup copy.
+//
+// If the primary boot sector is already valid, nothing is changed and
+// the returned recovery has no changes. This is also the case for a
+// healthy FAT12 or FAT16 volume, which has no backup boot sector.
+func RecoverBootSector(device fs.BlockDevice, write bool) (*BootSectorRecovery, error) {
+	sectorSize := int64(device.SectorSize())
+	primary := make([]byte, 512)
+	if _, err := device.ReadAt(primary, 0); err != nil {
+		return nil, err
+	}
+
+	if validateBootSectorFat32(primary, 0) == nil || validateBootSectorFat16(primary) == nil {
+		return &BootSectorRecovery{}, nil
+	}
+
+	// Try the backup sector named by the primary first, in case only
+	// part of it is damaged, then fall back to the default location.
+	candidates := []uint16{DefaultBackupBootSector}
+	if bk := binary.LittleEndian.Uint16(primary[50:52]); bk != 0 &&
+		bk != 0xFFFF && bk != DefaultBackupBootSector {
+		candidates = append([]uint16{bk}, candidates...)
+	}
+
+	var backup []byte
+	var backupSector uint16
+	for _, candidate := range candidates {
+		sector := make([]byte, 512)
+		offset := int64(candidate) * sectorSize
+		if offset+512 > device.Len() {
+			continue
+		}
+
+		if _, err := device.ReadAt(sector, offset); err != nil {
+			return nil, err
+		}
+
+		if validateBootSectorFat32(sector, candidate) == nil {
+			backup = sector
+			backupSector = candidate
+			break
+		}
+	}
+
+	if backup == nil {
+		return nil, errors.New("no valid backup boot sector found")
+	}
+
+	result := &BootSectorRecovery{BackupSector: backupSector}
+	for _, field := range bootSectorFat32Fields {
+		oldValue := primary[field.start:field.end]
+		newValue := backup[field.start:field.end]
+		if !bytes.Equal(oldValue, newValue) {
+			result.Changes = append(result.Changes, BootSectorChange{
+				Field:  field.name,
+				Offset: field.start,
+				Old:    oldValue,
+				New:    newValue,
+			})
+		}
+	}
+
+	if write {
+		if _, err := device.WriteAt(backup, 0); err != nil {
+			return nil, err
+		}
+
+		result.Written = true
+	}
+
+	return result, nil
+}
+
+// validateBootSectorFat32 verifies that the raw sector is a sane FAT32
+// boot sector that was read from the given sector number.
+func validateBootSectorFat32(sector []byte, n uint16) error {
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return errors.New("corrupt boot sector signature")
+	}
+
+	bs, err := decodeBootSectorFat32(sector)
+	if err != nil {
+		return err
+	}
+
+	if err := validateBootSectorCommon(&bs.BootSectorCommon); err != nil {
+		return err
+	}
+
+	if bs.RootEntryCount != 0 || bs.FATType() != FAT32 {
+		return errors.New("not a FAT32 boot sector")
+	}
+
+	if bs.RootCluster >= bs.ClusterCount()+FirstCluster {
+		return fmt.Errorf("invalid root cluster: %d", bs.RootCluster)
+	}
+
+	if n != 0 && bs.BackupBootSector != n {
+		return fmt.Errorf("backup boot sector found at %d claims to be at %d", n, bs.BackupBootSector)
+	}
+
+	return nil
+}
+
+// validateBootSectorFat16 verifies that the raw sector is a sane FAT12
+// or FAT16 boot sector. These have no backup copy.
+func validateBootSectorFat16(sector []byte) error {
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return errors.New("corrupt boot sector signature")
+	}
+
+	bs := decodeBootSectorCommon(sector)
+	if err := validateBootSectorCommon(bs); err != nil {
+		return err
+	}
+
+	if bs.RootEntryCount == 0 || bs.FATType() == FAT32 {
+		return errors.New("not a FAT12 or FAT16 boot sector")
+	}
+
+	return nil
+}
+
+// validateBootSectorCommon verifies the fields that every FAT type has.
+func validateBootSectorCommon(bs *BootSectorCommon) error {
+	switch bs.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid bytes per sector: %d", bs.BytesPerSector)
+	}
+
+	if bs.SectorsPerCluster == 0 || bs.SectorsPerCluster&(bs.SectorsPerCluster-1) != 0 {
+		return fmt.Errorf("invalid sectors per cluster: %d", bs.SectorsPerCluster)
+	}
+
+	if bs.ReservedSectorCount == 0 || bs.NumFATs == 0 {
+		return errors.New("invalid reserved sector count or number of FATs")
+	}
+
+	if bs.SectorsPerFat == 0 {
+		return errors.New("invalid sectors per FAT")
+	}
+
+	rootDirSectors := (uint32(bs.RootEntryCount)*DirectoryEntrySize + uint32(bs.BytesPerSector) - 1) / uint32(bs.BytesPerSector)
+	reserved := uint32(bs.ReservedSectorCount) + bs.SectorsPerFat*uint32(bs.NumFATs) + rootDirSectors
+	if bs.TotalSectors <= reserved {
+		return fmt.Errorf("invalid total sectors: %d", bs.TotalSectors)
+	}
+
+	return nil
+}
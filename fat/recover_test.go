@@ -0,0 +1,88 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestRecoverBootSector(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A valid boot sector needs no recovery
+	recovery, err := RecoverBootSector(device, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if recovery.Written || len(recovery.Changes) > 0 {
+		t.Fatalf("bad: %#v", recovery)
+	}
+
+	// Trash the primary boot sector
+	if _, err := device.WriteAt(make([]byte, 512), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := New(device); err == nil {
+		t.Fatal("should not be able to open a trashed filesystem")
+	}
+
+	recovery, err = RecoverBootSector(device, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !recovery.Written || recovery.BackupSector != DefaultBackupBootSector {
+		t.Fatalf("bad: %#v", recovery)
+	}
+
+	if len(recovery.Changes) == 0 {
+		t.Fatal("should report changes")
+	}
+
+	if _, err := New(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestRecoverBootSector_fat16(t *testing.T) {
+	for _, fatType := range []FATType{FAT12, FAT16} {
+		device := testDevice(t, 16*1024*1024)
+		if fatType == FAT12 {
+			device = testDevice(t, 1474560)
+		}
+
+		if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: fatType}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		recovery, err := RecoverBootSector(device, true)
+		if err != nil {
+			t.Fatalf("%s: err: %s", fatType, err)
+		}
+
+		if recovery.Written || len(recovery.Changes) > 0 {
+			t.Fatalf("%s: bad: %#v", fatType, recovery)
+		}
+	}
+}
+
+func TestRecoverBootSector_noBackup(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := device.WriteAt(make([]byte, 512), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := device.WriteAt(make([]byte, 512), DefaultBackupBootSector*512); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := RecoverBootSector(device, true); err == nil {
+		t.Fatal("should error")
+	}
+}
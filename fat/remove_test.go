@@ -0,0 +1,164 @@
+package fat
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestRemove(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("a file with a long name.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write(bytes.Repeat([]byte("x"), 10000)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cluster := entry.(*DirectoryEntry).entry.cluster
+	if err := rootDir.Remove("A FILE WITH A LONG NAME.TXT"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rootDir.Remove("a file with a long name.txt"); err == nil {
+		t.Fatal("should error removing a missing file")
+	}
+
+	// Everything must be gone after a remount
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(rootDir.Entries()) != 0 {
+		t.Fatalf("bad entries: %#v", rootDir.Entries())
+	}
+
+	if filesys.fat.entries[cluster] != 0 {
+		t.Fatal("clusters should be freed")
+	}
+
+	for _, dirEntry := range rootDir.(*Directory).dirCluster.entries {
+		if !dirEntry.IsVolumeId() && !dirEntry.deleted {
+			t.Fatalf("entry should be deleted: %#v", dirEntry)
+		}
+	}
+
+	fat0, err := DecodeFAT(device, filesys.bs, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fat1, err := DecodeFAT(device, filesys.bs, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(fat0.Bytes(), fat1.Bytes()) {
+		t.Fatal("FATs should match")
+	}
+}
+
+func TestRemove_directory(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddDirectory("dir")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir, err := entry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := dir.AddFile("file"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := dir.Remove("."); err == nil {
+		t.Fatal("should not remove the dot entry")
+	}
+
+	if err := rootDir.Remove("dir"); err == nil {
+		t.Fatal("should not remove a non-empty directory")
+	}
+
+	if err := rootDir.(*Directory).RemoveAll("dir"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if rootDir.Entry("dir") != nil {
+		t.Fatal("directory should be removed")
+	}
+}
+
+func TestRemove_crash(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, _ := filesys.RootDir()
+	entry, err := rootDir.AddFile("file.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, _ := entry.File()
+	if _, err := file.Write(bytes.Repeat([]byte("x"), 10000)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Crash right after the first write of the removal
+	crash := &crashDevice{BlockDevice: device, writesLeft: 1}
+	filesys = mustNew(t, crash)
+	rootDir, _ = filesys.RootDir()
+	if err := rootDir.Remove("file.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The clusters may leak, but no entry may point at free clusters
+	filesys = mustNew(t, device)
+	rootDir, _ = filesys.RootDir()
+	for _, entry := range rootDir.Entries() {
+		if cluster := entry.(*DirectoryEntry).entry.cluster; filesys.fat.IsFree(cluster) {
+			t.Fatalf("%s points at free cluster %d", entry.Name(), cluster)
+		}
+	}
+}
+
+// crashDevice drops every write after the given number of writes, as if
+// the machine crashed.
+type crashDevice struct {
+	fs.BlockDevice
+
+	writesLeft int
+}
+
+func (d *crashDevice) WriteAt(p []byte, off int64) (int, error) {
+	if d.writesLeft == 0 {
+		return len(p), nil
+	}
+
+	d.writesLeft--
+	return d.BlockDevice.WriteAt(p, off)
+}
@@ -0,0 +1,166 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// Rename moves the entry named oldName in oldDir to newName in newDir,
+// which may be the same directory as oldDir. The entry keeps its start
+// cluster, so none of its data is copied.
+func (f *FileSystem) Rename(oldDir fs.Directory, oldName string, newDir fs.Directory, newName string) error {
+	src, ok := oldDir.(*Directory)
+	if !ok {
+		return errors.New("source directory is not a FAT directory")
+	}
+
+	dst, ok := newDir.(*Directory)
+	if !ok {
+		return errors.New("destination directory is not a FAT directory")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	newName = strings.TrimSpace(newName)
+	if newName == "" || newName == "." || newName == ".." {
+		return fmt.Errorf("invalid name: %s", newName)
+	}
+
+	entry := src.entry(oldName)
+	if entry == nil {
+		return fmt.Errorf("file not found: %s", oldName)
+	}
+
+	if entry.entry.name == "." || entry.entry.name == ".." {
+		return fmt.Errorf("cannot rename: %s", oldName)
+	}
+
+	// If both are the same directory on disk, only use one of them so
+	// that neither overwrites the changes of the other.
+	sameDir := src.dirCluster.startCluster == dst.dirCluster.startCluster &&
+		src.dirCluster.root == dst.dirCluster.root
+	if sameDir {
+		dst = src
+	}
+
+	if entry.IsDir() && !sameDir {
+		inside, err := f.isInside(dst.dirCluster, entry.entry.cluster)
+		if err != nil {
+			return err
+		}
+
+		if inside {
+			return fmt.Errorf("cannot move a directory inside itself: %s", oldName)
+		}
+	}
+
+	var ignore *DirectoryEntry
+	if sameDir {
+		ignore = entry
+	}
+
+	shortEntry, lfnEntries, err := dst.newEntryNames(newName, ignore)
+	if err != nil {
+		return err
+	}
+
+	// The entry itself moves to the new slot with its new name, so that
+	// open files and directory entries keep referring to it. Its old slot
+	// holds a copy until the new one is written.
+	moved := entry.entry
+	idx := -1
+	for i, e := range src.dirCluster.entries {
+		if e == moved {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 {
+		return fmt.Errorf("entry not found in its directory: %s", oldName)
+	}
+
+	old := *moved
+	src.dirCluster.entries[idx] = &old
+	moved.name, moved.ext, moved.caseFlags = shortEntry.name, shortEntry.ext, 0
+
+	// Write the new entries first so that a failure never leaves the
+	// data unreachable.
+	if err := dst.appendEntries(lfnEntries, moved); err != nil {
+		*moved = old
+		src.dirCluster.entries[idx] = moved
+		return err
+	}
+
+	for _, lfn := range entry.lfnEntries {
+		lfn.deleted = true
+	}
+	old.deleted = true
+
+	if err := src.dirCluster.WriteToDevice(src.device, src.fat); err != nil {
+		return err
+	}
+
+	// A directory that moved to another parent has to point its ".."
+	// entry at the new parent.
+	if entry.IsDir() && !sameDir {
+		dirCluster, err := f.directory(moved.cluster)
+		if err != nil {
+			return err
+		}
+
+		for _, dirEntry := range dirCluster.entries {
+			if !dirEntry.IsLong() && dirEntry.name == ".." {
+				dirEntry.cluster = dst.dirCluster.dotDotCluster()
+				break
+			}
+		}
+
+		if err := dirCluster.WriteToDevice(f.device, f.fat); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isInside returns true if the given directory is the directory at the
+// cluster, or any of its subdirectories.
+func (f *FileSystem) isInside(dir *DirectoryCluster, cluster uint32) (bool, error) {
+	visited := make(map[uint32]bool)
+	for !dir.root {
+		if dir.startCluster == cluster {
+			return true, nil
+		}
+
+		// Guard against loops on a corrupt filesystem
+		if visited[dir.startCluster] {
+			return false, errors.New("directory loop detected")
+		}
+		visited[dir.startCluster] = true
+
+		var parent uint32
+		for _, entry := range dir.entries {
+			if !entry.IsLong() && entry.name == ".." {
+				parent = entry.cluster
+				break
+			}
+		}
+
+		if parent == 0 {
+			break
+		}
+
+		var err error
+		dir, err = DecodeDirectoryCluster(parent, f.device, f.fat)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
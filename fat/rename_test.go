@@ -0,0 +1,241 @@
+package fat
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRename(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("original name.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := io.WriteString(file, "contents"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("other.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cluster := entry.(*DirectoryEntry).entry.cluster
+	if err := filesys.Rename(rootDir, "original name.txt", rootDir, "other.txt"); err == nil {
+		t.Fatal("should not rename over an existing file")
+	}
+
+	if err := filesys.Rename(rootDir, "original name.txt", rootDir, "renamed.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A rename that only changes the case is fine
+	if err := filesys.Rename(rootDir, "renamed.txt", rootDir, "Renamed.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if rootDir.Entry("original name.txt") != nil {
+		t.Fatal("old name should be gone")
+	}
+
+	newEntry := rootDir.Entry("renamed.txt")
+	if newEntry == nil {
+		t.Fatal("new name should exist")
+	}
+
+	if newEntry.Name() != "Renamed.txt" {
+		t.Fatalf("bad name: %s", newEntry.Name())
+	}
+
+	if newEntry.(*DirectoryEntry).entry.cluster != cluster {
+		t.Fatal("start cluster should be kept")
+	}
+
+	file, err = newEntry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, 8))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data) != "contents" {
+		t.Fatalf("bad contents: %s", data)
+	}
+}
+
+func TestRename_directory(t *testing.T) {
+	filesys, _ := testFileSystem(t, FAT32, 64*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	aEntry, err := rootDir.AddDirectory("a")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bEntry, err := rootDir.AddDirectory("b")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	aDir, err := aEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bDir, err := bEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := filesys.Rename(rootDir, "b", bDir, "b"); err == nil {
+		t.Fatal("should not move a directory inside itself")
+	}
+
+	if err := filesys.Rename(rootDir, "b", aDir, "moved"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if rootDir.Entry("b") != nil {
+		t.Fatal("b should be gone from the root")
+	}
+
+	movedEntry := aDir.Entry("moved")
+	if movedEntry == nil {
+		t.Fatal("moved directory should exist")
+	}
+
+	movedDir, err := movedEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dotDot := movedDir.Entry("..").(*DirectoryEntry)
+	if dotDot.entry.cluster != aEntry.(*DirectoryEntry).entry.cluster {
+		t.Fatalf("bad .. cluster: %d", dotDot.entry.cluster)
+	}
+
+	// Moving back to the root points ".." at cluster 0
+	if err := filesys.Rename(aDir, "moved", rootDir, "b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bDir, err = rootDir.Entry("b").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dotDot = bDir.Entry("..").(*DirectoryEntry)
+	if dotDot.entry.cluster != 0 {
+		t.Fatalf("bad .. cluster: %d", dotDot.entry.cluster)
+	}
+}
+
+func TestRename_openFile(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("file.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddDirectory("dir"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	subDir, err := rootDir.Entry("dir").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Rename within the directory and then move it, writing through the
+	// handle that was opened before either
+	if err := filesys.Rename(rootDir, "file.txt", rootDir, "renamed.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := io.WriteString(file, "hello "); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := filesys.Rename(rootDir, "renamed.txt", subDir, "moved.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := io.WriteString(file, "world"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if rootDir.Entry("file.txt") != nil || rootDir.Entry("renamed.txt") != nil {
+		t.Fatal("old names should be gone")
+	}
+
+	subDir, err = rootDir.Entry("dir").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	moved := subDir.Entry("moved.txt")
+	if moved == nil {
+		t.Fatal("moved file should exist")
+	}
+
+	file, err = moved.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Fatalf("bad contents: %q", data)
+	}
+}
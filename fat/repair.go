@@ -0,0 +1,547 @@
+package fat
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// RepairOptions are the options for Repair.
+type RepairOptions struct {
+	// DryRun makes Repair report what it would change without writing
+	// anything to the device.
+	DryRun bool
+
+	// CollectLost saves lost chains as FILEnnnn.CHK files in a new
+	// FOUND.nnn directory in the root directory instead of freeing them.
+	CollectLost bool
+
+	// KeepChains fixes files whose chain is longer than their size needs
+	// by growing the size to cover the whole chain, instead of truncating
+	// the chain.
+	KeepChains bool
+
+	// Log, if not nil, has every action written to it as it is taken.
+	Log io.Writer
+}
+
+// RepairReport is the result of Repair.
+type RepairReport struct {
+	// Findings are the problems that were found before repairing.
+	Findings []Finding
+
+	// Actions are the changes made to fix the problems, in order.
+	Actions []RepairAction
+
+	// Unrepaired are the findings that Repair doesn't know how to fix.
+	Unrepaired []Finding
+
+	// Written is true if the changes were written to the device.
+	Written bool
+}
+
+// RepairAction is a single change made by Repair.
+type RepairAction struct {
+	Kind        FindingKind
+	Path        string
+	Description string
+}
+
+func (a RepairAction) String() string {
+	if a.Path == "" {
+		return a.Description
+	}
+
+	return fmt.Sprintf("%s: %s", a.Path, a.Description)
+}
+
+// Repair checks the FAT filesystem on the device like Check and fixes
+// the problems it finds, much like "dosfsck -a":
+//
+//   - Files whose chain doesn't match their size have their chain
+//     truncated or their size shrunk, whichever is shorter.
+//   - Chains that are cross-linked or contain invalid clusters are
+//     truncated before the bad cluster.
+//   - Lost chains are freed or collected into FOUND.nnn.
+//   - The FAT copy with the fewest problems is copied over the others.
+//   - Orphan long name entries are deleted.
+//   - "." and ".." entries are pointed at the right clusters.
+//   - The dirty flags of the volume are cleared.
+//   - The FSInfo free count and next free hints of FAT32 are recomputed.
+//
+// If options is nil, the defaults are used.
+func Repair(device fs.BlockDevice, options *RepairOptions) (*RepairReport, error) {
+	if options == nil {
+		options = new(RepairOptions)
+	}
+
+	if options.DryRun {
+		device = &dryRunDevice{
+			BlockDevice: device,
+			blocks:      make(map[int64][]byte),
+		}
+	}
+
+	c, err := repairChecker(device)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &repairer{
+		checker:  c,
+		options:  options,
+		result:   &RepairReport{Findings: c.report.Findings},
+		released: make(map[uint32]bool),
+	}
+
+	if err := r.repair(); err != nil {
+		return nil, err
+	}
+
+	r.result.Written = !options.DryRun && len(r.result.Actions) > 0
+	return r.result, nil
+}
+
+// repairChecker checks the filesystem using each copy of the FAT that
+// differs from the one in use, and returns the checker that found the
+// fewest problems.
+func repairChecker(device fs.BlockDevice) (*checker, error) {
+	best, err := newChecker(device)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := best.check(); err != nil {
+		return nil, err
+	}
+
+	for _, finding := range best.report.Findings {
+		if finding.Kind != FindingFATMismatch {
+			continue
+		}
+
+		c, err := newChecker(device)
+		if err != nil {
+			return nil, err
+		}
+
+		c.fat, err = DecodeFAT(device, c.bs, finding.FAT)
+		if err != nil {
+			return nil, err
+		}
+
+		c.fat.activeFAT = finding.FAT
+		if err := c.check(); err != nil {
+			return nil, err
+		}
+
+		if repairScore(c) < repairScore(best) {
+			best = c
+		}
+	}
+
+	return best, nil
+}
+
+// repairScore returns the number of problems found by the checker,
+// other than the FAT copies disagreeing.
+func repairScore(c *checker) int {
+	result := 0
+	for _, finding := range c.report.Findings {
+		if finding.Kind != FindingFATMismatch && finding.Kind != FindingDirtyVolume {
+			result++
+		}
+	}
+
+	return result
+}
+
+// repairer holds the state of a single run of Repair.
+type repairer struct {
+	*checker
+
+	options *RepairOptions
+	result  *RepairReport
+
+	// dirs are the directories that were changed and need writing.
+	dirs []*DirectoryCluster
+
+	// lost are the lost chains that need collecting.
+	lost []Finding
+
+	// released are the cross-linked clusters that were cut off from the
+	// chain that first claimed them, so they now belong to the other
+	// chain only.
+	released map[uint32]bool
+}
+
+func (r *repairer) repair() error {
+	// Cross-linked clusters are never freed when truncating a chain,
+	// since they belong to another chain as well.
+	crossLinked := make(map[uint32]bool)
+	for _, f := range r.checker.report.Findings {
+		if f.Kind == FindingCrossLink {
+			crossLinked[f.Cluster] = true
+		}
+	}
+
+	dirty := false
+	for _, f := range r.checker.report.Findings {
+		switch f.Kind {
+		case FindingLostChain:
+			r.fixLostChain(f)
+		case FindingCrossLink:
+			if r.released[f.Cluster] {
+				continue
+			}
+
+			r.truncate(f, len(f.chain), crossLinked)
+		case FindingInvalidCluster:
+			r.truncate(f, len(f.chain), crossLinked)
+		case FindingChainTooLong:
+			if r.options.KeepChains {
+				r.setSize(f, uint64(f.Length)*uint64(r.bs.BytesPerCluster()))
+			} else {
+				r.truncate(f, f.Expected, crossLinked)
+			}
+		case FindingChainTooShort:
+			r.setSize(f, uint64(f.Length)*uint64(r.bs.BytesPerCluster()))
+		case FindingBadDotEntry:
+			r.fixDotEntry(f)
+		case FindingOrphanLongName:
+			for _, entry := range f.dir.entries[f.Entry : f.Entry+f.Length] {
+				entry.deleted = true
+			}
+
+			r.changed(f.dir)
+			r.action(f, fmt.Sprintf("delete %d orphan long name entries at entry %d", f.Length, f.Entry))
+		case FindingFATMismatch:
+			r.action(f, fmt.Sprintf("copy FAT #%d over FAT #%d", r.fat.activeFAT, f.FAT))
+		case FindingDirtyVolume:
+			r.fat.setEntry(1, r.fat.entries[1]|r.fat.cleanShutdownMask())
+			dirty = true
+			r.action(f, "clear dirty flag")
+		}
+	}
+
+	if len(r.result.Actions) == 0 && len(r.lost) == 0 {
+		return nil
+	}
+
+	// Freeing and truncating chains leaves the FSInfo hints stale, so
+	// they are computed afresh from the FAT that is kept.
+	if r.bs32 != nil && !r.options.DryRun && r.bs32.FSInfoSector != 0 && r.bs32.FSInfoSector != 0xFFFF {
+		r.fat.fsInfo = countFSInfo(r.fat)
+		r.fat.fsInfoSector = r.bs32.FSInfoSector
+	}
+
+	// The FAT is always written in full, which also brings every copy
+	// in sync with the one we used, along with the FSInfo sector.
+	r.fat.markAllDirty()
+	if err := r.fat.WriteToDevice(r.device); err != nil {
+		return err
+	}
+
+	for _, dir := range r.dirs {
+		if err := dir.WriteToDevice(r.device, r.fat); err != nil {
+			return err
+		}
+	}
+
+	if dirty {
+		if err := r.clearDirtyFlag(); err != nil {
+			return err
+		}
+	}
+
+	if len(r.lost) > 0 {
+		return r.collectLost()
+	}
+
+	return nil
+}
+
+func (r *repairer) action(f Finding, description string) {
+	action := RepairAction{
+		Kind:        f.Kind,
+		Path:        f.Path,
+		Description: description,
+	}
+
+	r.result.Actions = append(r.result.Actions, action)
+	if r.options.Log != nil {
+		fmt.Fprintln(r.options.Log, action)
+	}
+}
+
+func (r *repairer) changed(dir *DirectoryCluster) {
+	for _, d := range r.dirs {
+		if d == dir {
+			return
+		}
+	}
+
+	r.dirs = append(r.dirs, dir)
+}
+
+func (r *repairer) fixLostChain(f Finding) {
+	if r.options.CollectLost {
+		r.fat.setEntry(f.chain[len(f.chain)-1], 0xFFFFFFFF&r.fat.entryMask())
+		r.lost = append(r.lost, f)
+		return
+	}
+
+	for _, cluster := range f.chain {
+		r.fat.setEntry(cluster, 0)
+	}
+
+	r.action(f, fmt.Sprintf("free lost chain of %d clusters at cluster %d", f.Length, f.Cluster))
+}
+
+// truncate cuts the chain of the finding down to the given number of
+// clusters. Clusters that are cut off are freed, up to the first one
+// that is cross-linked with another chain.
+func (r *repairer) truncate(f Finding, length int, crossLinked map[uint32]bool) {
+	if length == 0 && f.entry == nil {
+		r.result.Unrepaired = append(r.result.Unrepaired, f)
+		return
+	}
+
+	if length > len(f.chain) {
+		length = len(f.chain)
+	}
+
+	for _, cluster := range f.chain[length:] {
+		if crossLinked[cluster] {
+			r.released[cluster] = true
+			break
+		}
+
+		r.fat.setEntry(cluster, 0)
+	}
+
+	if length == 0 {
+		// Nothing is left of the chain. A file becomes empty, but a
+		// directory without any clusters can't exist at all.
+		if f.entry.attr&AttrDirectory != 0 {
+			r.removeEntry(f.dir, f.entry)
+			r.action(f, "remove directory")
+			return
+		}
+
+		f.entry.cluster = 0
+		f.entry.fileSize = 0
+		r.changed(f.dir)
+		r.action(f, "truncate to 0 bytes")
+		return
+	}
+
+	r.fat.setEntry(f.chain[length-1], 0xFFFFFFFF&r.fat.entryMask())
+	if f.entry == nil || f.entry.attr&AttrDirectory != 0 {
+		r.action(f, fmt.Sprintf("truncate chain to %d clusters", length))
+		return
+	}
+
+	maxSize := uint64(length) * uint64(r.bs.BytesPerCluster())
+	if uint64(f.entry.fileSize) > maxSize {
+		f.entry.fileSize = uint32(maxSize)
+		r.changed(f.dir)
+	}
+
+	r.action(f, fmt.Sprintf("truncate chain to %d clusters", length))
+}
+
+func (r *repairer) setSize(f Finding, size uint64) {
+	if size > 0xFFFFFFFF {
+		size = 0xFFFFFFFF
+	}
+
+	f.entry.fileSize = uint32(size)
+	r.changed(f.dir)
+	r.action(f, fmt.Sprintf("set size to %d bytes", size))
+}
+
+func (r *repairer) fixDotEntry(f Finding) {
+	name := "."
+	if f.Entry == 1 {
+		name = ".."
+	}
+
+	if f.Entry >= len(f.dir.entries) || f.dir.entries[f.Entry].name != name {
+		r.result.Unrepaired = append(r.result.Unrepaired, f)
+		return
+	}
+
+	entry := f.dir.entries[f.Entry]
+	entry.attr |= AttrDirectory
+	entry.cluster = f.Cluster
+	r.changed(f.dir)
+	r.action(f, fmt.Sprintf("point %q entry to cluster %d", name, f.Cluster))
+}
+
+// removeEntry marks a short entry and the long name entries before it
+// as deleted.
+func (r *repairer) removeEntry(dir *DirectoryCluster, entry *DirectoryClusterEntry) {
+	for i, e := range dir.entries {
+		if e != entry {
+			continue
+		}
+
+		e.deleted = true
+		for j := i - 1; j >= 0 && dir.entries[j].IsLong() && !dir.entries[j].deleted; j-- {
+			dir.entries[j].deleted = true
+		}
+	}
+
+	r.changed(dir)
+}
+
+// clearDirtyFlag clears the dirty flag in the boot sector and its
+// backup copy.
+func (r *repairer) clearDirtyFlag() error {
+	sectors := []int64{0}
+	if r.bs32 != nil && r.bs32.BackupBootSector != 0 {
+		sectors = append(sectors, int64(r.bs32.BackupBootSector))
+	}
+
+	for _, sector := range sectors {
+		offset := sector * int64(r.bs.BytesPerSector)
+		data, err := readBootSector(r.device, offset)
+		if err != nil {
+			// A damaged backup is left for RecoverBootSector
+			if sector != 0 {
+				continue
+			}
+
+			return err
+		}
+
+		data[r.dirtyFlagOffset()] &^= dirtyFlag
+		if _, err := r.device.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectLost saves the lost chains as files in a new FOUND.nnn
+// directory in the root directory. The chains must already be written
+// to the FAT.
+func (r *repairer) collectLost() error {
+	filesys, err := New(r.device)
+	if err != nil {
+		return err
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		return err
+	}
+
+	var name string
+	for i := 0; i < 1000; i++ {
+		name = fmt.Sprintf("FOUND.%03d", i)
+		if rootDir.Entry(name) == nil {
+			break
+		}
+	}
+
+	entry, err := rootDir.AddDirectory(name)
+	if err != nil {
+		return err
+	}
+
+	rawDir, err := entry.Dir()
+	if err != nil {
+		return err
+	}
+
+	dir := rawDir.(*Directory)
+	bpc := uint64(r.bs.BytesPerCluster())
+	for i, f := range r.lost {
+		fileName := fmt.Sprintf("FILE%04d.CHK", i)
+		shortEntry, lfnEntries, err := dir.newEntryNames(fileName, nil)
+		if err != nil {
+			return err
+		}
+
+		size := uint64(len(f.chain)) * bpc
+		if size > 0xFFFFFFFF {
+			size = 0xFFFFFFFF
+		}
+
+		now := time.Now()
+		shortEntry.cluster = f.Cluster
+		shortEntry.fileSize = uint32(size)
+		shortEntry.accessTime = now
+		shortEntry.createTime = now
+		shortEntry.writeTime = now
+		if err := dir.appendEntries(lfnEntries, shortEntry); err != nil {
+			return err
+		}
+
+		r.action(f, fmt.Sprintf("save lost chain of %d clusters at cluster %d as /%s/%s",
+			f.Length, f.Cluster, name, fileName))
+	}
+
+	return nil
+}
+
+// dryRunDevice is a BlockDevice that keeps every write in memory, so a
+// dry run sees its own changes without modifying the real device.
+type dryRunDevice struct {
+	fs.BlockDevice
+
+	blocks map[int64][]byte
+}
+
+const dryRunBlockSize = 512
+
+func (d *dryRunDevice) ReadAt(p []byte, off int64) (int, error) {
+	return d.blockIO(p, off, false)
+}
+
+func (d *dryRunDevice) WriteAt(p []byte, off int64) (int, error) {
+	return d.blockIO(p, off, true)
+}
+
+func (d *dryRunDevice) blockIO(p []byte, off int64, write bool) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		blockOff := pos - pos%dryRunBlockSize
+		block, ok := d.blocks[blockOff]
+		if !ok && write {
+			block = make([]byte, dryRunBlockSize)
+			if _, err := d.BlockDevice.ReadAt(block, blockOff); err != nil && err != io.EOF {
+				return n, err
+			}
+
+			d.blocks[blockOff] = block
+		}
+
+		start := int(pos - blockOff)
+		end := start + len(p) - n
+		if end > dryRunBlockSize {
+			end = dryRunBlockSize
+		}
+
+		switch {
+		case write:
+			copy(block[start:end], p[n:])
+		case ok:
+			copy(p[n:], block[start:end])
+		default:
+			if _, err := d.BlockDevice.ReadAt(p[n:n+end-start], pos); err != nil {
+				return n, err
+			}
+		}
+
+		n += end - start
+	}
+
+	return n, nil
+}
@@ -0,0 +1,286 @@
+package fat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	for _, tc := range checkTestDamage {
+		filesys, device := checkTestFileSystem(t)
+		tc.damage(filesys, device)
+
+		var log bytes.Buffer
+		report, err := Repair(device, &RepairOptions{Log: &log})
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		if !report.Written || len(report.Actions) == 0 || len(report.Unrepaired) > 0 {
+			t.Fatalf("%s: bad report: %#v", tc.name, report)
+		}
+
+		if strings.Count(log.String(), "\n") != len(report.Actions) {
+			t.Fatalf("%s: bad log: %s", tc.name, log.String())
+		}
+
+		check, err := Check(device)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		if !check.OK() {
+			t.Fatalf("%s: bad findings after repair: %v", tc.name, check.Findings)
+		}
+	}
+}
+
+func TestRepair_crossLink(t *testing.T) {
+	filesys, device := checkTestFileSystem(t)
+	other := checkTestEntry(filesys, "other.txt").entry.cluster
+	chain := filesys.fat.Chain(checkTestEntry(filesys, "hello.txt").entry.cluster)
+	filesys.fat.setEntry(chain[len(chain)-1], other)
+	filesys.fat.WriteToDevice(device)
+
+	if _, err := Repair(device, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Truncating the chain that is too long resolves the cross-link, so
+	// the other file must be untouched.
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry := checkTestEntry(filesys, "other.txt")
+	if entry.entry.cluster != other || entry.entry.fileSize != 10 {
+		t.Fatalf("bad: %#v", entry.entry)
+	}
+
+	if len(filesys.fat.Chain(checkTestEntry(filesys, "hello.txt").entry.cluster)) != 2 {
+		t.Fatal("chain should be truncated")
+	}
+}
+
+func TestRepair_damagedFAT(t *testing.T) {
+	filesys, device := checkTestFileSystem(t)
+	start := checkTestEntry(filesys, "hello.txt").entry.cluster
+
+	// Break the chain in the first FAT only
+	filesys.fat.setEntry(start, 0)
+	data := filesys.fat.Bytes()
+	device.WriteAt(data, int64(filesys.bs.FATOffset(0)))
+
+	if _, err := Repair(device, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(filesys.fat.Chain(start)) != 2 {
+		t.Fatal("the good FAT should be used")
+	}
+
+	fat1, err := DecodeFAT(device, filesys.bs, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(filesys.fat.Bytes(), fat1.Bytes()) {
+		t.Fatal("FATs should match")
+	}
+}
+
+func TestRepair_collectLost(t *testing.T) {
+	filesys, device := checkTestFileSystem(t)
+	cluster, _ := filesys.fat.AllocChain(1)
+	filesys.fat.ResizeChain(cluster, 3)
+	filesys.fat.WriteToDevice(device)
+
+	_, err := Repair(device, &RepairOptions{CollectLost: true})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	found := rootDir.Entry("FOUND.000")
+	if found == nil {
+		t.Fatal("should have FOUND.000")
+	}
+
+	dir, err := found.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry := dir.Entry("FILE0000.CHK")
+	if entry == nil {
+		t.Fatal("should have FILE0000.CHK")
+	}
+
+	fileEntry := entry.(*DirectoryEntry).entry
+	if fileEntry.cluster != cluster || fileEntry.fileSize != 3*filesys.bs.BytesPerCluster() {
+		t.Fatalf("bad: %#v", fileEntry)
+	}
+
+	check, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !check.OK() {
+		t.Fatalf("bad findings: %v", check.Findings)
+	}
+}
+
+func TestRepair_dryRun(t *testing.T) {
+	for _, tc := range checkTestDamage {
+		filesys, device := checkTestFileSystem(t)
+		tc.damage(filesys, device)
+
+		before := make([]byte, device.Len())
+		device.ReadAt(before, 0)
+
+		report, err := Repair(device, &RepairOptions{DryRun: true, CollectLost: true})
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.name, err)
+		}
+
+		if report.Written || len(report.Actions) == 0 {
+			t.Fatalf("%s: bad report: %#v", tc.name, report)
+		}
+
+		after := make([]byte, device.Len())
+		device.ReadAt(after, 0)
+		if !bytes.Equal(before, after) {
+			t.Fatalf("%s: device should not be modified", tc.name)
+		}
+	}
+}
+
+func TestRepair_emptyFile(t *testing.T) {
+	filesys, device := checkTestFileSystem(t)
+
+	// Point the file at a cluster past the end of the volume, so nothing
+	// is left of its chain
+	entry := checkTestEntry(filesys, "other.txt")
+	filesys.fat.FreeChain(entry.entry.cluster)
+	entry.entry.cluster = filesys.fat.MaxCluster() + 1
+	filesys.fat.WriteToDevice(device)
+	entry.dir.dirCluster.WriteToDevice(device, filesys.fat)
+
+	report, err := Repair(device, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(report.Actions) != 1 || report.Actions[0].Description != "truncate to 0 bytes" {
+		t.Fatalf("bad report: %#v", report)
+	}
+
+	// The repaired file has no clusters, and must grow a new chain
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := checkTestEntry(filesys, "other.txt").File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.Write([]byte("hello world")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err = checkTestEntry(filesys, "other.txt").File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Fatalf("bad contents: %q", data)
+	}
+
+	check, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !check.OK() {
+		t.Fatalf("bad findings: %v", check.Findings)
+	}
+}
+
+func TestRepair_fsInfo(t *testing.T) {
+	for _, collect := range []bool{false, true} {
+		filesys, device := testFileSystem(t, FAT32, 64*1024*1024)
+		checkTestFiles(t, filesys)
+
+		// A lost chain, which the FSInfo free count doesn't include
+		if _, err := filesys.fat.AllocChain(3); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := filesys.fat.WriteToDevice(device); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, err := Repair(device, &RepairOptions{CollectLost: collect}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		filesys, err := New(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		stat, err := filesys.Stat()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		bs32, err := DecodeBootSectorFat32(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		fsInfo, err := DecodeFSInfo(device, bs32)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if fsInfo.FreeCount != stat.FreeClusters {
+			t.Fatalf("collect %t: bad free count: %d, expected %d", collect, fsInfo.FreeCount, stat.FreeClusters)
+		}
+
+		if fsInfo.NextFree == FSInfoUnknown || !filesys.fat.IsFree(fsInfo.NextFree+1) {
+			t.Fatalf("collect %t: bad next free: %d", collect, fsInfo.NextFree)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package fat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// Stat returns statistics about the volume. See fs.StatFileSystem.
+//
+// The label is taken from the volume ID entry of the root directory,
+// which is what Windows shows, and falls back to the label in the boot
+// sector.
+func (f *FileSystem) Stat() (*fs.FileSystemStat, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	result := &fs.FileSystemStat{
+		Type:            f.bs.FATType().String(),
+		BytesPerCluster: f.bs.BytesPerCluster(),
+		TotalClusters:   f.bs.ClusterCount(),
+	}
+
+	last := f.bs.ClusterCount() + FirstCluster
+	if last > uint32(len(f.fat.entries)) {
+		last = uint32(len(f.fat.entries))
+	}
+
+	for cluster := uint32(FirstCluster); cluster < last; cluster++ {
+		switch f.fat.entries[cluster] {
+		case 0:
+			result.FreeClusters++
+		case f.fat.badCluster():
+			result.BadClusters++
+		}
+	}
+
+	if f.bs.FATType() == FAT32 {
+		bs32, err := DecodeBootSectorFat32(f.device)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Label = bs32.VolumeLabel
+		result.VolumeID = bs32.VolumeID
+	} else {
+		bs16, err := DecodeBootSectorFat16(f.device)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Label = bs16.VolumeLabel
+		result.VolumeID = bs16.VolumeID
+	}
+
+	for _, entry := range f.rootDir.entries {
+		if entry.IsVolumeId() && !entry.IsLong() && !entry.deleted {
+			result.Label = strings.TrimRight(fmt.Sprintf("%-8s%s", entry.name, entry.ext), " ")
+			break
+		}
+	}
+
+	// "NO NAME" is what formatters write when there is no label
+	if result.Label == "NO NAME" {
+		result.Label = ""
+	}
+
+	count, err := f.countEntries(f.rootDir, make(map[uint32]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	result.DirectoryEntries = count
+	return result, nil
+}
+
+// countEntries returns the number of entries in use in the directory
+// and all the directories below it.
+func (f *FileSystem) countEntries(dir *DirectoryCluster, visited map[uint32]bool) (int, error) {
+	result := 0
+	for _, entry := range dir.entries {
+		if entry.deleted {
+			continue
+		}
+
+		result++
+		if entry.IsLong() || entry.attr&AttrDirectory == 0 ||
+			entry.name == "." || entry.name == ".." {
+			continue
+		}
+
+		// Guard against directories that contain themselves
+		if entry.cluster < FirstCluster || visited[entry.cluster] {
+			continue
+		}
+
+		visited[entry.cluster] = true
+		subDir, err := DecodeDirectoryCluster(entry.cluster, f.device, f.fat)
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := f.countEntries(subDir, visited)
+		if err != nil {
+			return 0, err
+		}
+
+		result += count
+	}
+
+	return result, nil
+}
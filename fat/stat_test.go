@@ -0,0 +1,83 @@
+package fat
+
+import (
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestFileSystem_Stat(t *testing.T) {
+	var raw interface{}
+	raw = new(FileSystem)
+	if _, ok := raw.(fs.StatFileSystem); !ok {
+		t.Fatal("should be a StatFileSystem")
+	}
+
+	for _, fatType := range []FATType{FAT16, FAT32} {
+		size := int64(16 * 1024 * 1024)
+		if fatType == FAT32 {
+			size = 64 * 1024 * 1024
+		}
+
+		device := testDevice(t, size)
+		config := &SuperFloppyConfig{FATType: fatType, Label: "GO-FS"}
+		if err := FormatSuperFloppy(device, config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		filesys, err := New(device)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		before, err := filesys.Stat()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		rootDir, err := filesys.RootDir()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// A long name, a short name and a directory with "." and ".."
+		if _, err := rootDir.AddFile("a long file name.txt"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, err := rootDir.AddFile("SHORT.TXT"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, err := rootDir.AddDirectory("DIR"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		stat, err := filesys.Stat()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if stat.Type != fatType.String() || stat.Label != "GO-FS" {
+			t.Fatalf("bad: %#v", stat)
+		}
+
+		if stat.TotalClusters != filesys.bs.ClusterCount() || stat.BytesPerCluster != filesys.bs.BytesPerCluster() {
+			t.Fatalf("bad: %#v", stat)
+		}
+
+		if stat.FreeClusters != before.FreeClusters-3 || stat.BadClusters != 0 {
+			t.Fatalf("bad: %#v", stat)
+		}
+
+		if stat.FreeBytes() != int64(stat.FreeClusters)*int64(stat.BytesPerCluster) {
+			t.Fatalf("bad: %d", stat.FreeBytes())
+		}
+
+		// Volume ID, 3 for the long name, 1 for the short name, 1 for the
+		// directory and 2 for its dot entries
+		if stat.DirectoryEntries != before.DirectoryEntries+7 {
+			t.Fatalf("bad: %d %d", before.DirectoryEntries, stat.DirectoryEntries)
+		}
+	}
+}
@@ -20,6 +20,13 @@ type SuperFloppyConfig struct {
 
 	// The OEM name for the FAT filesystem. Defaults to "gofs" if not set.
 	OEMName string
+
+	// The drive geometry recorded in the boot sector, for software that
+	// still addresses the disk with CHS. Defaults to 16 heads and 32
+	// sectors per track. A partition should use the geometry of the CHS
+	// fields in its partition table.
+	NumHeads        uint16
+	SectorsPerTrack uint16
 }
 
 // Formats an fs.BlockDevice with the "super floppy" format according
@@ -35,11 +42,28 @@ func FormatSuperFloppy(device fs.BlockDevice, config *SuperFloppyConfig) error {
 	return formatter.format()
 }
 
+// FormatPartition formats a single partition of a disk with a FAT file
+// system, the same way FormatSuperFloppy formats a whole device. The
+// device is just the partition, such as one returned by
+// fs.NewSectionDevice, and startLBA is its first sector on the disk,
+// which is recorded in the boot sector as BPB_HiddSec. The partition
+// table itself is not written.
+func FormatPartition(device fs.BlockDevice, startLBA uint32, config *SuperFloppyConfig) error {
+	formatter := &superFloppyFormatter{
+		config:        config,
+		device:        device,
+		hiddenSectors: startLBA,
+	}
+
+	return formatter.format()
+}
+
 // An internal struct that helps maintain state and perform calculations
 // during a single formatting pass.
 type superFloppyFormatter struct {
-	config *SuperFloppyConfig
-	device fs.BlockDevice
+	config        *SuperFloppyConfig
+	device        fs.BlockDevice
+	hiddenSectors uint32
 }
 
 func (f *superFloppyFormatter) format() error {
@@ -52,6 +76,7 @@ func (f *superFloppyFormatter) format() error {
 
 	bsCommon := BootSectorCommon{
 		BytesPerSector:      uint16(f.device.SectorSize()),
+		HiddenSectors:       f.hiddenSectors,
 		Media:               MediaFixed,
 		NumFATs:             2,
 		NumHeads:            16,
@@ -62,6 +87,14 @@ func (f *superFloppyFormatter) format() error {
 		TotalSectors:        uint32(f.device.Len() / int64(f.device.SectorSize())),
 	}
 
+	if f.config.NumHeads != 0 {
+		bsCommon.NumHeads = f.config.NumHeads
+	}
+
+	if f.config.SectorsPerTrack != 0 {
+		bsCommon.SectorsPerTrack = f.config.SectorsPerTrack
+	}
+
 	// Next, fill in the FAT-type specific boot sector information
 	switch f.config.FATType {
 	case FAT12, FAT16:
@@ -109,35 +142,38 @@ func (f *superFloppyFormatter) format() error {
 		}
 	case FAT32:
 		bsCommon.SectorsPerFat = f.sectorsPerFat(0, sectorsPerCluster)
+	default:
+		return fmt.Errorf("Unknown FAT type: %d", f.config.FATType)
+	}
+
+	// Create the FATs
+	fat, err := NewFAT(&bsCommon)
+	if err != nil {
+		return err
+	}
+
+	var rootCluster uint32
+	if f.config.FATType == FAT32 {
+		// The FAT32 root directory is a normal cluster chain, so it
+		// has to be allocated before the FAT is written.
+		rootCluster, err = fat.AllocChain(1)
+		if err != nil {
+			return err
+		}
 
 		bs := &BootSectorFat32{
 			BootSectorCommon:    bsCommon,
+			BackupBootSector:    6,
 			FileSystemTypeLabel: "FAT32   ",
 			FSInfoSector:        1,
+			RootCluster:         rootCluster,
 			VolumeID:            uint32(time.Now().Unix()),
 			VolumeLabel:         f.config.Label,
 		}
 
-		// Write the boot sector
-		bsBytes, err := bs.Bytes()
-		if err != nil {
-			return err
-		}
-
-		if _, err := f.device.WriteAt(bsBytes, 0); err != nil {
+		if err := f.writeFat32BootSectors(bs); err != nil {
 			return err
 		}
-
-		// TODO(mitchellh): Create the fsinfo structure
-		// TODO(mitchellh): write the boot sector copy
-	default:
-		return fmt.Errorf("Unknown FAT type: %d", f.config.FATType)
-	}
-
-	// Create the FATs
-	fat, err := NewFAT(&bsCommon)
-	if err != nil {
-		return err
 	}
 
 	// Write the FAT
@@ -147,7 +183,22 @@ func (f *superFloppyFormatter) format() error {
 
 	var rootDir *DirectoryCluster
 	if f.config.FATType == FAT32 {
-		panic("TODO")
+		rootDir, err = NewFat32RootDirectoryCluster(rootCluster, f.config.Label)
+		if err != nil {
+			return err
+		}
+
+		// Zero out the cluster so that no garbage is mistaken for
+		// directory entries.
+		empty := make([]byte, bsCommon.BytesPerCluster())
+		offset := bsCommon.ClusterOffset(int(rootCluster))
+		if _, err := f.device.WriteAt(empty, offset); err != nil {
+			return err
+		}
+
+		if err := rootDir.WriteToDevice(f.device, fat); err != nil {
+			return err
+		}
 	} else {
 		rootDir, err = NewFat16RootDirectoryCluster(&bsCommon, f.config.Label)
 		if err != nil {
@@ -163,6 +214,44 @@ func (f *superFloppyFormatter) format() error {
 	return nil
 }
 
+// writeFat32BootSectors writes the boot sector, the FSInfo sector and
+// the backup copies of both to the device. The rest of the reserved
+// sectors are zeroed, so that nothing of an earlier format is left.
+func (f *superFloppyFormatter) writeFat32BootSectors(bs *BootSectorFat32) error {
+	bsBytes, err := bs.Bytes()
+	if err != nil {
+		return err
+	}
+
+	reserved := make([]byte, int(bs.ReservedSectorCount)*int(bs.BytesPerSector))
+	if _, err := f.device.WriteAt(reserved, 0); err != nil {
+		return err
+	}
+
+	// All of the clusters are free except for the root directory, which
+	// is the last allocated cluster
+	fsInfo := &FSInfo{
+		FreeCount: bs.ClusterCount() - 1,
+		NextFree:  bs.RootCluster,
+	}
+	fsInfoBytes := fsInfo.Bytes()
+
+	bytesPerSector := int64(bs.BytesPerSector)
+	for _, sector := range []uint16{0, bs.BackupBootSector} {
+		offset := int64(sector) * bytesPerSector
+		if _, err := f.device.WriteAt(bsBytes, offset); err != nil {
+			return err
+		}
+
+		offset += int64(bs.FSInfoSector) * bytesPerSector
+		if _, err := f.device.WriteAt(fsInfoBytes, offset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (f *superFloppyFormatter) ReservedSectorCount() uint16 {
 	if f.config.FATType == FAT32 {
 		return 32
@@ -0,0 +1,166 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFormatSuperFloppy_FAT32(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+
+	config := &SuperFloppyConfig{
+		FATType: FAT32,
+		Label:   "GOFS",
+		OEMName: "gofs",
+	}
+	if err := FormatSuperFloppy(device, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSectorFat32(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if bs.FATType() != FAT32 {
+		t.Fatalf("bad FAT type: %d", bs.FATType())
+	}
+
+	if bs.RootCluster != FirstCluster {
+		t.Fatalf("bad root cluster: %d", bs.RootCluster)
+	}
+
+	// The backup boot sector must match the primary
+	primary := make([]byte, 512)
+	backup := make([]byte, 512)
+	if _, err := device.ReadAt(primary, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := device.ReadAt(backup, int64(bs.BackupBootSector)*512); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(primary, backup) {
+		t.Fatal("backup boot sector should match primary")
+	}
+
+	// The FSInfo sector must have valid signatures
+	fsInfo := make([]byte, 512)
+	if _, err := device.ReadAt(fsInfo, int64(bs.FSInfoSector)*512); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if binary.LittleEndian.Uint32(fsInfo[0:4]) != 0x41615252 {
+		t.Fatal("bad FSInfo lead signature")
+	}
+	if binary.LittleEndian.Uint32(fsInfo[488:492]) != bs.ClusterCount()-1 {
+		t.Fatal("bad FSInfo free count")
+	}
+	if binary.LittleEndian.Uint32(fsInfo[492:496]) != bs.RootCluster {
+		t.Fatal("FSInfo next free should be the last allocated cluster")
+	}
+
+	// The filesystem should be usable
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("hello.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := io.WriteString(file, "hello"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(rootDir.Entries()) != 1 {
+		t.Fatalf("bad entries: %#v", rootDir.Entries())
+	}
+
+	if rootDir.Entry("HELLO.TXT") == nil {
+		t.Fatal("file should exist")
+	}
+}
+
+func TestFormatSuperFloppy_FAT32ReservedSectors(t *testing.T) {
+	device := testDevice(t, 64*1024*1024)
+
+	// Garbage from whatever used the device before
+	garbage := bytes.Repeat([]byte{0xAB}, 32*512)
+	if _, err := device.WriteAt(garbage, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSectorFat32(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	written := map[int64]bool{0: true, 1: true, 6: true, 7: true}
+	sector := make([]byte, 512)
+	for i := int64(0); i < int64(bs.ReservedSectorCount); i++ {
+		if written[i] {
+			continue
+		}
+
+		if _, err := device.ReadAt(sector, i*512); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if !bytes.Equal(sector, make([]byte, 512)) {
+			t.Fatalf("reserved sector %d should be zero", i)
+		}
+	}
+}
+
+func TestFormatPartition(t *testing.T) {
+	device := testDevice(t, 16*1024*1024)
+
+	config := &SuperFloppyConfig{FATType: FAT16, NumHeads: 255, SectorsPerTrack: 63}
+	if err := FormatPartition(device, 2048, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if bs.HiddenSectors != 2048 {
+		t.Fatalf("bad hidden sectors: %d", bs.HiddenSectors)
+	}
+
+	if bs.NumHeads != 255 || bs.SectorsPerTrack != 63 {
+		t.Fatalf("bad geometry: %d %d", bs.NumHeads, bs.SectorsPerTrack)
+	}
+
+	if _, err := New(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,190 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+)
+
+func TestFile_Truncate(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := rootDir.AddFile("config.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rawFile, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file := rawFile.(*File)
+	if _, err := file.Write(bytes.Repeat([]byte("x"), 20000)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	start := file.chain.startCluster
+	bpc := int(filesys.bs.BytesPerCluster())
+	chain := filesys.fat.Chain(start)
+
+	// Shrink the file
+	if err := file.Truncate(10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(filesys.fat.Chain(start)) != 1 {
+		t.Fatalf("bad chain: %#v", filesys.fat.Chain(start))
+	}
+
+	for _, cluster := range chain[1:] {
+		if filesys.fat.entries[cluster] != 0 {
+			t.Fatalf("cluster %d should be free", cluster)
+		}
+	}
+
+	// Grow it again, the new region must be zero
+	if err := file.Truncate(int64(bpc) + 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry = rootDir.Entry("config.txt")
+	if size := entry.(*DirectoryEntry).entry.fileSize; size != uint32(bpc)+100 {
+		t.Fatalf("bad size: %d", size)
+	}
+
+	rawFile, err = entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := make([]byte, bpc+100)
+	if _, err := io.ReadFull(rawFile, data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := append(bytes.Repeat([]byte("x"), 10), make([]byte, bpc+90)...)
+	if !bytes.Equal(data, expected) {
+		t.Fatal("bad contents")
+	}
+}
+
+func TestFile_Truncate_emptyFile(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("empty.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testTruncateEmpty(t, device, "empty.txt")
+}
+
+func TestFile_Truncate_noClusters(t *testing.T) {
+	filesys, device := testFileSystem(t, FAT16, 16*1024*1024)
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := rootDir.AddFile(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Other implementations give empty files no clusters at all
+	entry := rootDir.Entry("a.txt").(*DirectoryEntry)
+	filesys.fat.FreeChain(entry.entry.cluster)
+	entry.entry.cluster = 0
+	if err := filesys.fat.WriteToDevice(device); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := rootDir.(*Directory).dirCluster.WriteToDevice(device, filesys.fat); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testTruncateEmpty(t, device, "a.txt")
+}
+
+// testTruncateEmpty grows the empty file with the given name, writes to
+// it and checks that the data and the file system survive a remount.
+func testTruncateEmpty(t *testing.T, device fs.BlockDevice, name string) {
+	filesys, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err := filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rawFile, err := rootDir.Entry(name).File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file := rawFile.(*File)
+	if err := file.Truncate(11); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := file.WriteAt([]byte("hello world"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, err = filesys.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rawFile, err = rootDir.Entry(name).File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(rawFile)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Fatalf("bad contents: %q", data)
+	}
+
+	report, err := Check(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !report.OK() {
+		t.Fatalf("bad findings: %v", report.Findings)
+	}
+}
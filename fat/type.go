@@ -1,6 +1,10 @@
 package fat
 
-import "github.com/mitchellh/go-fs"
+import (
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
 
 // FATType is a simple enum of the available FAT filesystem types.
 type FATType uint8
@@ -11,6 +15,19 @@ const (
 	FAT32
 )
 
+func (t FATType) String() string {
+	switch t {
+	case FAT12:
+		return "FAT12"
+	case FAT16:
+		return "FAT16"
+	case FAT32:
+		return "FAT32"
+	default:
+		return fmt.Sprintf("FATType(%d)", uint8(t))
+	}
+}
+
 // TypeForDevice determines the usable FAT type based solely on
 // size information about the block device.
 func TypeForDevice(device fs.BlockDevice) FATType {
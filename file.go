@@ -6,4 +6,7 @@ import "io"
 type File interface {
 	io.Reader
 	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.WriterAt
 }
@@ -6,3 +6,47 @@ type FileSystem interface {
 	// RootDir returns the single root directory.
 	RootDir() (Directory, error)
 }
+
+// StatFileSystem is an optional interface implemented by filesystems
+// that can report statistics about their volume.
+type StatFileSystem interface {
+	FileSystem
+
+	// Stat returns statistics about the volume.
+	Stat() (*FileSystemStat, error)
+}
+
+// FileSystemStat holds statistics about the volume of a filesystem, much
+// like statfs(2).
+type FileSystemStat struct {
+	// Type is the type of the filesystem, such as "FAT32".
+	Type string
+
+	// Label and VolumeID identify the volume.
+	Label    string
+	VolumeID uint32
+
+	// BytesPerCluster is the size of the unit of allocation.
+	BytesPerCluster uint32
+
+	// TotalClusters is the number of clusters that can hold data, of
+	// which FreeClusters are free and BadClusters are marked bad.
+	TotalClusters uint32
+	FreeClusters  uint32
+	BadClusters   uint32
+
+	// DirectoryEntries is the number of directory entry slots in use in
+	// all the directories. Long names and other metadata stored in
+	// directories use slots as well.
+	DirectoryEntries int
+}
+
+// TotalBytes returns the number of bytes that the volume can hold.
+func (s *FileSystemStat) TotalBytes() int64 {
+	return int64(s.TotalClusters) * int64(s.BytesPerCluster)
+}
+
+// FreeBytes returns the number of bytes that are free.
+func (s *FileSystemStat) FreeBytes() int64 {
+	return int64(s.FreeClusters) * int64(s.BytesPerCluster)
+}
@@ -0,0 +1,296 @@
+package fs
+
+import (
+	"io"
+	iofs "io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IOFS adapts a FileSystem to the io/fs interfaces of the standard
+// library so that it can be used with fs.WalkDir, http.FS, fstest and
+// friends. The adapter is read-only.
+//
+// Entries that implement DirectoryEntryInfo report their size, mode and
+// modification time, and Sys returns their attributes, such as a
+// fat.DirectoryAttr. Only the directory and read-only attributes show up
+// in the mode, hidden and system entries are listed like any other.
+// Other entries report only whether they are a directory. Volume labels
+// are not entries of a directory, so they are never listed.
+type IOFS struct {
+	fs FileSystem
+}
+
+var (
+	_ iofs.FS         = new(IOFS)
+	_ iofs.ReadDirFS  = new(IOFS)
+	_ iofs.ReadFileFS = new(IOFS)
+	_ iofs.StatFS     = new(IOFS)
+)
+
+// NewIOFS returns an io/fs.FS that reads from the given FileSystem.
+func NewIOFS(fs FileSystem) *IOFS {
+	return &IOFS{fs: fs}
+}
+
+// Open opens the named file or directory. See io/fs.FS.
+func (f *IOFS) Open(name string) (iofs.File, error) {
+	dir, entry, err := f.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := newIOFileInfo(name, entry)
+	if entry == nil || entry.IsDir() {
+		if entry != nil {
+			if dir, err = entry.Dir(); err != nil {
+				return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+
+		return &ioDir{dir: dir, info: info}, nil
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &ioFile{file: file, info: info}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by
+// name. See io/fs.ReadDirFS.
+func (f *IOFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	dir, entry, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil {
+		if !entry.IsDir() {
+			return nil, &iofs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+		}
+
+		if dir, err = entry.Dir(); err != nil {
+			return nil, &iofs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+	}
+
+	return ioDirEntries(dir), nil
+}
+
+// ReadFile reads the entire contents of the named file. See
+// io/fs.ReadFileFS.
+func (f *IOFS) ReadFile(name string) ([]byte, error) {
+	_, entry, err := f.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil || entry.IsDir() {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: errIsDir}
+	}
+
+	file, err := entry.File()
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+
+	return data, nil
+}
+
+// Stat returns information about the named file or directory. See
+// io/fs.StatFS.
+func (f *IOFS) Stat(name string) (iofs.FileInfo, error) {
+	_, entry, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newIOFileInfo(name, entry), nil
+}
+
+// lookup walks the path to the named entry. It returns the directory
+// the entry lives in and the entry itself, which is nil for the root.
+func (f *IOFS) lookup(op, name string) (Directory, DirectoryEntry, error) {
+	if !iofs.ValidPath(name) {
+		return nil, nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+
+	dir, err := f.fs.RootDir()
+	if err != nil {
+		return nil, nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	if name == "." {
+		return dir, nil, nil
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		entry := dir.Entry(part)
+		if entry == nil || part == "." || part == ".." {
+			return nil, nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+		}
+
+		if i == len(parts)-1 {
+			return dir, entry, nil
+		}
+
+		if !entry.IsDir() {
+			return nil, nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+		}
+
+		if dir, err = entry.Dir(); err != nil {
+			return nil, nil, &iofs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+
+	panic("unreachable")
+}
+
+var (
+	errIsDir  = iofsError("is a directory")
+	errNotDir = iofsError("not a directory")
+)
+
+type iofsError string
+
+func (e iofsError) Error() string { return string(e) }
+
+// ioDirEntries returns the entries of the directory sorted by name,
+// without the "." and ".." entries.
+func ioDirEntries(dir Directory) []iofs.DirEntry {
+	entries := dir.Entries()
+	result := make([]iofs.DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+
+		result = append(result, newIOFileInfo(entry.Name(), entry))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+
+	return result
+}
+
+// ioFileInfo implements both io/fs.FileInfo and io/fs.DirEntry.
+type ioFileInfo struct {
+	name    string
+	size    int64
+	mode    iofs.FileMode
+	modTime time.Time
+	sys     interface{}
+}
+
+// newIOFileInfo returns the info of the entry at the given path. The name
+// is the one stored in the directory, which may differ in case from the
+// path on filesystems that ignore case. Only the root, which has no
+// entry, is named after the path.
+func newIOFileInfo(path string, entry DirectoryEntry) *ioFileInfo {
+	if entry == nil {
+		return &ioFileInfo{name: path, mode: iofs.ModeDir | 0777}
+	}
+
+	name := entry.Name()
+
+	if info, ok := entry.(DirectoryEntryInfo); ok {
+		return &ioFileInfo{
+			name:    name,
+			size:    info.Size(),
+			mode:    info.Mode(),
+			modTime: info.ModTime(),
+			sys:     info.Sys(),
+		}
+	}
+
+	result := &ioFileInfo{name: name, mode: 0666}
+	if entry.IsDir() {
+		result.mode = iofs.ModeDir | 0777
+	}
+
+	return result
+}
+
+func (i *ioFileInfo) Name() string                 { return i.name }
+func (i *ioFileInfo) Size() int64                  { return i.size }
+func (i *ioFileInfo) Mode() iofs.FileMode          { return i.mode }
+func (i *ioFileInfo) ModTime() time.Time           { return i.modTime }
+func (i *ioFileInfo) IsDir() bool                  { return i.mode.IsDir() }
+func (i *ioFileInfo) Sys() interface{}             { return i.sys }
+func (i *ioFileInfo) Type() iofs.FileMode          { return i.mode.Type() }
+func (i *ioFileInfo) Info() (iofs.FileInfo, error) { return i, nil }
+
+// ioFile is an open regular file.
+type ioFile struct {
+	file File
+	info *ioFileInfo
+}
+
+func (f *ioFile) Stat() (iofs.FileInfo, error) { return f.info, nil }
+func (f *ioFile) Close() error                 { return nil }
+
+func (f *ioFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+// ioDir is an open directory.
+type ioDir struct {
+	dir     Directory
+	info    *ioFileInfo
+	entries []iofs.DirEntry
+	read    bool
+}
+
+func (d *ioDir) Stat() (iofs.FileInfo, error) { return d.info, nil }
+func (d *ioDir) Close() error                 { return nil }
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+// ReadDir reads the directory entries in name order. See
+// io/fs.ReadDirFile.
+func (d *ioDir) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if !d.read {
+		d.entries = ioDirEntries(d.dir)
+		d.read = true
+	}
+
+	if n <= 0 {
+		result := d.entries
+		d.entries = nil
+		return result, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+
+	result := d.entries[:n]
+	d.entries = d.entries[n:]
+	return result, nil
+}
@@ -0,0 +1,318 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// The size of the pages that a MemoryDisk allocates as it is written.
+const MemoryDiskPageSize = 64 * 1024
+
+// The magic number at the start of a dumped MemoryDisk.
+var memoryDiskMagic = [8]byte{'G', 'O', 'F', 'S', 'M', 'E', 'M', '1'}
+
+// A MemoryDisk is an implementation of a BlockDevice that is kept in
+// memory. Memory is only used for the pages that were written, so a
+// large MemoryDisk costs nothing until it is used. Pages are shared
+// between a MemoryDisk, its snapshots and its clones until one of them
+// writes to the page. It is safe for concurrent use.
+type MemoryDisk struct {
+	lock       sync.RWMutex
+	size       int64
+	sectorSize int
+
+	// pages holds the pages that were written, by index. A page may be
+	// shared with snapshots and clones, and is only changed in place if
+	// owned says it belongs to this disk alone.
+	pages map[int64][]byte
+	owned map[int64]bool
+}
+
+// A MemorySnapshot is the contents of a MemoryDisk at the time
+// MemoryDisk.Snapshot was called. It can be restored any number of times.
+type MemorySnapshot struct {
+	size       int64
+	sectorSize int
+	pages      map[int64][]byte
+}
+
+// NewMemoryDisk creates a new MemoryDisk of the given size in bytes,
+// with 512 byte sectors. It reads as zeros until it is written.
+func NewMemoryDisk(size int64) *MemoryDisk {
+	return &MemoryDisk{
+		size:       size,
+		sectorSize: 512,
+		pages:      make(map[int64][]byte),
+		owned:      make(map[int64]bool),
+	}
+}
+
+// LoadMemoryDisk reads a MemoryDisk that was written with WriteTo.
+func LoadMemoryDisk(r io.Reader) (*MemoryDisk, error) {
+	var header struct {
+		Magic      [8]byte
+		Size       int64
+		SectorSize uint32
+		PageSize   uint32
+		Pages      uint64
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if header.Magic != memoryDiskMagic {
+		return nil, errors.New("not a memory disk dump")
+	}
+
+	if header.PageSize != MemoryDiskPageSize {
+		return nil, fmt.Errorf("unsupported page size: %d", header.PageSize)
+	}
+
+	if header.SectorSize == 0 || header.SectorSize&(header.SectorSize-1) != 0 {
+		return nil, fmt.Errorf("invalid sector size: %d", header.SectorSize)
+	}
+
+	if header.Size < 0 {
+		return nil, fmt.Errorf("invalid size: %d", header.Size)
+	}
+
+	result := NewMemoryDisk(header.Size)
+	result.sectorSize = int(header.SectorSize)
+
+	lastPage := (header.Size - 1) / MemoryDiskPageSize
+	for i := uint64(0); i < header.Pages; i++ {
+		var index int64
+		if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return nil, err
+		}
+
+		if index < 0 || index > lastPage {
+			return nil, fmt.Errorf("page %d out of range", index)
+		}
+
+		page := make([]byte, MemoryDiskPageSize)
+		if _, err := io.ReadFull(r, page); err != nil {
+			return nil, err
+		}
+
+		result.pages[index] = page
+		result.owned[index] = true
+	}
+
+	return result, nil
+}
+
+func (d *MemoryDisk) Close() error {
+	return nil
+}
+
+func (d *MemoryDisk) Len() int64 {
+	return d.size
+}
+
+func (d *MemoryDisk) SectorSize() int {
+	return d.sectorSize
+}
+
+func (d *MemoryDisk) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if off >= d.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > d.size-off {
+		p = p[:d.size-off]
+		err = io.EOF
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / MemoryDiskPageSize
+		start := pos % MemoryDiskPageSize
+		end := start + int64(len(p)-n)
+		if end > MemoryDiskPageSize {
+			end = MemoryDiskPageSize
+		}
+
+		if page, ok := d.pages[index]; ok {
+			copy(p[n:], page[start:end])
+		} else {
+			zero(p[n : n+int(end-start)])
+		}
+
+		n += int(end - start)
+	}
+
+	return n, err
+}
+
+func (d *MemoryDisk) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if off+int64(len(p)) > d.size {
+		return 0, errors.New("write past the end of the device")
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / MemoryDiskPageSize
+		start := pos % MemoryDiskPageSize
+
+		n += copy(d.page(index)[start:], p[n:])
+	}
+
+	return n, nil
+}
+
+// Snapshot returns the current contents of the disk, which can be
+// restored later with Restore. It doesn't copy any data.
+func (d *MemoryDisk) Snapshot() *MemorySnapshot {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return &MemorySnapshot{
+		size:       d.size,
+		sectorSize: d.sectorSize,
+		pages:      d.share(),
+	}
+}
+
+// Restore sets the contents of the disk back to the given snapshot,
+// which may also be the snapshot of another disk.
+func (d *MemoryDisk) Restore(snapshot *MemorySnapshot) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.size = snapshot.size
+	d.sectorSize = snapshot.sectorSize
+	d.pages = make(map[int64][]byte, len(snapshot.pages))
+	d.owned = make(map[int64]bool)
+	for index, page := range snapshot.pages {
+		d.pages[index] = page
+	}
+}
+
+// Clone returns a new MemoryDisk with the same contents as this one.
+// Both disks share their pages until one of them writes to a page, so
+// cloning is cheap no matter the size of the disk.
+func (d *MemoryDisk) Clone() *MemoryDisk {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return &MemoryDisk{
+		size:       d.size,
+		sectorSize: d.sectorSize,
+		pages:      d.share(),
+		owned:      make(map[int64]bool),
+	}
+}
+
+// WriteTo dumps the disk to the given writer, so that it can be loaded
+// again with LoadMemoryDisk. Only the pages that were written are
+// dumped. See io.WriterTo.
+func (d *MemoryDisk) WriteTo(w io.Writer) (int64, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	indexes := make([]int64, 0, len(d.pages))
+	for index := range d.pages {
+		indexes = append(indexes, index)
+	}
+
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+
+	counter := &countingWriter{w: w}
+	bw := bufio.NewWriter(counter)
+	header := []interface{}{
+		memoryDiskMagic,
+		d.size,
+		uint32(d.sectorSize),
+		uint32(MemoryDiskPageSize),
+		uint64(len(indexes)),
+	}
+
+	for _, field := range header {
+		if err := binary.Write(bw, binary.LittleEndian, field); err != nil {
+			return counter.n, err
+		}
+	}
+
+	for _, index := range indexes {
+		if err := binary.Write(bw, binary.LittleEndian, index); err != nil {
+			return counter.n, err
+		}
+
+		if _, err := bw.Write(d.pages[index]); err != nil {
+			return counter.n, err
+		}
+	}
+
+	err := bw.Flush()
+	return counter.n, err
+}
+
+// page returns the page with the given index for writing, allocating it
+// or copying it first if it isn't owned by this disk.
+func (d *MemoryDisk) page(index int64) []byte {
+	if d.owned[index] {
+		return d.pages[index]
+	}
+
+	page := make([]byte, MemoryDiskPageSize)
+	if shared, ok := d.pages[index]; ok {
+		copy(page, shared)
+	}
+
+	d.pages[index] = page
+	d.owned[index] = true
+	return page
+}
+
+// share returns a copy of the page map and gives up ownership of every
+// page, since they are now shared.
+func (d *MemoryDisk) share() map[int64][]byte {
+	result := make(map[int64][]byte, len(d.pages))
+	for index, page := range d.pages {
+		result[index] = page
+	}
+
+	d.owned = make(map[int64]bool)
+	return result
+}
+
+// countingWriter counts the bytes written to the writer it wraps.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
@@ -0,0 +1,168 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryDiskImplementsBlockDevice(t *testing.T) {
+	var raw interface{}
+	raw = new(MemoryDisk)
+	if _, ok := raw.(BlockDevice); !ok {
+		t.Fatal("MemoryDisk should be a BlockDevice")
+	}
+}
+
+func TestMemoryDisk_sparse(t *testing.T) {
+	disk := NewMemoryDisk(32 * 1024 * 1024 * 1024)
+	if disk.Len() != 32*1024*1024*1024 || disk.SectorSize() != 512 {
+		t.Fatalf("bad: %d %d", disk.Len(), disk.SectorSize())
+	}
+
+	// A write across a page boundary
+	data := bytes.Repeat([]byte("x"), 100)
+	off := int64(10*MemoryDiskPageSize - 50)
+	if _, err := disk.WriteAt(data, off); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(disk.pages) != 2 {
+		t.Fatalf("bad pages: %d", len(disk.pages))
+	}
+
+	result := make([]byte, 200)
+	if _, err := disk.ReadAt(result, off-50); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := append(make([]byte, 50), data...)
+	expected = append(expected, make([]byte, 50)...)
+	if !bytes.Equal(result, expected) {
+		t.Fatal("bad data")
+	}
+
+	if _, err := disk.WriteAt(data, disk.Len()-10); err == nil {
+		t.Fatal("should not write past the end")
+	}
+
+	n, err := disk.ReadAt(result, disk.Len()-10)
+	if n != 10 || err == nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
+
+func TestMemoryDisk_Snapshot(t *testing.T) {
+	disk := NewMemoryDisk(1024 * 1024)
+	disk.WriteAt([]byte("before"), 0)
+
+	snapshot := disk.Snapshot()
+	disk.WriteAt([]byte("after!"), 0)
+	disk.WriteAt([]byte("new"), 500000)
+
+	disk.Restore(snapshot)
+	data := make([]byte, 6)
+	disk.ReadAt(data, 0)
+	if string(data) != "before" {
+		t.Fatalf("bad data: %q", data)
+	}
+
+	disk.ReadAt(data, 500000)
+	if !bytes.Equal(data, make([]byte, 6)) {
+		t.Fatalf("bad data: %q", data)
+	}
+
+	// Writing after a restore doesn't change the snapshot
+	disk.WriteAt([]byte("again!"), 0)
+	disk.Restore(snapshot)
+	disk.ReadAt(data, 0)
+	if string(data) != "before" {
+		t.Fatalf("bad data: %q", data)
+	}
+}
+
+func TestMemoryDisk_Clone(t *testing.T) {
+	disk := NewMemoryDisk(1024 * 1024)
+	disk.WriteAt([]byte("shared"), 0)
+
+	clone := disk.Clone()
+	clone.WriteAt([]byte("clone!"), 0)
+	disk.WriteAt([]byte("disk!!"), 0)
+
+	data := make([]byte, 6)
+	disk.ReadAt(data, 0)
+	if string(data) != "disk!!" {
+		t.Fatalf("bad data: %q", data)
+	}
+
+	clone.ReadAt(data, 0)
+	if string(data) != "clone!" {
+		t.Fatalf("bad data: %q", data)
+	}
+}
+
+func TestMemoryDisk_WriteTo(t *testing.T) {
+	disk := NewMemoryDisk(16 * 1024 * 1024)
+	disk.WriteAt([]byte("start"), 0)
+	disk.WriteAt([]byte("end"), disk.Len()-3)
+
+	var buf bytes.Buffer
+	n, err := disk.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the two pages that were written are dumped
+	if n != int64(buf.Len()) || n > 3*MemoryDiskPageSize {
+		t.Fatalf("bad size: %d %d", n, buf.Len())
+	}
+
+	loaded, err := LoadMemoryDisk(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if loaded.Len() != disk.Len() {
+		t.Fatalf("bad len: %d", loaded.Len())
+	}
+
+	for _, off := range []int64{0, 1000, disk.Len() - MemoryDiskPageSize} {
+		expected := make([]byte, MemoryDiskPageSize)
+		actual := make([]byte, MemoryDiskPageSize)
+		disk.ReadAt(expected, off)
+		loaded.ReadAt(actual, off)
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("bad data at %d", off)
+		}
+	}
+
+	if _, err := LoadMemoryDisk(bytes.NewReader([]byte("garbage data"))); err == nil {
+		t.Fatal("should error on bad data")
+	}
+}
+
+func TestLoadMemoryDisk_invalidHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewMemoryDisk(1024 * 1024).WriteTo(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		off   int
+		value []byte
+	}{
+		// A sector size of 0, and one that isn't a power of two
+		{16, []byte{0, 0, 0, 0}},
+		{16, []byte{0, 3, 0, 0}},
+
+		// A negative size
+		{8, []byte{0, 0, 0, 0, 0, 0, 0, 0x80}},
+	}
+
+	for _, c := range cases {
+		data := append([]byte(nil), buf.Bytes()...)
+		copy(data[c.off:], c.value)
+		if _, err := LoadMemoryDisk(bytes.NewReader(data)); err == nil {
+			t.Fatalf("should error on % X at %d", c.value, c.off)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package partition formats whole disk images with a partition table
+// and a FAT file system in each partition. The partition tables are read
+// and edited with the mbr and gpt packages.
+package partition
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+	"github.com/mitchellh/go-fs/partition/gpt"
+	"github.com/mitchellh/go-fs/partition/mbr"
+)
+
+// Scheme is the kind of partition table that is written.
+type Scheme int
+
+const (
+	MBR Scheme = iota
+	GPT
+)
+
+// Partitions are aligned to 1MB, the way current partitioning tools
+// align them.
+const Alignment = 1024 * 1024
+
+// Layout describes the partitions of a disk.
+type Layout struct {
+	Scheme Scheme
+
+	// Partitions are laid out in order from the start of the disk. An MBR
+	// holds at most four of them.
+	Partitions []*Partition
+}
+
+// Partition describes a single FAT partition of a Layout.
+type Partition struct {
+	// Sectors is the length of the partition. If it is 0, the partition
+	// takes the rest of the disk, which is only allowed for the last one.
+	Sectors uint64
+
+	// Config is the configuration of the FAT file system.
+	Config *fat.SuperFloppyConfig
+
+	// Bootable sets the boot flag in an MBR, or the legacy BIOS bootable
+	// attribute in a GPT.
+	Bootable bool
+
+	// Type is the partition type in a GPT. Defaults to
+	// gpt.TypeMicrosoftBasicData. In an MBR the type follows from the
+	// FAT type and the location of the partition.
+	Type gpt.GUID
+
+	// Name is the name of the partition in a GPT.
+	Name string
+}
+
+// Format writes the partition table of the layout to the device, which
+// is a whole disk, then formats every partition with its FAT file
+// system. Unlike FormatSuperFloppy this gives an image that also boots
+// on firmware that expects a partitioned disk.
+func Format(device fs.BlockDevice, layout *Layout) error {
+	if len(layout.Partitions) == 0 {
+		return errors.New("layout has no partitions")
+	}
+
+	for i, p := range layout.Partitions {
+		if p.Config == nil {
+			return fmt.Errorf("partition %d has no FAT configuration", i+1)
+		}
+
+		if p.Sectors == 0 && i != len(layout.Partitions)-1 {
+			return errors.New("only the last partition can take the rest of the disk")
+		}
+	}
+
+	var extents []extent
+	var err error
+	switch layout.Scheme {
+	case MBR:
+		extents, err = writeMBR(device, layout)
+	case GPT:
+		extents, err = writeGPT(device, layout)
+	default:
+		return fmt.Errorf("unknown partition scheme: %d", layout.Scheme)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	sectorSize := int64(device.SectorSize())
+	for i, p := range layout.Partitions {
+		e := extents[i]
+		part, err := fs.NewSectionDevice(device, int64(e.first)*sectorSize, int64(e.sectors)*sectorSize)
+		if err != nil {
+			return err
+		}
+
+		if e.first > 0xFFFFFFFF {
+			return fmt.Errorf("partition %d starts past the sectors a FAT boot sector can address", i+1)
+		}
+
+		// The boot sector records the same geometry as the CHS fields of
+		// the MBR, or of the protective MBR of a GPT
+		config := *p.Config
+		config.NumHeads = mbr.Heads
+		config.SectorsPerTrack = mbr.SectorsPerTrack
+
+		if err := fat.FormatPartition(part, uint32(e.first), &config); err != nil {
+			return fmt.Errorf("partition %d: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// extent is the sectors of the disk that a partition was given.
+type extent struct {
+	first   uint64
+	sectors uint64
+}
+
+// writeMBR writes an MBR with the partitions of the layout as primary
+// partitions, and returns where each of them is.
+func writeMBR(device fs.BlockDevice, layout *Layout) ([]extent, error) {
+	if len(layout.Partitions) > 4 {
+		return nil, errors.New("an MBR holds at most four partitions")
+	}
+
+	var signature [4]byte
+	if _, err := rand.Read(signature[:]); err != nil {
+		return nil, err
+	}
+
+	table := &mbr.MBR{DiskSignature: binary.LittleEndian.Uint32(signature[:])}
+
+	align := uint64(Alignment / device.SectorSize())
+	sectors := uint64(device.Len()) / uint64(device.SectorSize())
+	extents := make([]extent, len(layout.Partitions))
+	first := align
+	for i, p := range layout.Partitions {
+		length := p.Sectors
+		if length == 0 && first < sectors {
+			length = sectors - first
+		}
+
+		if length == 0 || first+length > sectors {
+			return nil, fmt.Errorf("partition %d doesn't fit on the disk", i+1)
+		}
+
+		if first+length > 0xFFFFFFFF {
+			return nil, fmt.Errorf("partition %d is past the sectors an MBR can address", i+1)
+		}
+
+		last := first + length - 1
+		table.Entries[i] = mbr.Entry{
+			Bootable: p.Bootable,
+			FirstCHS: mbr.CHS(first),
+			Type:     mbrType(p.Config.FATType, last, length),
+			LastCHS:  mbr.CHS(last),
+			StartLBA: uint32(first),
+			Sectors:  uint32(length),
+		}
+
+		extents[i] = extent{first, length}
+		first = (last + align) / align * align
+	}
+
+	// Clear the headers of a GPT the disk held before, so that the disk
+	// isn't taken for a GPT disk with a damaged protective MBR
+	zeros := make([]byte, device.SectorSize())
+	for _, lba := range []uint64{1, sectors - 1} {
+		if _, err := device.WriteAt(zeros, int64(lba)*int64(len(zeros))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := table.WriteToDevice(device); err != nil {
+		return nil, err
+	}
+
+	return extents, nil
+}
+
+// writeGPT writes a GPT with the partitions of the layout, and returns
+// where each of them is.
+func writeGPT(device fs.BlockDevice, layout *Layout) ([]extent, error) {
+	table, err := gpt.New(device)
+	if err != nil {
+		return nil, err
+	}
+
+	extents := make([]extent, len(layout.Partitions))
+	for i, p := range layout.Partitions {
+		// A partition that takes the rest of the disk needs at least one
+		// sector to start with
+		length := p.Sectors
+		if length == 0 {
+			length = 1
+		}
+
+		first, err := table.Allocate(length)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %s", i+1, err)
+		}
+
+		if p.Sectors == 0 {
+			length = table.Header.LastUsableLBA - first + 1
+		}
+
+		entry := &gpt.Partition{
+			Type:     p.Type,
+			FirstLBA: first,
+			LastLBA:  first + length - 1,
+			Name:     p.Name,
+		}
+
+		if entry.Type == gpt.TypeUnused {
+			entry.Type = gpt.TypeMicrosoftBasicData
+		}
+
+		if p.Bootable {
+			entry.Attributes |= gpt.AttrLegacyBIOSBootable
+		}
+
+		if err := table.Add(entry); err != nil {
+			return nil, fmt.Errorf("partition %d: %s", i+1, err)
+		}
+
+		extents[i] = extent{first, length}
+	}
+
+	if err := table.WriteToDevice(device); err != nil {
+		return nil, err
+	}
+
+	return extents, nil
+}
+
+// mbrType returns the MBR partition type for a FAT partition. The LBA
+// types are used when the partition ends past what CHS can address.
+func mbrType(fatType fat.FATType, last, sectors uint64) byte {
+	lba := last >= mbr.CHSLimit
+
+	switch fatType {
+	case fat.FAT12:
+		return mbr.TypeFAT12
+	case fat.FAT16:
+		if lba {
+			return mbr.TypeFAT16LBA
+		} else if sectors < 65536 {
+			return mbr.TypeFAT16Small
+		}
+
+		return mbr.TypeFAT16
+	default:
+		if lba {
+			return mbr.TypeFAT32LBA
+		}
+
+		return mbr.TypeFAT32
+	}
+}
@@ -0,0 +1,194 @@
+package partition
+
+import (
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+	"github.com/mitchellh/go-fs/partition/gpt"
+	"github.com/mitchellh/go-fs/partition/mbr"
+)
+
+func TestFormat_MBR(t *testing.T) {
+	disk := fs.NewMemoryDisk(128 * 1024 * 1024)
+
+	layout := &Layout{
+		Scheme: MBR,
+		Partitions: []*Partition{
+			{Bootable: true, Config: &fat.SuperFloppyConfig{FATType: fat.FAT32, Label: "BOOT"}},
+		},
+	}
+
+	if err := Format(disk, layout); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	m, err := mbr.Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := mbr.Partition{
+		Number:   1,
+		Bootable: true,
+		Type:     mbr.TypeFAT32,
+		StartLBA: 2048,
+		Sectors:  262144 - 2048,
+	}
+
+	if len(m.Partitions) != 1 || *m.Partitions[0] != expected {
+		t.Fatalf("bad partitions: %v", m.Partitions)
+	}
+
+	if m.Entries[0].FirstCHS != mbr.CHS(2048) {
+		t.Fatalf("bad CHS: % X", m.Entries[0].FirstCHS)
+	}
+
+	testFormatPartition(t, disk, 2048, 262144-2048, fat.FAT32)
+}
+
+func TestFormat_GPT(t *testing.T) {
+	disk := fs.NewMemoryDisk(128 * 1024 * 1024)
+
+	layout := &Layout{
+		Scheme: GPT,
+		Partitions: []*Partition{
+			{Sectors: 32768, Type: gpt.TypeEFISystem, Name: "EFI", Config: &fat.SuperFloppyConfig{FATType: fat.FAT16}},
+			{Config: &fat.SuperFloppyConfig{FATType: fat.FAT32}},
+		},
+	}
+
+	if err := Format(disk, layout); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	table, err := gpt.Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if table.PrimaryErr != nil || table.BackupErr != nil || len(table.Partitions) != 2 {
+		t.Fatalf("bad table: %v", table.Partitions)
+	}
+
+	efi, data := table.Partition(1), table.Partition(2)
+	if efi.Type != gpt.TypeEFISystem || efi.Name != "EFI" || efi.FirstLBA != 2048 {
+		t.Fatalf("bad partition: %s", efi)
+	}
+
+	if data.Type != gpt.TypeMicrosoftBasicData || data.FirstLBA != 2048+32768 ||
+		data.LastLBA != table.Header.LastUsableLBA {
+		t.Fatalf("bad partition: %s", data)
+	}
+
+	testFormatPartition(t, disk, efi.FirstLBA, efi.Sectors(), fat.FAT16)
+	testFormatPartition(t, disk, data.FirstLBA, data.Sectors(), fat.FAT32)
+}
+
+func TestFormat_MBRClearsGPT(t *testing.T) {
+	disk := fs.NewMemoryDisk(128 * 1024 * 1024)
+	config := &fat.SuperFloppyConfig{FATType: fat.FAT32}
+
+	layout := &Layout{Scheme: GPT, Partitions: []*Partition{{Config: config}}}
+	if err := Format(disk, layout); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	layout = &Layout{Scheme: MBR, Partitions: []*Partition{{Config: config}}}
+	if err := Format(disk, layout); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Neither copy of the old GPT header is left
+	if _, err := gpt.Decode(disk); err == nil {
+		t.Fatal("should not find a GPT")
+	}
+
+	if _, err := mbr.Decode(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFormat_invalid(t *testing.T) {
+	disk := fs.NewMemoryDisk(128 * 1024 * 1024)
+	config := &fat.SuperFloppyConfig{FATType: fat.FAT16}
+
+	layouts := []*Layout{
+		{Scheme: MBR},
+		{Scheme: MBR, Partitions: []*Partition{{Sectors: 32768}}},
+		{Scheme: MBR, Partitions: []*Partition{{Config: config}, {Sectors: 32768, Config: config}}},
+		{Scheme: MBR, Partitions: []*Partition{{Sectors: 300000, Config: config}}},
+		{Scheme: GPT, Partitions: []*Partition{{Sectors: 300000, Config: config}}},
+		{Scheme: MBR, Partitions: []*Partition{
+			{Sectors: 20000, Config: config},
+			{Sectors: 20000, Config: config},
+			{Sectors: 20000, Config: config},
+			{Sectors: 20000, Config: config},
+			{Sectors: 20000, Config: config},
+		}},
+	}
+
+	for i, layout := range layouts {
+		if err := Format(disk, layout); err == nil {
+			t.Fatalf("layout %d should error", i)
+		}
+	}
+}
+
+func TestMBRType(t *testing.T) {
+	cases := []struct {
+		fatType  fat.FATType
+		last     uint64
+		sectors  uint64
+		expected byte
+	}{
+		{fat.FAT12, 4096, 2048, mbr.TypeFAT12},
+		{fat.FAT16, 34815, 32768, mbr.TypeFAT16Small},
+		{fat.FAT16, 264191, 262144, mbr.TypeFAT16},
+		{fat.FAT16, mbr.CHSLimit, 262144, mbr.TypeFAT16LBA},
+		{fat.FAT32, 264191, 262144, mbr.TypeFAT32},
+		{fat.FAT32, mbr.CHSLimit + 2048, mbr.CHSLimit, mbr.TypeFAT32LBA},
+	}
+
+	for _, c := range cases {
+		if actual := mbrType(c.fatType, c.last, c.sectors); actual != c.expected {
+			t.Fatalf("bad type for %s: 0x%02X", c.fatType, actual)
+		}
+	}
+}
+
+// testFormatPartition checks that the partition with the given sectors
+// holds a usable FAT file system that knows where its partition starts.
+func testFormatPartition(t *testing.T, disk fs.BlockDevice, first, sectors uint64, fatType fat.FATType) {
+	part, err := fs.NewSectionDevice(disk, int64(first)*512, int64(sectors)*512)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := fat.DecodeBootSector(part)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if bs.HiddenSectors != uint32(first) || bs.TotalSectors != uint32(sectors) {
+		t.Fatalf("bad boot sector: %d %d", bs.HiddenSectors, bs.TotalSectors)
+	}
+
+	if bs.NumHeads != mbr.Heads || bs.SectorsPerTrack != mbr.SectorsPerTrack {
+		t.Fatalf("bad geometry: %d %d", bs.NumHeads, bs.SectorsPerTrack)
+	}
+
+	if bs.FATType() != fatType {
+		t.Fatalf("bad FAT type: %s", bs.FATType())
+	}
+
+	filesys, err := fat.New(part)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ := filesys.RootDir()
+	if _, err := rootDir.AddFile("hello.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
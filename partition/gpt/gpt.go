@@ -0,0 +1,614 @@
+package gpt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"unicode/utf16"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/partition/mbr"
+)
+
+// The defaults for the partition entry array of a new GPT.
+const (
+	DefaultEntries   = 128
+	DefaultEntrySize = 128
+)
+
+// The revision of the GPT headers that are written, 1.0.
+const Revision = 0x00010000
+
+// New partitions are aligned to 1MB by Allocate.
+const Alignment = 1024 * 1024
+
+// The partition attributes that are defined for every partition type.
+// The high 16 bits are specific to the partition type.
+const (
+	AttrRequired           uint64 = 1 << 0
+	AttrNoBlockIO          uint64 = 1 << 1
+	AttrLegacyBIOSBootable uint64 = 1 << 2
+)
+
+// The longest partition name, in UTF-16 code units.
+const MaxNameLength = 36
+
+var headerSignature = []byte("EFI PART")
+
+// Header is a GPT header. There is a primary header in the second sector
+// of the disk, and a backup header in the last sector.
+type Header struct {
+	Revision   uint32
+	HeaderSize uint32
+
+	// CurrentLBA is the sector of this header and BackupLBA is the
+	// sector of the other one.
+	CurrentLBA uint64
+	BackupLBA  uint64
+
+	// FirstUsableLBA and LastUsableLBA are the sectors that partitions
+	// can use.
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+
+	DiskGUID GUID
+
+	// PartitionEntryLBA is the first sector of the partition entry array
+	// that belongs to this header.
+	PartitionEntryLBA   uint64
+	NumPartitionEntries uint32
+	PartitionEntrySize  uint32
+}
+
+// Table is a GUID partition table.
+type Table struct {
+	// Header is the primary header. The backup header is the same, with
+	// the locations of the header and the partition entries swapped to
+	// the end of the disk.
+	Header Header
+
+	// Partitions are the partitions in use, ordered by number.
+	Partitions []*Partition
+
+	// PrimaryErr and BackupErr are the reasons the primary or backup
+	// copy of the table is invalid, or nil if it is valid. The table is
+	// decoded from the primary copy if possible, otherwise from the
+	// backup copy. WriteToDevice rewrites both.
+	PrimaryErr error
+	BackupErr  error
+
+	// EntryErrs are the reasons entries of the partition entry array
+	// were left out of Partitions, such as a partition that overlaps an
+	// earlier one or lies outside of the usable sectors. Bad entries
+	// don't make a copy of the table invalid, as its CRC32s still hold.
+	// WriteToDevice drops them.
+	EntryErrs []error
+
+	sectorSize int
+	sectors    uint64
+}
+
+// Partition is a single entry of the partition table.
+type Partition struct {
+	// Number is the index of the entry in the partition entry array,
+	// counting from 1.
+	Number int
+
+	Type GUID
+	GUID GUID
+
+	// FirstLBA and LastLBA are the first and last sectors of the
+	// partition, inclusive.
+	FirstLBA uint64
+	LastLBA  uint64
+
+	Attributes uint64
+	Name       string
+}
+
+// Decode reads the GPT of the device. The device must start with a
+// protective MBR, otherwise any GPT on it is stale and the disk is taken
+// for an MBR disk. Both the primary and the backup copies are validated,
+// including their CRC32s, and the first valid one is used. It is an
+// error if neither is valid.
+func Decode(device fs.BlockDevice) (*Table, error) {
+	result := &Table{
+		sectorSize: device.SectorSize(),
+		sectors:    uint64(device.Len()) / uint64(device.SectorSize()),
+	}
+
+	if result.sectors < 3 {
+		return nil, errors.New("device too small for a GPT")
+	}
+
+	if err := checkProtectiveMBR(device); err != nil {
+		return nil, err
+	}
+
+	primary, primaryPartitions, primaryEntryErrs, err := result.readCopy(device, 1)
+	result.PrimaryErr = err
+
+	backupLBA := result.sectors - 1
+	if err == nil {
+		backupLBA = primary.BackupLBA
+	}
+
+	backup, backupPartitions, backupEntryErrs, err := result.readCopy(device, backupLBA)
+	result.BackupErr = err
+
+	switch {
+	case result.PrimaryErr == nil:
+		result.Header = *primary
+		result.Partitions = primaryPartitions
+		result.EntryErrs = primaryEntryErrs
+	case result.BackupErr == nil:
+		// Turn the backup header into the primary header it stands for
+		result.Header = *backup
+		result.Header.CurrentLBA, result.Header.BackupLBA = backup.BackupLBA, backup.CurrentLBA
+		result.Header.PartitionEntryLBA = 2
+		result.Partitions = backupPartitions
+		result.EntryErrs = backupEntryErrs
+	default:
+		return nil, fmt.Errorf("no valid GPT: primary: %s, backup: %s",
+			result.PrimaryErr, result.BackupErr)
+	}
+
+	return result, nil
+}
+
+// New returns an empty GPT for the device, with a new random disk GUID
+// and the default partition entry array. Nothing is written until
+// WriteToDevice is called.
+func New(device fs.BlockDevice) (*Table, error) {
+	diskGUID, err := NewRandomGUID()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Table{
+		sectorSize: device.SectorSize(),
+		sectors:    uint64(device.Len()) / uint64(device.SectorSize()),
+	}
+
+	entrySectors := uint64(DefaultEntries*DefaultEntrySize+result.sectorSize-1) / uint64(result.sectorSize)
+	if result.sectors < 3+2*entrySectors {
+		return nil, errors.New("device too small for a GPT")
+	}
+
+	result.Header = Header{
+		Revision:            Revision,
+		HeaderSize:          92,
+		CurrentLBA:          1,
+		BackupLBA:           result.sectors - 1,
+		FirstUsableLBA:      2 + entrySectors,
+		LastUsableLBA:       result.sectors - 2 - entrySectors,
+		DiskGUID:            diskGUID,
+		PartitionEntryLBA:   2,
+		NumPartitionEntries: DefaultEntries,
+		PartitionEntrySize:  DefaultEntrySize,
+	}
+
+	return result, nil
+}
+
+// Partition returns the partition with the given number, or nil.
+func (t *Table) Partition(number int) *Partition {
+	for _, p := range t.Partitions {
+		if p.Number == number {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Add adds a partition to the table. If its number is 0, the first free
+// entry is used, and if its GUID is zero a random one is generated. The
+// partition must be within the usable sectors and must not overlap any
+// other partition. Use Allocate to find room for it.
+func (t *Table) Add(p *Partition) error {
+	if p.Type == TypeUnused {
+		return errors.New("partition type must be set")
+	}
+
+	if p.Number == 0 {
+		for number := 1; number <= int(t.Header.NumPartitionEntries); number++ {
+			if t.Partition(number) == nil {
+				p.Number = number
+				break
+			}
+		}
+
+		if p.Number == 0 {
+			return errors.New("partition table full")
+		}
+	}
+
+	if p.GUID == (GUID{}) {
+		guid, err := NewRandomGUID()
+		if err != nil {
+			return err
+		}
+
+		p.GUID = guid
+	}
+
+	if err := t.validate(p, nil); err != nil {
+		return err
+	}
+
+	t.Partitions = append(t.Partitions, p)
+	sort.Slice(t.Partitions, func(i, j int) bool {
+		return t.Partitions[i].Number < t.Partitions[j].Number
+	})
+
+	return nil
+}
+
+// Delete removes the partition with the given number from the table.
+func (t *Table) Delete(number int) error {
+	for i, p := range t.Partitions {
+		if p.Number == number {
+			t.Partitions = append(t.Partitions[:i], t.Partitions[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no partition %d", number)
+}
+
+// Resize changes the length of the partition with the given number to
+// the given number of sectors. The partition keeps its first sector.
+func (t *Table) Resize(number int, sectors uint64) error {
+	p := t.Partition(number)
+	if p == nil {
+		return fmt.Errorf("no partition %d", number)
+	}
+
+	if sectors == 0 {
+		return errors.New("partition must have at least one sector")
+	}
+
+	resized := *p
+	resized.LastLBA = p.FirstLBA + sectors - 1
+	if err := t.validate(&resized, p); err != nil {
+		return err
+	}
+
+	p.LastLBA = resized.LastLBA
+	return nil
+}
+
+// Allocate returns the first sector of the first free space that can
+// hold the given number of sectors, aligned to Alignment.
+func (t *Table) Allocate(sectors uint64) (uint64, error) {
+	if sectors == 0 {
+		return 0, errors.New("partition must have at least one sector")
+	}
+
+	align := uint64(Alignment / t.sectorSize)
+	first := alignUp(t.Header.FirstUsableLBA, align)
+	for {
+		if first+sectors-1 > t.Header.LastUsableLBA {
+			return 0, errors.New("no free space large enough")
+		}
+
+		last := first + sectors - 1
+		overlap := false
+		for _, p := range t.Partitions {
+			if first <= p.LastLBA && p.FirstLBA <= last {
+				first = alignUp(p.LastLBA+1, align)
+				overlap = true
+				break
+			}
+		}
+
+		if !overlap {
+			return first, nil
+		}
+	}
+}
+
+// WriteToDevice writes a protective MBR and both copies of the GPT to
+// the device.
+func (t *Table) WriteToDevice(device fs.BlockDevice) error {
+	entries, err := t.entriesBytes()
+	if err != nil {
+		return err
+	}
+
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	entrySectors := (uint64(len(entries)) + uint64(t.sectorSize) - 1) / uint64(t.sectorSize)
+
+	backup := t.Header
+	backup.CurrentLBA, backup.BackupLBA = t.Header.BackupLBA, t.Header.CurrentLBA
+	backup.PartitionEntryLBA = t.Header.LastUsableLBA + 1
+
+	if backup.PartitionEntryLBA+entrySectors > backup.CurrentLBA ||
+		t.Header.PartitionEntryLBA+entrySectors > t.Header.FirstUsableLBA {
+		return errors.New("partition entries overlap the usable sectors")
+	}
+
+	// The backup is written first, so that there is always one valid
+	// copy if the writes are interrupted.
+	for _, header := range []*Header{&backup, &t.Header} {
+		offset := int64(header.PartitionEntryLBA) * int64(t.sectorSize)
+		if _, err := device.WriteAt(entries, offset); err != nil {
+			return err
+		}
+
+		offset = int64(header.CurrentLBA) * int64(t.sectorSize)
+		if _, err := device.WriteAt(header.bytes(t.sectorSize, entriesCRC), offset); err != nil {
+			return err
+		}
+	}
+
+	sectors := t.sectors - 1
+	if sectors > 0xFFFFFFFF {
+		sectors = 0xFFFFFFFF
+	}
+
+	protective := &mbr.MBR{}
+	protective.Entries[0] = mbr.Entry{
+		FirstCHS: [3]byte{0x00, 0x02, 0x00},
+		Type:     mbr.TypeGPTProtective,
+		LastCHS:  [3]byte{0xFF, 0xFF, 0xFF},
+		StartLBA: 1,
+		Sectors:  uint32(sectors),
+	}
+
+	if err := protective.WriteToDevice(device); err != nil {
+		return err
+	}
+
+	t.PrimaryErr = nil
+	t.BackupErr = nil
+	t.EntryErrs = nil
+	return nil
+}
+
+// Sectors returns the length of the partition in sectors.
+func (p *Partition) Sectors() uint64 {
+	return p.LastLBA - p.FirstLBA + 1
+}
+
+// Device returns a BlockDevice for just this partition of the given
+// device, which must be the device the table belongs to.
+func (p *Partition) Device(device fs.BlockDevice) (*fs.SectionDevice, error) {
+	sectorSize := int64(device.SectorSize())
+	return fs.NewSectionDevice(device, int64(p.FirstLBA)*sectorSize, int64(p.Sectors())*sectorSize)
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("partition %d %q: type %s, sectors %d-%d",
+		p.Number, p.Name, p.Type, p.FirstLBA, p.LastLBA)
+}
+
+// readCopy reads and validates the header in the given sector and the
+// partition entries that belong to it. Entries that don't fit in the
+// table are left out, with the reasons returned separately.
+func (t *Table) readCopy(device fs.BlockDevice, lba uint64) (*Header, []*Partition, []error, error) {
+	if lba >= t.sectors {
+		return nil, nil, nil, fmt.Errorf("header sector %d is past the end of the disk", lba)
+	}
+
+	data := make([]byte, t.sectorSize)
+	if _, err := device.ReadAt(data, int64(lba)*int64(t.sectorSize)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !bytes.Equal(data[0:8], headerSignature) {
+		return nil, nil, nil, errors.New("missing header signature")
+	}
+
+	header := &Header{
+		Revision:            binary.LittleEndian.Uint32(data[8:12]),
+		HeaderSize:          binary.LittleEndian.Uint32(data[12:16]),
+		CurrentLBA:          binary.LittleEndian.Uint64(data[24:32]),
+		BackupLBA:           binary.LittleEndian.Uint64(data[32:40]),
+		FirstUsableLBA:      binary.LittleEndian.Uint64(data[40:48]),
+		LastUsableLBA:       binary.LittleEndian.Uint64(data[48:56]),
+		PartitionEntryLBA:   binary.LittleEndian.Uint64(data[72:80]),
+		NumPartitionEntries: binary.LittleEndian.Uint32(data[80:84]),
+		PartitionEntrySize:  binary.LittleEndian.Uint32(data[84:88]),
+	}
+	copy(header.DiskGUID[:], data[56:72])
+
+	if header.HeaderSize < 92 || int(header.HeaderSize) > t.sectorSize {
+		return nil, nil, nil, fmt.Errorf("invalid header size: %d", header.HeaderSize)
+	}
+
+	headerCRC := binary.LittleEndian.Uint32(data[16:20])
+	binary.LittleEndian.PutUint32(data[16:20], 0)
+	if crc32.ChecksumIEEE(data[:header.HeaderSize]) != headerCRC {
+		return nil, nil, nil, errors.New("header CRC32 mismatch")
+	}
+
+	if header.CurrentLBA != lba {
+		return nil, nil, nil, fmt.Errorf("header in sector %d says it is in sector %d", lba, header.CurrentLBA)
+	}
+
+	if header.FirstUsableLBA > header.LastUsableLBA || header.LastUsableLBA >= t.sectors {
+		return nil, nil, nil, errors.New("invalid usable sectors")
+	}
+
+	if header.PartitionEntrySize < 128 || header.PartitionEntrySize%8 != 0 ||
+		header.NumPartitionEntries > 65536 {
+		return nil, nil, nil, errors.New("invalid partition entry array")
+	}
+
+	size := int64(header.NumPartitionEntries) * int64(header.PartitionEntrySize)
+	offset := int64(header.PartitionEntryLBA) * int64(t.sectorSize)
+	if offset+size > int64(t.sectors)*int64(t.sectorSize) {
+		return nil, nil, nil, errors.New("partition entry array is past the end of the disk")
+	}
+
+	entries := make([]byte, size)
+	if _, err := device.ReadAt(entries, offset); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(data[88:92]) {
+		return nil, nil, nil, errors.New("partition entry array CRC32 mismatch")
+	}
+
+	// Validate the partitions against the header that was just read
+	// rather than the one of the table.
+	decoded := &Table{Header: *header, sectorSize: t.sectorSize, sectors: t.sectors}
+	var entryErrs []error
+	for i := 0; i < int(header.NumPartitionEntries); i++ {
+		entry := entries[i*int(header.PartitionEntrySize):]
+
+		var p Partition
+		copy(p.Type[:], entry[0:16])
+		if p.Type == TypeUnused {
+			continue
+		}
+
+		p.Number = i + 1
+		copy(p.GUID[:], entry[16:32])
+		p.FirstLBA = binary.LittleEndian.Uint64(entry[32:40])
+		p.LastLBA = binary.LittleEndian.Uint64(entry[40:48])
+		p.Attributes = binary.LittleEndian.Uint64(entry[48:56])
+		p.Name = decodeName(entry[56:128])
+
+		if err := decoded.validate(&p, nil); err != nil {
+			entryErrs = append(entryErrs, err)
+			continue
+		}
+
+		decoded.Partitions = append(decoded.Partitions, &p)
+	}
+
+	return header, decoded.Partitions, entryErrs, nil
+}
+
+// checkProtectiveMBR checks that the MBR of the device has a protective
+// partition for a GPT. Only the signature and the types of the four
+// entries are looked at: the protective partition often doesn't match
+// the size of the disk, and a hybrid MBR may hold any other entries.
+func checkProtectiveMBR(device fs.BlockDevice) error {
+	data := make([]byte, mbr.Size)
+	if _, err := device.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	if data[510] != 0x55 || data[511] != 0xAA {
+		return errors.New("no protective MBR: missing boot record signature")
+	}
+
+	for i := 0; i < 4; i++ {
+		if data[446+16*i+4] == mbr.TypeGPTProtective {
+			return nil
+		}
+	}
+
+	return errors.New("no protective MBR: MBR has no GPT protective partition")
+}
+
+// validate checks that the partition fits in the table. The ignore
+// partition, if not nil, is the partition that p replaces.
+func (t *Table) validate(p *Partition, ignore *Partition) error {
+	if p.Number < 1 || p.Number > int(t.Header.NumPartitionEntries) {
+		return fmt.Errorf("invalid partition number: %d", p.Number)
+	}
+
+	if p.FirstLBA > p.LastLBA {
+		return fmt.Errorf("partition %d ends before it starts", p.Number)
+	}
+
+	if p.FirstLBA < t.Header.FirstUsableLBA || p.LastLBA > t.Header.LastUsableLBA {
+		return fmt.Errorf("partition %d is outside of the usable sectors", p.Number)
+	}
+
+	if len(utf16.Encode([]rune(p.Name))) > MaxNameLength {
+		return fmt.Errorf("partition %d name too long", p.Number)
+	}
+
+	for _, other := range t.Partitions {
+		if other == ignore {
+			continue
+		}
+
+		if other.Number == p.Number {
+			return fmt.Errorf("partition %d already exists", p.Number)
+		}
+
+		if p.FirstLBA <= other.LastLBA && other.FirstLBA <= p.LastLBA {
+			return fmt.Errorf("partition %d overlaps partition %d", p.Number, other.Number)
+		}
+	}
+
+	return nil
+}
+
+// entriesBytes returns the raw partition entry array.
+func (t *Table) entriesBytes() ([]byte, error) {
+	size := int(t.Header.PartitionEntrySize)
+	result := make([]byte, int(t.Header.NumPartitionEntries)*size)
+	for _, p := range t.Partitions {
+		if p.Number < 1 || p.Number > int(t.Header.NumPartitionEntries) {
+			return nil, fmt.Errorf("invalid partition number: %d", p.Number)
+		}
+
+		entry := result[(p.Number-1)*size:]
+		copy(entry[0:16], p.Type[:])
+		copy(entry[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(entry[32:40], p.FirstLBA)
+		binary.LittleEndian.PutUint64(entry[40:48], p.LastLBA)
+		binary.LittleEndian.PutUint64(entry[48:56], p.Attributes)
+		for i, c := range utf16.Encode([]rune(p.Name)) {
+			if i == MaxNameLength {
+				break
+			}
+
+			binary.LittleEndian.PutUint16(entry[56+2*i:], c)
+		}
+	}
+
+	return result, nil
+}
+
+// bytes returns the raw header sector, with the CRC32s filled in.
+func (h *Header) bytes(sectorSize int, entriesCRC uint32) []byte {
+	data := make([]byte, sectorSize)
+	copy(data[0:8], headerSignature)
+	binary.LittleEndian.PutUint32(data[8:12], h.Revision)
+	binary.LittleEndian.PutUint32(data[12:16], h.HeaderSize)
+	binary.LittleEndian.PutUint64(data[24:32], h.CurrentLBA)
+	binary.LittleEndian.PutUint64(data[32:40], h.BackupLBA)
+	binary.LittleEndian.PutUint64(data[40:48], h.FirstUsableLBA)
+	binary.LittleEndian.PutUint64(data[48:56], h.LastUsableLBA)
+	copy(data[56:72], h.DiskGUID[:])
+	binary.LittleEndian.PutUint64(data[72:80], h.PartitionEntryLBA)
+	binary.LittleEndian.PutUint32(data[80:84], h.NumPartitionEntries)
+	binary.LittleEndian.PutUint32(data[84:88], h.PartitionEntrySize)
+	binary.LittleEndian.PutUint32(data[88:92], entriesCRC)
+	binary.LittleEndian.PutUint32(data[16:20], crc32.ChecksumIEEE(data[:h.HeaderSize]))
+	return data
+}
+
+func decodeName(data []byte) string {
+	chars := make([]uint16, 0, MaxNameLength)
+	for i := 0; i+1 < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+
+		chars = append(chars, c)
+	}
+
+	return string(utf16.Decode(chars))
+}
+
+func alignUp(n, align uint64) uint64 {
+	if align == 0 {
+		return n
+	}
+
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,389 @@
+package gpt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+	"github.com/mitchellh/go-fs/partition/mbr"
+)
+
+func TestGUID(t *testing.T) {
+	g := MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+
+	expected := GUID{
+		0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11,
+		0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B,
+	}
+
+	if g != expected {
+		t.Fatalf("bad GUID: % X", g[:])
+	}
+
+	if g.String() != "C12A7328-F81F-11D2-BA4B-00A0C93EC93B" {
+		t.Fatalf("bad string: %s", g)
+	}
+
+	if _, err := ParseGUID("C12A7328-F81F-11D2-BA4B"); err == nil {
+		t.Fatal("should error on an invalid GUID")
+	}
+
+	random, err := NewRandomGUID()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if random[7]>>4 != 4 || random[8]>>6 != 2 {
+		t.Fatalf("bad version: %s", random)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	disk, table := testDisk(t)
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil || decoded.BackupErr != nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+
+	if decoded.Header != table.Header {
+		t.Fatalf("bad header: %#v", decoded.Header)
+	}
+
+	if !reflect.DeepEqual(decoded.Partitions, table.Partitions) {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+
+	p := decoded.Partition(2)
+	if p == nil || p.Name != "Linüx data" || p.Attributes != AttrLegacyBIOSBootable {
+		t.Fatalf("bad partition: %v", p)
+	}
+
+	// The protective MBR covers the whole disk
+	m, err := mbr.Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry := m.Entries[0]
+	if entry.Type != mbr.TypeGPTProtective || entry.StartLBA != 1 || entry.Sectors != 131071 {
+		t.Fatalf("bad protective MBR: %#v", entry)
+	}
+}
+
+func TestDecode_primaryCorrupt(t *testing.T) {
+	disk, table := testDisk(t)
+
+	// Break the CRC32 of the primary partition entries
+	disk.WriteAt([]byte{0xFF}, 2*512+200)
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr == nil || decoded.BackupErr != nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+
+	if decoded.Header != table.Header {
+		t.Fatalf("bad header: %#v", decoded.Header)
+	}
+
+	if !reflect.DeepEqual(decoded.Partitions, table.Partitions) {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+
+	// Writing it out repairs the primary copy
+	if err := decoded.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err = Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil {
+		t.Fatalf("err: %s", decoded.PrimaryErr)
+	}
+}
+
+func TestDecode_bothCorrupt(t *testing.T) {
+	disk, _ := testDisk(t)
+
+	// Break the signature of both headers
+	disk.WriteAt([]byte("X"), 512)
+	disk.WriteAt([]byte("X"), 131071*512)
+
+	if _, err := Decode(disk); err == nil {
+		t.Fatal("should error if both copies are invalid")
+	}
+
+	if _, err := Decode(fs.NewMemoryDisk(1024 * 1024)); err == nil {
+		t.Fatal("should error without a GPT")
+	}
+}
+
+func TestDecode_missingBackup(t *testing.T) {
+	disk, table := testDisk(t)
+
+	// Grow the disk, so that the backup header the primary points to is
+	// no longer in the last sector, then lose it
+	data := make([]byte, disk.Len())
+	disk.ReadAt(data, 0)
+	disk = fs.NewMemoryDisk(2 * disk.Len())
+	disk.WriteAt(data, 0)
+	disk.WriteAt(make([]byte, 512), 131071*512)
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil || decoded.BackupErr == nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+
+	if decoded.Header != table.Header || decoded.Header.BackupLBA != 131071 {
+		t.Fatalf("bad header: %#v", decoded.Header)
+	}
+
+	if !reflect.DeepEqual(decoded.Partitions, table.Partitions) {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+
+	// Writing it out puts the backup back where the primary says it is
+	if err := decoded.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err = Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil || decoded.BackupErr != nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+}
+
+func TestDecode_badEntry(t *testing.T) {
+	disk, table := testDisk(t)
+	expected := append([]*Partition(nil), table.Partitions...)
+
+	// An entry that overlaps the first partition, with valid CRC32s
+	table.Partitions = append(table.Partitions, &Partition{
+		Number:   3,
+		Type:     TypeLinuxSwap,
+		FirstLBA: 4000,
+		LastLBA:  5000,
+	})
+
+	if err := table.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil || decoded.BackupErr != nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+
+	if len(decoded.EntryErrs) != 1 {
+		t.Fatalf("bad entry errors: %v", decoded.EntryErrs)
+	}
+
+	if !reflect.DeepEqual(decoded.Partitions, expected) {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+}
+
+func TestDecode_noProtectiveMBR(t *testing.T) {
+	disk, _ := testDisk(t)
+
+	// Overwrite the protective MBR, as a tool that only knows MBRs does
+	m := &mbr.MBR{}
+	m.Entries[0] = mbr.Entry{Type: mbr.TypeFAT32LBA, StartLBA: 2048, Sectors: 16384}
+	if err := m.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := Decode(disk); err == nil {
+		t.Fatal("should error without a protective MBR")
+	}
+}
+
+func TestDecode_oddProtectiveMBR(t *testing.T) {
+	disk, table := testDisk(t)
+
+	// A protective partition that covers 0xFFFFFFFF sectors no matter
+	// the size of the disk, in a hybrid MBR with an extended partition
+	// that points past the end of the disk
+	m := &mbr.MBR{}
+	m.Entries[0] = mbr.Entry{Type: mbr.TypeGPTProtective, StartLBA: 1, Sectors: 0xFFFFFFFF}
+	m.Entries[1] = mbr.Entry{Type: mbr.TypeExtendedLBA, StartLBA: 200000, Sectors: 1000}
+	if err := m.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Partitions, table.Partitions) {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+}
+
+func TestTable_Add(t *testing.T) {
+	_, table := testDisk(t)
+
+	// Overlaps the first partition
+	err := table.Add(&Partition{Type: TypeLinuxSwap, FirstLBA: 4000, LastLBA: 5000})
+	if err == nil {
+		t.Fatal("should error on overlap")
+	}
+
+	err = table.Add(&Partition{Type: TypeLinuxSwap, FirstLBA: 10, LastLBA: 100})
+	if err == nil {
+		t.Fatal("should error outside of the usable sectors")
+	}
+
+	err = table.Add(&Partition{Type: TypeLinuxSwap, FirstLBA: 100000, LastLBA: 100100, Name: "this name is far too long for a GPT partition"})
+	if err == nil {
+		t.Fatal("should error on a long name")
+	}
+
+	first, err := table.Allocate(2048)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The first free 1MB after the second partition
+	if first != 2048+16384+8192 {
+		t.Fatalf("bad first sector: %d", first)
+	}
+
+	p := &Partition{Type: TypeLinuxSwap, FirstLBA: first, LastLBA: first + 2047}
+	if err := table.Add(p); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.Number != 3 || p.GUID == (GUID{}) {
+		t.Fatalf("bad partition: %v", p)
+	}
+
+	if _, err := table.Allocate(200000); err == nil {
+		t.Fatal("should error if there is no room")
+	}
+}
+
+func TestTable_DeleteResize(t *testing.T) {
+	disk, table := testDisk(t)
+
+	if err := table.Resize(1, 20000); err == nil {
+		t.Fatal("should error when growing into the next partition")
+	}
+
+	if err := table.Delete(2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := table.Delete(2); err == nil {
+		t.Fatal("should error on a missing partition")
+	}
+
+	if err := table.Resize(1, 20000); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := table.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(decoded.Partitions) != 1 || decoded.Partition(1).Sectors() != 20000 {
+		t.Fatalf("bad partitions: %v", decoded.Partitions)
+	}
+}
+
+func TestPartition_Device(t *testing.T) {
+	disk, table := testDisk(t)
+
+	p := table.Partition(1)
+	part, err := p.Device(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if part.Offset() != int64(p.FirstLBA)*512 || part.Len() != int64(p.Sectors())*512 {
+		t.Fatalf("bad section: %d %d", part.Offset(), part.Len())
+	}
+
+	config := &fat.SuperFloppyConfig{FATType: fat.FAT16}
+	if err := fat.FormatSuperFloppy(part, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	filesys, err := fat.New(part)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	rootDir, _ := filesys.RootDir()
+	if _, err := rootDir.AddFile("hello.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The partition table is still intact
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if decoded.PrimaryErr != nil || decoded.BackupErr != nil {
+		t.Fatalf("bad copies: %s, %s", decoded.PrimaryErr, decoded.BackupErr)
+	}
+}
+
+// testDisk returns a 64MB disk with a GPT that holds a FAT partition and
+// a Linux partition, along with the table that was written.
+func testDisk(t *testing.T) (*fs.MemoryDisk, *Table) {
+	disk := fs.NewMemoryDisk(64 * 1024 * 1024)
+
+	table, err := New(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	partitions := []*Partition{
+		{Type: TypeMicrosoftBasicData, FirstLBA: 2048, LastLBA: 2048 + 16383, Name: "DATA"},
+		{Type: TypeLinuxFilesystem, FirstLBA: 2048 + 16384, LastLBA: 2048 + 16384 + 8191, Name: "Linüx data", Attributes: AttrLegacyBIOSBootable},
+	}
+
+	for _, p := range partitions {
+		if err := table.Add(p); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := table.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return disk, table
+}
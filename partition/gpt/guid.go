@@ -0,0 +1,79 @@
+package gpt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a GUID as it is stored on disk. The first three groups are
+// little-endian and the last two are big-endian.
+type GUID [16]byte
+
+// The partition type GUIDs that are commonly found in a GPT.
+var (
+	TypeUnused             = GUID{}
+	TypeEFISystem          = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TypeBIOSBoot           = MustParseGUID("21686148-6449-6E6F-744E-656564454649")
+	TypeMicrosoftBasicData = MustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	TypeMicrosoftReserved  = MustParseGUID("E3C9E316-0B5C-4DB8-817D-F92DF00215AE")
+	TypeLinuxFilesystem    = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	TypeLinuxSwap          = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+)
+
+// ParseGUID parses a GUID in its usual text form, such as
+// "C12A7328-F81F-11D2-BA4B-00A0C93EC93B".
+func ParseGUID(s string) (GUID, error) {
+	var result GUID
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 ||
+		len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return result, fmt.Errorf("invalid GUID: %s", s)
+	}
+
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return result, fmt.Errorf("invalid GUID: %s", s)
+	}
+
+	binary.LittleEndian.PutUint32(result[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(result[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(result[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(result[8:], raw[8:])
+	return result, nil
+}
+
+// MustParseGUID is like ParseGUID but panics if the GUID is invalid.
+func MustParseGUID(s string) GUID {
+	result, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return result
+}
+
+// NewRandomGUID returns a new random (version 4) GUID.
+func NewRandomGUID() (GUID, error) {
+	var result GUID
+	if _, err := rand.Read(result[:]); err != nil {
+		return result, err
+	}
+
+	// The version is in the high bits of the little-endian third group
+	result[7] = (result[7] & 0x0F) | 0x40
+	result[8] = (result[8] & 0x3F) | 0x80
+	return result, nil
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10],
+		g[10:16])
+}
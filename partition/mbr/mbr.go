@@ -0,0 +1,320 @@
+package mbr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/go-fs"
+)
+
+// The partition types that are commonly found in an MBR.
+const (
+	TypeEmpty         byte = 0x00
+	TypeFAT12         byte = 0x01
+	TypeFAT16Small    byte = 0x04
+	TypeExtended      byte = 0x05
+	TypeFAT16         byte = 0x06
+	TypeNTFS          byte = 0x07
+	TypeFAT32         byte = 0x0B
+	TypeFAT32LBA      byte = 0x0C
+	TypeFAT16LBA      byte = 0x0E
+	TypeExtendedLBA   byte = 0x0F
+	TypeLinuxSwap     byte = 0x82
+	TypeLinux         byte = 0x83
+	TypeLinuxExtended byte = 0x85
+	TypeGPTProtective byte = 0xEE
+	TypeEFISystem     byte = 0xEF
+)
+
+// The most logical partitions that are followed in an EBR chain, which
+// guards against loops in a corrupt chain.
+const MaxLogicalPartitions = 128
+
+// The size of an MBR in bytes.
+const Size = 512
+
+// The disk geometry that CHS addresses are computed with, and the
+// number of sectors that can be addressed with it. Partitions past that
+// need one of the LBA partition types.
+const (
+	Heads           = 255
+	SectorsPerTrack = 63
+	CHSLimit        = 1024 * Heads * SectorsPerTrack
+)
+
+// MBR is the master boot record at the start of a partitioned disk.
+type MBR struct {
+	// BootCode is the boot loader code at the start of the MBR.
+	BootCode [440]byte
+
+	// DiskSignature identifies the disk.
+	DiskSignature uint32
+
+	// Entries are the four entries of the partition table. Unused
+	// entries have TypeEmpty.
+	Entries [4]Entry
+
+	// Partitions are the primary partitions, followed by the logical
+	// partitions in the order of the EBR chain. Empty entries and the
+	// extended partition itself are left out.
+	Partitions []*Partition
+}
+
+// Entry is a single entry of the partition table of an MBR or EBR.
+type Entry struct {
+	Bootable bool
+	FirstCHS [3]byte
+	Type     byte
+	LastCHS  [3]byte
+
+	// StartLBA is the first sector of the partition. For the entries of
+	// an EBR this is relative to the EBR or to the extended partition.
+	StartLBA uint32
+	Sectors  uint32
+}
+
+// Partition is a primary or logical partition of a disk.
+type Partition struct {
+	// Number is the number of the partition as Linux counts them, 1 to
+	// 4 for primary partitions and 5 on for logical partitions.
+	Number int
+
+	Bootable bool
+	Type     byte
+	Logical  bool
+
+	// StartLBA is the first sector of the partition on the disk, and
+	// Sectors is its length in sectors.
+	StartLBA uint64
+	Sectors  uint64
+}
+
+// Decode reads the MBR of the device, following the EBR chain of an
+// extended partition to find the logical partitions.
+func Decode(device fs.BlockDevice) (*MBR, error) {
+	data, err := readSector(device, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var result MBR
+	copy(result.BootCode[:], data[0:440])
+	result.DiskSignature = binary.LittleEndian.Uint32(data[440:444])
+	for i := range result.Entries {
+		result.Entries[i] = decodeEntry(data[446+16*i:])
+	}
+
+	sectors := uint64(device.Len()) / uint64(device.SectorSize())
+	for i, entry := range result.Entries {
+		if entry.Type == TypeEmpty {
+			continue
+		}
+
+		if uint64(entry.StartLBA)+uint64(entry.Sectors) > sectors {
+			return nil, fmt.Errorf("partition %d extends past the end of the disk", i+1)
+		}
+
+		if entry.IsExtended() {
+			continue
+		}
+
+		result.Partitions = append(result.Partitions, &Partition{
+			Number:   i + 1,
+			Bootable: entry.Bootable,
+			Type:     entry.Type,
+			StartLBA: uint64(entry.StartLBA),
+			Sectors:  uint64(entry.Sectors),
+		})
+	}
+
+	for _, entry := range result.Entries {
+		if entry.IsExtended() {
+			logical, err := decodeEBRChain(device, entry)
+			if err != nil {
+				return nil, err
+			}
+
+			result.Partitions = append(result.Partitions, logical...)
+			break
+		}
+	}
+
+	return &result, nil
+}
+
+// Bytes returns the raw bytes of the MBR. Only the four entries of the
+// partition table are written, the EBR chain of an extended partition is
+// not.
+func (m *MBR) Bytes() []byte {
+	data := make([]byte, Size)
+	copy(data[0:440], m.BootCode[:])
+	binary.LittleEndian.PutUint32(data[440:444], m.DiskSignature)
+	for i, entry := range m.Entries {
+		entry.encode(data[446+16*i:])
+	}
+
+	data[510] = 0x55
+	data[511] = 0xAA
+	return data
+}
+
+// WriteToDevice writes the MBR to the first sector of the device.
+func (m *MBR) WriteToDevice(device fs.BlockDevice) error {
+	_, err := device.WriteAt(m.Bytes(), 0)
+	return err
+}
+
+// Partition returns the partition with the given number, or nil.
+func (m *MBR) Partition(number int) *Partition {
+	for _, p := range m.Partitions {
+		if p.Number == number {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// CHS returns the CHS address of the given sector, as it is stored in an
+// entry. Sectors past CHSLimit get the largest address, as is usual.
+func CHS(lba uint64) [3]byte {
+	if lba >= CHSLimit {
+		return [3]byte{0xFE, 0xFF, 0xFF}
+	}
+
+	cylinder := lba / (Heads * SectorsPerTrack)
+	head := (lba / SectorsPerTrack) % Heads
+	sector := lba%SectorsPerTrack + 1
+	return [3]byte{
+		byte(head),
+		byte(sector) | byte(cylinder>>2)&0xC0,
+		byte(cylinder),
+	}
+}
+
+// IsExtended returns true if the entry is an extended partition, which
+// holds an EBR chain of logical partitions.
+func (e *Entry) IsExtended() bool {
+	switch e.Type {
+	case TypeExtended, TypeExtendedLBA, TypeLinuxExtended:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsFAT returns true if the partition has one of the FAT partition
+// types.
+func (p *Partition) IsFAT() bool {
+	switch p.Type {
+	case TypeFAT12, TypeFAT16Small, TypeFAT16, TypeFAT32, TypeFAT32LBA, TypeFAT16LBA:
+		return true
+	default:
+		return false
+	}
+}
+
+// Device returns a BlockDevice for just this partition of the given
+// device, which must be the device the MBR was decoded from.
+func (p *Partition) Device(device fs.BlockDevice) (*fs.SectionDevice, error) {
+	sectorSize := int64(device.SectorSize())
+	return fs.NewSectionDevice(device, int64(p.StartLBA)*sectorSize, int64(p.Sectors)*sectorSize)
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("partition %d: type 0x%02X, %d sectors at %d",
+		p.Number, p.Type, p.Sectors, p.StartLBA)
+}
+
+// decodeEBRChain follows the chain of EBRs of the extended partition and
+// returns its logical partitions. The first entry of every EBR is a
+// logical partition relative to the EBR, and the second entry points at
+// the next EBR relative to the start of the extended partition.
+func decodeEBRChain(device fs.BlockDevice, extended Entry) ([]*Partition, error) {
+	var result []*Partition
+	start := uint64(extended.StartLBA)
+	end := start + uint64(extended.Sectors)
+	visited := make(map[uint64]bool)
+
+	ebr := start
+	for {
+		if len(result) >= MaxLogicalPartitions || visited[ebr] {
+			return nil, errors.New("loop in the EBR chain")
+		}
+		visited[ebr] = true
+
+		data, err := readSector(device, ebr)
+		if err != nil {
+			return nil, fmt.Errorf("EBR at sector %d: %s", ebr, err)
+		}
+
+		logical := decodeEntry(data[446:])
+		next := decodeEntry(data[462:])
+
+		if logical.Type != TypeEmpty {
+			partition := &Partition{
+				Number:   5 + len(result),
+				Bootable: logical.Bootable,
+				Type:     logical.Type,
+				Logical:  true,
+				StartLBA: ebr + uint64(logical.StartLBA),
+				Sectors:  uint64(logical.Sectors),
+			}
+
+			if partition.StartLBA+partition.Sectors > end {
+				return nil, fmt.Errorf("partition %d extends past the extended partition", partition.Number)
+			}
+
+			result = append(result, partition)
+		}
+
+		if next.Type == TypeEmpty || next.StartLBA == 0 {
+			return result, nil
+		}
+
+		ebr = start + uint64(next.StartLBA)
+		if ebr >= end {
+			return nil, fmt.Errorf("EBR at sector %d is outside of the extended partition", ebr)
+		}
+	}
+}
+
+func decodeEntry(data []byte) Entry {
+	var result Entry
+	result.Bootable = data[0]&0x80 != 0
+	copy(result.FirstCHS[:], data[1:4])
+	result.Type = data[4]
+	copy(result.LastCHS[:], data[5:8])
+	result.StartLBA = binary.LittleEndian.Uint32(data[8:12])
+	result.Sectors = binary.LittleEndian.Uint32(data[12:16])
+	return result
+}
+
+func (e *Entry) encode(data []byte) {
+	data[0] = 0
+	if e.Bootable {
+		data[0] = 0x80
+	}
+
+	copy(data[1:4], e.FirstCHS[:])
+	data[4] = e.Type
+	copy(data[5:8], e.LastCHS[:])
+	binary.LittleEndian.PutUint32(data[8:12], e.StartLBA)
+	binary.LittleEndian.PutUint32(data[12:16], e.Sectors)
+}
+
+// readSector reads the boot record in the given sector and checks its
+// signature.
+func readSector(device fs.BlockDevice, sector uint64) ([]byte, error) {
+	data := make([]byte, Size)
+	if _, err := device.ReadAt(data, int64(sector)*int64(device.SectorSize())); err != nil {
+		return nil, err
+	}
+
+	if data[510] != 0x55 || data[511] != 0xAA {
+		return nil, errors.New("missing boot record signature")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,190 @@
+package mbr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mitchellh/go-fs"
+	"github.com/mitchellh/go-fs/fat"
+)
+
+func TestDecode(t *testing.T) {
+	disk := testDisk(t)
+
+	m, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if m.DiskSignature != 0x12345678 {
+		t.Fatalf("bad signature: %x", m.DiskSignature)
+	}
+
+	expected := []Partition{
+		{Number: 1, Bootable: true, Type: TypeFAT16LBA, StartLBA: 2048, Sectors: 32768},
+		{Number: 5, Type: TypeFAT32LBA, Logical: true, StartLBA: 34816 + 2048, Sectors: 16384},
+		{Number: 6, Type: TypeLinux, Logical: true, StartLBA: 53248 + 2048, Sectors: 8192},
+	}
+
+	if len(m.Partitions) != len(expected) {
+		t.Fatalf("bad partitions: %v", m.Partitions)
+	}
+
+	for i, p := range m.Partitions {
+		if *p != expected[i] {
+			t.Fatalf("bad partition: %s", p)
+		}
+	}
+
+	if !m.Entries[1].IsExtended() || m.Partition(5) != m.Partitions[1] || m.Partition(2) != nil {
+		t.Fatal("extended partition should be left out")
+	}
+}
+
+func TestDecode_noSignature(t *testing.T) {
+	if _, err := Decode(fs.NewMemoryDisk(1024 * 1024)); err == nil {
+		t.Fatal("should error without a signature")
+	}
+}
+
+func TestDecode_ebrLoop(t *testing.T) {
+	disk := testDisk(t)
+
+	// Point the second EBR at itself
+	testWriteEntry(disk, 53248, 1, TypeExtended, 18432, 16384)
+	if _, err := Decode(disk); err == nil {
+		t.Fatal("should error on a loop")
+	}
+}
+
+func TestDecode_pastEnd(t *testing.T) {
+	disk := testDisk(t)
+	testWriteEntry(disk, 0, 2, TypeLinux, 130000, 10000)
+	if _, err := Decode(disk); err == nil {
+		t.Fatal("should error if a partition doesn't fit")
+	}
+}
+
+func TestPartition_Device(t *testing.T) {
+	disk := testDisk(t)
+	m, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, p := range []*Partition{m.Partition(1), m.Partition(5)} {
+		part, err := p.Device(disk)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if part.Offset() != int64(p.StartLBA)*512 || part.Len() != int64(p.Sectors)*512 {
+			t.Fatalf("bad section: %d %d", part.Offset(), part.Len())
+		}
+
+		config := &fat.SuperFloppyConfig{FATType: fat.FAT16}
+		if err := fat.FormatSuperFloppy(part, config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		filesys, err := fat.New(part)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		rootDir, _ := filesys.RootDir()
+		if _, err := rootDir.AddFile("hello.txt"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The partition table is still intact
+	m, err = Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(m.Partitions) != 3 {
+		t.Fatalf("bad partitions: %v", m.Partitions)
+	}
+}
+
+func TestMBR_Bytes(t *testing.T) {
+	disk := testDisk(t)
+	m, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := make([]byte, Size)
+	disk.ReadAt(data, 0)
+	if !bytes.Equal(m.Bytes(), data) {
+		t.Fatal("should encode to the same bytes")
+	}
+
+	m.Entries[2] = Entry{Type: TypeLinux, StartLBA: 80000, Sectors: 1000}
+	if err := m.WriteToDevice(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	m, err = Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p := m.Partition(3); p == nil || p.StartLBA != 80000 || p.Sectors != 1000 {
+		t.Fatalf("bad partition: %v", p)
+	}
+}
+
+func TestCHS(t *testing.T) {
+	cases := []struct {
+		lba      uint64
+		expected [3]byte
+	}{
+		{0, [3]byte{0x00, 0x01, 0x00}},
+		{2048, [3]byte{0x20, 0x21, 0x00}},
+		{1023*255*63 + 254*63 + 62, [3]byte{0xFE, 0xFF, 0xFF}},
+		{CHSLimit + 100, [3]byte{0xFE, 0xFF, 0xFF}},
+	}
+
+	for _, c := range cases {
+		if actual := CHS(c.lba); actual != c.expected {
+			t.Fatalf("bad CHS for %d: % X", c.lba, actual)
+		}
+	}
+}
+
+// testDisk returns a 64MB disk with a FAT16 partition and an extended
+// partition holding a FAT32 and a Linux logical partition.
+func testDisk(t *testing.T) *fs.MemoryDisk {
+	disk := fs.NewMemoryDisk(64 * 1024 * 1024)
+
+	var signature [4]byte
+	binary.LittleEndian.PutUint32(signature[:], 0x12345678)
+	disk.WriteAt(signature[:], 440)
+
+	testWriteEntry(disk, 0, 0, TypeFAT16LBA, 2048, 32768)
+	disk.WriteAt([]byte{0x80}, 446)
+	testWriteEntry(disk, 0, 1, TypeExtendedLBA, 34816, 40960)
+
+	// The EBR chain, with the next EBR relative to the extended partition
+	testWriteEntry(disk, 34816, 0, TypeFAT32LBA, 2048, 16384)
+	testWriteEntry(disk, 34816, 1, TypeExtended, 18432, 10240)
+	testWriteEntry(disk, 53248, 0, TypeLinux, 2048, 8192)
+
+	return disk
+}
+
+// testWriteEntry writes an entry of the boot record in the given sector,
+// along with the boot record signature.
+func testWriteEntry(disk *fs.MemoryDisk, sector int64, index int, partType byte, start, sectors uint32) {
+	var entry [16]byte
+	entry[4] = partType
+	binary.LittleEndian.PutUint32(entry[8:12], start)
+	binary.LittleEndian.PutUint32(entry[12:16], sectors)
+
+	disk.WriteAt(entry[:], sector*512+446+int64(index)*16)
+	disk.WriteAt([]byte{0x55, 0xAA}, sector*512+510)
+}
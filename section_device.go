@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"errors"
+	"io"
+)
+
+// A SectionDevice is a BlockDevice that is a section of another
+// BlockDevice, such as a partition of a disk. Offsets are relative to the
+// start of the section, and nothing outside of it can be read or
+// written.
+type SectionDevice struct {
+	device BlockDevice
+	offset int64
+	size   int64
+}
+
+// NewSectionDevice returns a SectionDevice for the size bytes of the
+// device that start at the given offset.
+func NewSectionDevice(device BlockDevice, offset, size int64) (*SectionDevice, error) {
+	if offset < 0 || size < 0 || offset+size > device.Len() {
+		return nil, errors.New("section is outside of the device")
+	}
+
+	result := &SectionDevice{
+		device: device,
+		offset: offset,
+		size:   size,
+	}
+
+	return result, nil
+}
+
+// Close does nothing, since the device the section is part of may still
+// be in use. Close that device instead.
+func (s *SectionDevice) Close() error {
+	return nil
+}
+
+func (s *SectionDevice) Len() int64 {
+	return s.size
+}
+
+func (s *SectionDevice) SectorSize() int {
+	return s.device.SectorSize()
+}
+
+// Offset returns the offset of the section in the device it is part of.
+func (s *SectionDevice) Offset() int64 {
+	return s.offset
+}
+
+func (s *SectionDevice) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if off >= s.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > s.size-off {
+		p = p[:s.size-off]
+		err = io.EOF
+	}
+
+	n, rerr := s.device.ReadAt(p, s.offset+off)
+	if rerr != nil {
+		err = rerr
+	}
+
+	return
+}
+
+func (s *SectionDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if off+int64(len(p)) > s.size {
+		return 0, errors.New("write past the end of the section")
+	}
+
+	return s.device.WriteAt(p, s.offset+off)
+}
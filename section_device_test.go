@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"io"
+	"testing"
+)
+
+func TestSectionDeviceImplementsBlockDevice(t *testing.T) {
+	var raw interface{}
+	raw = new(SectionDevice)
+	if _, ok := raw.(BlockDevice); !ok {
+		t.Fatal("SectionDevice should be a BlockDevice")
+	}
+}
+
+func TestSectionDevice(t *testing.T) {
+	disk := NewMemoryDisk(64 * 512)
+	if _, err := NewSectionDevice(disk, 32*512, 33*512); err == nil {
+		t.Fatal("should error if the section doesn't fit")
+	}
+
+	section, err := NewSectionDevice(disk, 8*512, 16*512)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if section.Len() != 16*512 || section.Offset() != 8*512 {
+		t.Fatalf("bad: %d %d", section.Len(), section.Offset())
+	}
+
+	if _, err := section.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := make([]byte, 5)
+	disk.ReadAt(data, 8*512)
+	if string(data) != "hello" {
+		t.Fatalf("bad data: %q", data)
+	}
+
+	if _, err := section.WriteAt([]byte("hello"), 16*512-4); err == nil {
+		t.Fatal("should not write past the end")
+	}
+
+	n, err := section.ReadAt(data, 16*512-4)
+	if n != 4 || err != io.EOF {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}